@@ -0,0 +1,151 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+// defaultDeletionGrace is how long a deleted account can still be restored
+// by signing in again
+const defaultDeletionGrace = 30 * 24 * time.Hour
+
+// accountDeletionGrace reads the grace period from GRAYNOTE_DELETION_GRACE
+func accountDeletionGrace() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("GRAYNOTE_DELETION_GRACE")); err == nil && d >= 0 {
+		return d
+	}
+	return defaultDeletionGrace
+}
+
+// ChangeEmail moves the account to a confirmed new address. Verifications
+// still outstanding for either address are spent.
+func (u *User) ChangeEmail(email string) {
+	now := time.Now().UTC()
+	u.Email = normalizeEmail(email)
+	u.EmailVerifiedAt = &now
+
+	_, err := db.Exec("UPDATE users SET email=?, email_verified_at=? WHERE id=?", u.Email, now, u.ID)
+	checkErr(err, "change user email")
+
+	destroyEmailVerificationsForUser(u)
+	releaseCollaboratorInvites(u)
+	claimCollaboratorInvites(u)
+}
+
+// RequestDeletion schedules the account to be purged after the grace period.
+// Shares are suspended and every client is signed out straight away.
+// Collaborators and API keys are revoked for good; cancelling doesn't bring
+// them back.
+func (u *User) RequestDeletion() {
+	now := time.Now().UTC()
+	u.DeletionRequestedAt = &now
+
+	_, err := db.Exec("UPDATE users SET deletion_requested_at=? WHERE id=?", now, u.ID)
+	checkErr(err, "request user deletion")
+
+	_, err = db.Exec("UPDATE shares SET suspended=1 WHERE note_id IN (SELECT id FROM notes WHERE user_id=?)", u.ID)
+	checkErr(err, "suspend user shares")
+
+	_, err = db.Exec("DELETE FROM share_sessions WHERE share_id IN (SELECT id FROM shares WHERE note_id IN (SELECT id FROM notes WHERE user_id=?))", u.ID)
+	checkErr(err, "end user share sessions")
+
+	_, err = db.Exec("DELETE FROM collaborators WHERE note_id IN (SELECT id FROM notes WHERE user_id=?)", u.ID)
+	checkErr(err, "revoke user collaborators")
+
+	_, err = db.Exec("DELETE FROM api_keys WHERE user_id=?", u.ID)
+	checkErr(err, "revoke user api keys")
+
+	destroyPasswordResetsForUser(u)
+	u.RevokeTokens()
+}
+
+// CancelDeletion keeps an account whose deletion is still pending, and
+// lifts the suspension of its shares
+func (u *User) CancelDeletion() {
+	u.DeletionRequestedAt = nil
+
+	_, err := db.Exec("UPDATE users SET deletion_requested_at=NULL WHERE id=?", u.ID)
+	checkErr(err, "cancel user deletion")
+
+	_, err = db.Exec("UPDATE shares SET suspended=0 WHERE note_id IN (SELECT id FROM notes WHERE user_id=?)", u.ID)
+	checkErr(err, "restore user shares")
+}
+
+// DeletionScheduledFor returns when a pending deletion will be carried out
+func (u User) DeletionScheduledFor() *time.Time {
+	if u.DeletionRequestedAt == nil {
+		return nil
+	}
+	at := u.DeletionRequestedAt.Add(accountDeletionGrace())
+	return &at
+}
+
+// userTables lists tables holding rows owned through a user_id column
+var userTables = []string{"notes", "api_keys", "password_resets", "email_verifications", "recovery_codes", "two_factor_challenges", "user_identities", "idempotency_keys", "collaborators", "comments"}
+
+// purgeDeletedUsers removes accounts whose grace period has passed, along
+// with everything they own. It returns the number of accounts removed.
+func purgeDeletedUsers(grace time.Duration) int {
+	rows, err := db.Query(
+		"SELECT id FROM users WHERE deletion_requested_at IS NOT NULL AND deletion_requested_at < ?",
+		time.Now().UTC().Add(-grace))
+	checkErr(err, "find deleted users")
+
+	var userIDs []int
+	for rows.Next() {
+		var id int
+		rows.Scan(&id)
+		userIDs = append(userIDs, id)
+	}
+	rows.Close()
+
+	for _, id := range userIDs {
+		purgeUser(id)
+	}
+	return len(userIDs)
+}
+
+func purgeUser(userID int) {
+	// Archives live on disk as well as in the database
+	for _, export := range findExportsByUserID(userID) {
+		export.Destroy()
+	}
+
+	tx, err := db.Begin()
+	checkErr(err, "begin purge user")
+
+	_, err = tx.Exec("DELETE FROM share_sessions WHERE share_id IN (SELECT id FROM shares WHERE note_id IN (SELECT id FROM notes WHERE user_id=?))", userID)
+	checkErr(err, "purge user share sessions")
+
+	_, err = tx.Exec("DELETE FROM shares WHERE note_id IN (SELECT id FROM notes WHERE user_id=?)", userID)
+	checkErr(err, "purge user shares")
+
+	_, err = tx.Exec("DELETE FROM collaborators WHERE note_id IN (SELECT id FROM notes WHERE user_id=?)", userID)
+	checkErr(err, "purge user collaborators")
+
+	_, err = tx.Exec("DELETE FROM share_activity WHERE note_id IN (SELECT id FROM notes WHERE user_id=?)", userID)
+	checkErr(err, "purge user share activity")
+
+	_, err = tx.Exec("DELETE FROM comments WHERE note_id IN (SELECT id FROM notes WHERE user_id=?)", userID)
+	checkErr(err, "purge user note comments")
+
+	for _, table := range userTables {
+		_, err = tx.Exec("DELETE FROM "+table+" WHERE user_id=?", userID)
+		checkErr(err, "purge user "+table)
+	}
+
+	_, err = tx.Exec("DELETE FROM users WHERE id=?", userID)
+	checkErr(err, "purge user")
+
+	checkErr(tx.Commit(), "commit purge user")
+}
+
+// sweepDeletedUsers purges expired accounts every interval
+func sweepDeletedUsers(interval time.Duration) {
+	for range time.Tick(interval) {
+		if purged := purgeDeletedUsers(accountDeletionGrace()); purged > 0 {
+			log.Printf("purged %d deleted accounts", purged)
+		}
+	}
+}
@@ -3,7 +3,11 @@ package main
 // APIError field error message
 import (
 	"encoding/json"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
 )
 
 // APIError message for building API error
@@ -12,8 +16,9 @@ type APIError struct {
 	Message string
 }
 
+// optionsHandler answers preflight requests; CORS headers come from corsMiddleware
 func optionsHandler(w http.ResponseWriter, r *http.Request) {
-	apiApplyCorsHeaders(w, r)
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func apiErrorHandler(w http.ResponseWriter, r *http.Request, status int, errors []APIError) {
@@ -28,18 +33,133 @@ func apiErrorHandler(w http.ResponseWriter, r *http.Request, status int, errors
 	w.Write(b)
 }
 
+// apiAuthenticateUser finds the user for the X-Auth-Token header, falling
+// back to the session cookie, and records failures and API key usage
 func apiAuthenticateUser(r *http.Request) *User {
-	if len(r.Header["X-Auth-Token"]) != 1 {
+	user, failure := requestUser(r)
+	if user == nil {
+		authFailuresTotal.WithLabelValues(failure).Inc()
 		return nil
 	}
 
-	token := r.Header["X-Auth-Token"][0]
-	return findUserByAuthToken(token)
+	if user.APIKey != nil {
+		user.APIKey.Touch()
+	}
+	return user
+}
+
+// requestUser resolves the credential on r without side effects. Cookie
+// authenticated requests that change state must carry a CSRF token. On
+// failure it returns the reason: missing, invalid or csrf.
+func requestUser(r *http.Request) (*User, string) {
+	var token string
+	if len(r.Header["X-Auth-Token"]) == 1 {
+		token = r.Header["X-Auth-Token"][0]
+	} else if token = sessionAuthToken(r); len(token) > 0 && !safeMethod(r.Method) && !validCsrfToken(r) {
+		return nil, "csrf"
+	}
+
+	if len(token) == 0 {
+		return nil, "missing"
+	}
+
+	var user *User
+	if strings.HasPrefix(token, apiKeyPrefix) {
+		user = findUserByAPIKey(token)
+	} else {
+		user = findUserByAuthToken(token)
+	}
+	if user == nil {
+		return nil, "invalid"
+	}
+	return user, ""
 }
 
-func apiApplyCorsHeaders(w http.ResponseWriter, r *http.Request) {
-	origin := r.Header.Get("Origin")
-	w.Header().Set("Access-Control-Allow-Origin", origin)
-	w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Origin, X-Auth-Token")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, POST, DELETE, OPTIONS")
+// findUserByAPIKey finds the owner of an unexpired API key, carrying the key
+// on the user so handlers can check its scopes
+func findUserByAPIKey(token string) *User {
+	key := findAPIKeyByToken(token)
+	if key == nil {
+		return nil
+	}
+
+	user := findUserByID(int64(key.UserID))
+	if user == nil {
+		return nil
+	}
+
+	user.APIKey = key
+	return user
+}
+
+// apiRequireScope writes a 403 and returns false if the credential user
+// authenticated with was not granted scope
+func apiRequireScope(w http.ResponseWriter, r *http.Request, user *User, scope string) bool {
+	if user.HasScope(scope) {
+		return true
+	}
+
+	apiErrorHandler(w, r, http.StatusForbidden, []APIError{
+		{Field: "error", Message: "insufficient_scope"},
+		{Field: "scope", Message: scope},
+	})
+	return false
+}
+
+// apiRequireNote writes a 403 and returns false if the credential user
+// authenticated with is restricted to other notes
+func apiRequireNote(w http.ResponseWriter, r *http.Request, user *User, noteID int) bool {
+	if user.AllowsNote(noteID) {
+		return true
+	}
+
+	apiErrorHandler(w, r, http.StatusForbidden, []APIError{{Field: "error", Message: "note_not_permitted"}})
+	return false
+}
+
+// apiParseForm parses the request's form, writing a 400 and returning false
+// if it is malformed
+func apiParseForm(w http.ResponseWriter, r *http.Request) bool {
+	if err := r.ParseForm(); err != nil {
+		apiErrorHandler(w, r, http.StatusBadRequest, []APIError{{Field: "form", Message: "is invalid"}})
+		return false
+	}
+	return true
+}
+
+// trustedProxyHops reads GRAYNOTE_TRUST_PROXY, the number of proxies in
+// front of the server. "true" means one.
+func trustedProxyHops() int {
+	trust := os.Getenv("GRAYNOTE_TRUST_PROXY")
+	if trust == "true" {
+		return 1
+	}
+	if hops, err := strconv.Atoi(trust); err == nil && hops > 0 {
+		return hops
+	}
+	return 0
+}
+
+// clientIP returns the address of the caller. X-Forwarded-For is only
+// trusted when GRAYNOTE_TRUST_PROXY is set. Each proxy appends the address
+// it received the request from, so the caller is counted from the right;
+// anything further left was sent by the client and may be forged.
+func clientIP(r *http.Request) string {
+	if hops := trustedProxyHops(); hops > 0 {
+		var forwarded []string
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			forwarded = append(forwarded, strings.Split(header, ",")...)
+		}
+		if len(forwarded) >= hops {
+			if ip := strings.TrimSpace(forwarded[len(forwarded)-hops]); len(ip) > 0 {
+				return ip
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
 }
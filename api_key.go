@@ -0,0 +1,235 @@
+package main
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiKeyPrefix marks API keys so they can share the X-Auth-Token header
+const apiKeyPrefix = "gnk_"
+
+// maxAPIKeyNotes caps how many notes a single key may be restricted to
+const maxAPIKeyNotes = 100
+
+// Scopes grantable to API keys
+const (
+	scopeNotesRead    = "notes:read"
+	scopeNotesWrite   = "notes:write"
+	scopeSharesManage = "shares:manage"
+	// scopeAccount covers account settings and is never granted to a key
+	scopeAccount = "account"
+)
+
+var apiKeyScopes = []string{scopeNotesRead, scopeNotesWrite, scopeSharesManage}
+
+// APIKey is a scoped credential for scripts and integrations. Only a hash of
+// the key is stored. An empty NoteIDs list allows every note of the user.
+type APIKey struct {
+	ID         int
+	UserID     int
+	Name       string
+	KeyHash    string
+	KeyPrefix  string
+	Scopes     []string
+	NoteIDs    []int
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+	CreatedAt  time.Time
+}
+
+const apiKeyColumns = "id, user_id, name, key_hash, key_prefix, scopes, note_ids, expires_at, last_used_at, created_at"
+
+// ValidateAPIKeyScope checks scope is one a key may be granted
+func ValidateAPIKeyScope(scope string) bool {
+	for _, s := range apiKeyScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// createAPIKey stores a new key for user and returns it with the plain key,
+// which is only ever shown once
+func createAPIKey(user *User, name string, scopes []string, noteIDs []int, expiresAt *time.Time) (*APIKey, string) {
+	plain := apiKeyPrefix + randomToken()
+	key := &APIKey{
+		UserID:    user.ID,
+		Name:      name,
+		KeyHash:   hashToken(plain),
+		KeyPrefix: plain[:len(apiKeyPrefix)+6],
+		Scopes:    scopes,
+		NoteIDs:   noteIDs,
+		ExpiresAt: expiresAt,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+	}
+
+	stmt, err := db.Prepare("INSERT api_keys SET user_id=?, name=?, key_hash=?, key_prefix=?, scopes=?, note_ids=?, expires_at=?, created_at=?")
+	if err != nil {
+		checkErr(err, "prepare create api key")
+	} else {
+		defer stmt.Close()
+	}
+	res, err := stmt.Exec(
+		key.UserID,
+		key.Name,
+		key.KeyHash,
+		key.KeyPrefix,
+		strings.Join(key.Scopes, " "),
+		joinIDs(key.NoteIDs),
+		key.ExpiresAt,
+		key.CreatedAt)
+	checkErr(err, "create api key")
+
+	id, err := res.LastInsertId()
+	checkErr(err, "create api key id")
+	key.ID = int(id)
+
+	return key, plain
+}
+
+// findAPIKeyByToken returns the key for a plain token if it has not expired
+func findAPIKeyByToken(token string) *APIKey {
+	var key *APIKey
+
+	rows, err := db.Query(
+		"SELECT "+apiKeyColumns+" FROM api_keys WHERE key_hash=? AND (expires_at IS NULL OR expires_at > ?)",
+		hashToken(token),
+		time.Now().UTC())
+	if err != nil {
+		checkErr(err, "find api key by token")
+	} else {
+		defer rows.Close()
+	}
+
+	if rows.Next() {
+		key = apiKeyFromDbRows(rows)
+	}
+	return key
+}
+
+func findAPIKeyByID(keyID int64) *APIKey {
+	var key *APIKey
+
+	rows, err := db.Query("SELECT "+apiKeyColumns+" FROM api_keys WHERE id=?", keyID)
+	if err != nil {
+		checkErr(err, "find api key by id")
+	} else {
+		defer rows.Close()
+	}
+
+	if rows.Next() {
+		key = apiKeyFromDbRows(rows)
+	}
+	return key
+}
+
+func findAPIKeysByUser(user *User) []*APIKey {
+	var keys []*APIKey
+
+	rows, err := db.Query("SELECT "+apiKeyColumns+" FROM api_keys WHERE user_id=? ORDER BY id", user.ID)
+	if err != nil {
+		checkErr(err, "find api keys by user")
+	} else {
+		defer rows.Close()
+	}
+
+	for rows.Next() {
+		keys = append(keys, apiKeyFromDbRows(rows))
+	}
+	return keys
+}
+
+// Touch records that the key was just used
+func (k *APIKey) Touch() {
+	now := time.Now().UTC()
+	k.LastUsedAt = &now
+
+	_, err := db.Exec("UPDATE api_keys SET last_used_at=? WHERE id=?", now, k.ID)
+	checkErr(err, "touch api key")
+}
+
+// Destroy revokes the key
+func (k *APIKey) Destroy() {
+	_, err := db.Exec("DELETE FROM api_keys WHERE id=?", k.ID)
+	checkErr(err, "destroy api key")
+}
+
+// HasScope returns if the key was granted scope
+func (k APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsNote returns if the key may touch the note with noteID
+func (k APIKey) AllowsNote(noteID int) bool {
+	if len(k.NoteIDs) == 0 {
+		return true
+	}
+	for _, id := range k.NoteIDs {
+		if id == noteID {
+			return true
+		}
+	}
+	return false
+}
+
+// Restricted returns if the key is limited to particular notes
+func (k APIKey) Restricted() bool {
+	return len(k.NoteIDs) > 0
+}
+
+// HasScope returns if the credential the user authenticated with grants
+// scope. Auth tokens and sessions grant everything.
+func (u User) HasScope(scope string) bool {
+	return u.APIKey == nil || u.APIKey.HasScope(scope)
+}
+
+// AllowsNote returns if the credential the user authenticated with may touch
+// the note with noteID
+func (u User) AllowsNote(noteID int) bool {
+	return u.APIKey == nil || u.APIKey.AllowsNote(noteID)
+}
+
+func apiKeyFromDbRows(rows *sql.Rows) *APIKey {
+	key := new(APIKey)
+	var scopes, noteIDs string
+	rows.Scan(
+		&key.ID,
+		&key.UserID,
+		&key.Name,
+		&key.KeyHash,
+		&key.KeyPrefix,
+		&scopes,
+		&noteIDs,
+		&key.ExpiresAt,
+		&key.LastUsedAt,
+		&key.CreatedAt)
+	key.Scopes = strings.Fields(scopes)
+	key.NoteIDs = splitIDs(noteIDs)
+	return key
+}
+
+func joinIDs(ids []int) string {
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = strconv.Itoa(id)
+	}
+	return strings.Join(parts, ",")
+}
+
+func splitIDs(joined string) []int {
+	var ids []int
+	for _, part := range strings.Split(joined, ",") {
+		if id, err := strconv.Atoi(part); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/schema"
+)
+
+type apiKeyRequestParameters struct {
+	Name      string   `schema:"name"`
+	Scopes    []string `schema:"scopes"`
+	NoteIDs   []int    `schema:"note_ids"`
+	ExpiresAt string   `schema:"expires_at"`
+}
+
+type apiKeySuccessResponse struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Key        string     `json:"key,omitempty"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	NoteIDs    []int      `json:"note_ids"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+func apiKeyIndexHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Authenticate
+	user := apiAuthenticateUser(r)
+	if user == nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if !apiRequireScope(w, r, user, scopeAccount) {
+		return
+	}
+
+	response := []apiKeySuccessResponse{}
+	for _, key := range findAPIKeysByUser(user) {
+		response = append(response, apiKeyResponse(key, ""))
+	}
+	responseJSON, _ := json.Marshal(response)
+	w.Write(responseJSON)
+}
+
+func apiKeyCreateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Authenticate
+	user := apiAuthenticateUser(r)
+	if user == nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if !apiRequireScope(w, r, user, scopeAccount) {
+		return
+	}
+
+	if !apiParseForm(w, r) {
+		return
+	}
+
+	params := new(apiKeyRequestParameters)
+	decoder := schema.NewDecoder()
+	decoder.IgnoreUnknownKeys(true)
+	decodeErr := decoder.Decode(params, r.PostForm)
+
+	var errors []APIError
+
+	// Validate Name
+	if len(params.Name) == 0 {
+		errors = append(errors, APIError{Field: "name", Message: "is required"})
+	} else if len(params.Name) > 255 {
+		errors = append(errors, APIError{Field: "name", Message: "is too long"})
+	}
+
+	// Validate Scopes
+	if len(params.Scopes) == 0 {
+		errors = append(errors, APIError{Field: "scopes", Message: "is required"})
+	}
+	for _, scope := range params.Scopes {
+		if !ValidateAPIKeyScope(scope) {
+			errors = append(errors, APIError{Field: "scopes", Message: "is invalid"})
+			break
+		}
+	}
+
+	// Validate Notes are owned by User
+	if decodeErr != nil {
+		errors = append(errors, APIError{Field: "note_ids", Message: "is invalid"})
+	} else if len(params.NoteIDs) > maxAPIKeyNotes {
+		errors = append(errors, APIError{Field: "note_ids", Message: "has too many notes"})
+	}
+	for _, noteID := range params.NoteIDs {
+		if note := findNoteByID(int64(noteID)); note == nil || note.UserID != user.ID {
+			errors = append(errors, APIError{Field: "note_ids", Message: "is invalid"})
+			break
+		}
+	}
+
+	// Validate Expiry
+	var expiresAt *time.Time
+	if len(params.ExpiresAt) > 0 {
+		t, err := time.Parse(time.RFC3339, params.ExpiresAt)
+		if err != nil || !t.After(time.Now()) {
+			errors = append(errors, APIError{Field: "expires_at", Message: "is invalid"})
+		} else {
+			t = t.UTC().Truncate(time.Second)
+			expiresAt = &t
+		}
+	}
+
+	if len(errors) > 0 {
+		apiErrorHandler(w, r, http.StatusBadRequest, errors)
+		return
+	}
+
+	key, plain := createAPIKey(user, params.Name, params.Scopes, params.NoteIDs, expiresAt)
+
+	// Success message, the only time the key is shown
+	w.WriteHeader(http.StatusCreated)
+	responseJSON, _ := json.Marshal(apiKeyResponse(key, plain))
+	w.Write(responseJSON)
+}
+
+func apiKeyDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Authenticate
+	user := apiAuthenticateUser(r)
+	if user == nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if !apiRequireScope(w, r, user, scopeAccount) {
+		return
+	}
+
+	keyID, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	key := findAPIKeyByID(keyID)
+
+	// Key not found or invalid owner
+	if key == nil || key.UserID != user.ID {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	key.Destroy()
+	w.Write([]byte("{}"))
+}
+
+func apiKeyResponse(key *APIKey, plain string) apiKeySuccessResponse {
+	noteIDs := key.NoteIDs
+	if noteIDs == nil {
+		noteIDs = []int{}
+	}
+
+	return apiKeySuccessResponse{
+		ID:         key.ID,
+		Name:       key.Name,
+		Key:        plain,
+		Prefix:     key.KeyPrefix,
+		Scopes:     key.Scopes,
+		NoteIDs:    noteIDs,
+		ExpiresAt:  key.ExpiresAt,
+		LastUsedAt: key.LastUsedAt,
+		CreatedAt:  key.CreatedAt,
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func apiKeyRequest(method string, path string, token string, body string) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+	r.Header.Set("X-Auth-Token", token)
+	w := httptest.NewRecorder()
+	router().ServeHTTP(w, r)
+	return w
+}
+
+func TestAPIKeyCreateHandler(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+
+	w := apiKeyRequest("POST", "/users/api-keys", user.AuthToken, "name=backup&scopes=notes:read&scopes=shares:manage")
+
+	if w.Code != 201 {
+		t.Fatalf("Expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var response apiKeySuccessResponse
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if !strings.HasPrefix(response.Key, apiKeyPrefix) || !strings.HasPrefix(response.Key, response.Prefix) {
+		t.Errorf("Expected a prefixed key, got %q", response.Key)
+	}
+
+	key := findAPIKeyByToken(response.Key)
+	if key == nil || !key.HasScope(scopeNotesRead) || !key.HasScope(scopeSharesManage) || key.HasScope(scopeNotesWrite) {
+		t.Fatalf("Expected the key to be stored with its scopes")
+	}
+	if key.KeyHash == response.Key {
+		t.Errorf("Expected only a hash of the key to be stored")
+	}
+}
+
+func TestAPIKeyCreateHandlerFailValidation(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	other := factoryCreateUser("other@site.com")
+	note := createNote(other, "title", "body")
+
+	w := apiKeyRequest("POST", "/users/api-keys", user.AuthToken,
+		"scopes=notes:admin&expires_at=2001-01-01T00:00:00Z&note_ids="+strconv.Itoa(note.ID))
+
+	if w.Code != 400 {
+		t.Errorf("Expected 400, got %d", w.Code)
+	}
+	expectedBody := "{\"expires_at\":\"is invalid\",\"name\":\"is required\",\"note_ids\":\"is invalid\",\"scopes\":\"is invalid\"}"
+	if b := w.Body.String(); b != expectedBody {
+		t.Errorf("Expected %q, got %q", expectedBody, b)
+	}
+}
+
+func TestAPIKeyCreateHandlerMalformedForm(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+
+	w := apiKeyRequest("POST", "/users/api-keys", user.AuthToken, "name=%zz")
+	if w.Code != 400 || w.Body.String() != "{\"form\":\"is invalid\"}" {
+		t.Errorf("Expected 400 for the form, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestAPIKeyCannotManageAccount(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	_, plain := createAPIKey(user, "key", []string{scopeNotesRead, scopeNotesWrite, scopeSharesManage}, nil, nil)
+
+	w := apiKeyRequest("POST", "/users/api-keys", plain, "name=escalate&scopes=notes:read")
+
+	if w.Code != 403 {
+		t.Errorf("Expected 403, got %d", w.Code)
+	}
+	expectedBody := "{\"error\":\"insufficient_scope\",\"scope\":\"account\"}"
+	if b := w.Body.String(); b != expectedBody {
+		t.Errorf("Expected %q, got %q", expectedBody, b)
+	}
+}
+
+func TestAPIKeyScopeEnforced(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	note := createNote(user, "title", "body")
+	_, plain := createAPIKey(user, "reader", []string{scopeNotesRead}, nil, nil)
+
+	w := apiKeyRequest("GET", "/notes/"+strconv.Itoa(note.ID), plain, "")
+	if w.Code != 200 {
+		t.Errorf("Expected 200, got %d", w.Code)
+	}
+
+	w = apiKeyRequest("PUT", "/notes/"+strconv.Itoa(note.ID), plain, "title=new&body=new")
+	if w.Code != 403 {
+		t.Errorf("Expected 403, got %d", w.Code)
+	}
+	expectedBody := "{\"error\":\"insufficient_scope\",\"scope\":\"notes:write\"}"
+	if b := w.Body.String(); b != expectedBody {
+		t.Errorf("Expected %q, got %q", expectedBody, b)
+	}
+
+	w = apiKeyRequest("POST", "/shares", plain, "note_id="+strconv.Itoa(note.ID)+"&permissions=read")
+	if w.Code != 403 {
+		t.Errorf("Expected 403, got %d", w.Code)
+	}
+}
+
+func TestAPIKeyNoteRestriction(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	allowed := createNote(user, "allowed", "body")
+	other := createNote(user, "other", "body")
+	_, plain := createAPIKey(user, "one note", []string{scopeNotesRead, scopeNotesWrite}, []int{allowed.ID}, nil)
+
+	w := apiKeyRequest("GET", "/notes", plain, "")
+	if b := w.Body.String(); !strings.Contains(b, "allowed") || strings.Contains(b, "other") {
+		t.Errorf("Expected only the allowed note, got %q", b)
+	}
+
+	w = apiKeyRequest("GET", "/notes/"+strconv.Itoa(other.ID), plain, "")
+	if w.Code != 403 {
+		t.Errorf("Expected 403, got %d", w.Code)
+	}
+
+	w = apiKeyRequest("POST", "/notes", plain, "title=new&body=new")
+	if w.Code != 403 {
+		t.Errorf("Expected 403, got %d", w.Code)
+	}
+}
+
+func TestAPIKeyExpiredAndRevoked(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	past := time.Now().UTC().Add(-time.Minute)
+	_, expired := createAPIKey(user, "old", []string{scopeNotesRead}, nil, &past)
+
+	if w := apiKeyRequest("GET", "/notes", expired, ""); w.Code != 403 {
+		t.Errorf("Expected 403 for expired key, got %d", w.Code)
+	}
+
+	key, plain := createAPIKey(user, "current", []string{scopeNotesRead}, nil, nil)
+	if w := apiKeyRequest("GET", "/notes", plain, ""); w.Code != 200 {
+		t.Errorf("Expected 200, got %d", w.Code)
+	}
+	if used := findAPIKeyByID(int64(key.ID)); used.LastUsedAt == nil {
+		t.Errorf("Expected last used to be recorded")
+	}
+
+	w := apiKeyRequest("DELETE", "/users/api-keys/"+strconv.Itoa(key.ID), user.AuthToken, "")
+	if w.Code != 200 {
+		t.Errorf("Expected 200, got %d", w.Code)
+	}
+	if w := apiKeyRequest("GET", "/notes", plain, ""); w.Code != 403 {
+		t.Errorf("Expected 403 for revoked key, got %d", w.Code)
+	}
+}
+
+func TestAPIKeyIndexHandler(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	createAPIKey(user, "listed", []string{scopeNotesRead}, nil, nil)
+
+	w := apiKeyRequest("GET", "/users/api-keys", user.AuthToken, "")
+
+	if w.Code != 200 {
+		t.Errorf("Expected 200, got %d", w.Code)
+	}
+	var response []apiKeySuccessResponse
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if len(response) != 1 || response[0].Name != "listed" || len(response[0].Key) != 0 {
+		t.Errorf("Expected the key without its secret, got %q", w.Body.String())
+	}
+}
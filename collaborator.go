@@ -0,0 +1,217 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Collaborator gives a registered user access to another user's note.
+// UserID is nil while the invite waits for someone to register with Email.
+type Collaborator struct {
+	ID          int
+	NoteID      int
+	UserID      *int
+	Email       string
+	Permissions string
+	CreatedAt   time.Time
+}
+
+// noteOwnerPermission is what NotePermissions returns for a note's owner
+const noteOwnerPermission = "owner"
+
+// collaboratorColumns lists collaborators columns in the order
+// collaboratorFromDbRows scans them
+const collaboratorColumns = "id, note_id, user_id, email, permissions, created_at"
+
+// createCollaborator grants email permissions on note, or changes the
+// permissions of an existing grant. Unknown emails get a pending invite.
+func createCollaborator(note *Note, email string, permissions string) *Collaborator {
+	if !ValidateSharePermission(permissions) {
+		return nil
+	}
+
+	email = normalizeEmail(email)
+	if collaborator := findCollaboratorByEmail(note.ID, email); collaborator != nil {
+		collaborator.UpdatePermissions(permissions)
+		return collaborator
+	}
+
+	// Only a confirmed owner of the address takes the grant straight away;
+	// otherwise it waits as an invite until the address is verified
+	var userID *int
+	if user := findUserByEmail(email); user != nil && user.Verified() {
+		userID = &user.ID
+	}
+
+	stmt, err := db.Prepare("INSERT collaborators SET note_id=?, user_id=?, email=?, permissions=?, created_at=?")
+	if err != nil {
+		checkErr(err, "prepare create collaborator")
+	} else {
+		defer stmt.Close()
+	}
+	res, err := stmt.Exec(note.ID, userID, email, permissions, time.Now().UTC())
+	checkErr(err, "create collaborator")
+
+	id, _ := res.LastInsertId()
+	return findCollaboratorByID(id)
+}
+
+func findCollaboratorByID(id int64) *Collaborator {
+	return findCollaboratorWhere("id=?", id)
+}
+
+func findCollaboratorByEmail(noteID int, email string) *Collaborator {
+	return findCollaboratorWhere("note_id=? AND email=?", noteID, email)
+}
+
+// findCollaborator returns the grant user has on the note, if any
+func findCollaborator(noteID int, user *User) *Collaborator {
+	return findCollaboratorWhere("note_id=? AND user_id=?", noteID, user.ID)
+}
+
+func findCollaboratorWhere(condition string, args ...interface{}) *Collaborator {
+	var collaborator *Collaborator
+	rows, err := db.Query("SELECT "+collaboratorColumns+" FROM collaborators WHERE "+condition, args...)
+	if err != nil {
+		checkErr(err, "find collaborator")
+	} else {
+		defer rows.Close()
+	}
+
+	if rows.Next() {
+		collaborator = collaboratorFromDbRows(rows)
+	}
+	return collaborator
+}
+
+func findCollaboratorsByNote(note *Note) []*Collaborator {
+	rows, err := db.Query("SELECT "+collaboratorColumns+" FROM collaborators WHERE note_id=? ORDER BY id", note.ID)
+	if err != nil {
+		checkErr(err, "find collaborators by note")
+	} else {
+		defer rows.Close()
+	}
+
+	var collaborators []*Collaborator
+	for rows.Next() {
+		collaborators = append(collaborators, collaboratorFromDbRows(rows))
+	}
+	return collaborators
+}
+
+func collaboratorFromDbRows(rows *sql.Rows) *Collaborator {
+	collaborator := new(Collaborator)
+	rows.Scan(
+		&collaborator.ID,
+		&collaborator.NoteID,
+		&collaborator.UserID,
+		&collaborator.Email,
+		&collaborator.Permissions,
+		&collaborator.CreatedAt)
+	return collaborator
+}
+
+// Pending returns if the invite hasn't been claimed by a registered user
+func (c Collaborator) Pending() bool {
+	return c.UserID == nil
+}
+
+// UpdatePermissions changes what the collaborator may do with the note
+func (c *Collaborator) UpdatePermissions(permissions string) {
+	c.Permissions = permissions
+
+	_, err := db.Exec("UPDATE collaborators SET permissions=? WHERE id=?", permissions, c.ID)
+	checkErr(err, "update collaborator permissions")
+}
+
+// Destroy removes the collaborator's access
+func (c Collaborator) Destroy() {
+	_, err := db.Exec("DELETE FROM collaborators WHERE id=?", c.ID)
+	checkErr(err, "destroy collaborator")
+}
+
+// claimCollaboratorInvites attaches the invites sent to user's email address
+// before it was verified. Call it only once the address is confirmed.
+func claimCollaboratorInvites(user *User) {
+	_, err := db.Exec("UPDATE collaborators SET user_id=? WHERE user_id IS NULL AND email=?", user.ID, user.Email)
+	checkErr(err, "claim collaborator invites")
+}
+
+// releaseCollaboratorInvites turns grants made to user's previous email
+// addresses back into invites, for whoever holds those addresses now
+func releaseCollaboratorInvites(user *User) {
+	_, err := db.Exec("UPDATE collaborators SET user_id=NULL WHERE user_id=? AND email<>?", user.ID, user.Email)
+	checkErr(err, "release collaborator invites")
+}
+
+// SharedNote is a note another user has given the user access to
+type SharedNote struct {
+	Note        *Note
+	OwnerEmail  string
+	Permissions string
+}
+
+// findNotesSharedWithUser returns the notes user collaborates on
+func findNotesSharedWithUser(user *User) []SharedNote {
+	rows, err := db.Query(
+		"SELECT c.permissions, u.email, n.id FROM collaborators c "+
+			"JOIN notes n ON n.id = c.note_id JOIN users u ON u.id = n.user_id "+
+			"WHERE c.user_id=? AND c.email=? ORDER BY n.id",
+		user.ID,
+		user.Email)
+	if err != nil {
+		checkErr(err, "find notes shared with user")
+	} else {
+		defer rows.Close()
+	}
+
+	var shared []SharedNote
+	var noteIDs []int64
+	for rows.Next() {
+		var entry SharedNote
+		var noteID int64
+		rows.Scan(&entry.Permissions, &entry.OwnerEmail, &noteID)
+		shared = append(shared, entry)
+		noteIDs = append(noteIDs, noteID)
+	}
+	rows.Close()
+
+	for i, noteID := range noteIDs {
+		shared[i].Note = findNoteByID(noteID)
+	}
+	return shared
+}
+
+// NotePermissions returns what user may do with note: "owner" for its
+// owner, the permissions of a verified collaborator, or "" for no access.
+// Grants follow the address they were made to, not the account.
+func NotePermissions(note *Note, user *User) string {
+	if note.UserID == user.ID {
+		return noteOwnerPermission
+	}
+	if !user.Verified() {
+		return ""
+	}
+	if collaborator := findCollaborator(note.ID, user); collaborator != nil && collaborator.Email == user.Email {
+		return collaborator.Permissions
+	}
+	return ""
+}
+
+// sendCollaboratorInvite tells email that owner shared a note with them
+func sendCollaboratorInvite(owner *User, collaborator *Collaborator) {
+	link := appURL(fmt.Sprintf("/notes/%d", collaborator.NoteID))
+	body := fmt.Sprintf("%s shared a note with you on Graynote:\n%s", owner.Email, link)
+	if collaborator.Pending() {
+		body = fmt.Sprintf(
+			"%s shared a note with you on Graynote. Sign up with this email address to open it:\n%s",
+			owner.Email,
+			appURL("/register"))
+	}
+
+	if err := mailer.Send(collaborator.Email, "A note was shared with you on Graynote", body); err != nil {
+		log.Println("collaborator invite mail failed", err)
+	}
+}
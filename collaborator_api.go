@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/schema"
+)
+
+type collaboratorRequestParameters struct {
+	Email       string `schema:"email"`
+	Permissions string `schema:"permissions"`
+}
+
+type collaboratorSuccessResponse struct {
+	ID          int    `json:"id"`
+	NoteID      int    `json:"note_id"`
+	Email       string `json:"email"`
+	Permissions string `json:"permissions"`
+	Pending     bool   `json:"pending"`
+}
+
+type sharedNoteSuccessResponse struct {
+	ID          int    `json:"id"`
+	Title       string `json:"title"`
+	Body        string `json:"body"`
+	OwnerEmail  string `json:"owner_email"`
+	Permissions string `json:"permissions"`
+}
+
+func collaboratorIndexHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Authenticate
+	user := apiAuthenticateUser(r)
+	if user == nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	note := apiOwnedNote(w, r, user)
+	if note == nil {
+		return
+	}
+
+	response := []collaboratorSuccessResponse{}
+	for _, collaborator := range findCollaboratorsByNote(note) {
+		response = append(response, collaboratorResponse(collaborator))
+	}
+	responseJSON, _ := json.Marshal(response)
+	w.Write(responseJSON)
+}
+
+// collaboratorCreateHandler gives a user access to a note by email. Emails
+// without an account get an invite that is claimed when they register.
+func collaboratorCreateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Authenticate
+	user := apiAuthenticateUser(r)
+	if user == nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	note := apiOwnedNote(w, r, user)
+	if note == nil {
+		return
+	}
+
+	if !apiRequireVerified(w, r, user, actionCreateShares) {
+		return
+	}
+
+	if !apiParseForm(w, r) {
+		return
+	}
+
+	params := new(collaboratorRequestParameters)
+	decoder := schema.NewDecoder()
+	decoder.IgnoreUnknownKeys(true)
+	decoder.Decode(params, r.PostForm)
+
+	var errors []APIError
+
+	// Validate Email
+	params.Email = normalizeEmail(params.Email)
+	if len(params.Email) == 0 {
+		errors = append(errors, APIError{Field: "email", Message: "is required"})
+	} else if !ValidateEmail(params.Email) {
+		errors = append(errors, APIError{Field: "email", Message: "is invalid"})
+	} else if params.Email == user.Email {
+		errors = append(errors, APIError{Field: "email", Message: "is the owner"})
+	}
+
+	// Validate Permissions
+	if len(params.Permissions) == 0 {
+		errors = append(errors, APIError{Field: "permissions", Message: "is required"})
+	} else if !ValidateSharePermission(params.Permissions) {
+		errors = append(errors, APIError{Field: "permissions", Message: "is invalid"})
+	}
+
+	if len(errors) > 0 {
+		apiErrorHandler(w, r, http.StatusBadRequest, errors)
+		return
+	}
+
+	existing := findCollaboratorByEmail(note.ID, params.Email)
+	collaborator := createCollaborator(note, params.Email, params.Permissions)
+	responseJSON, _ := json.Marshal(collaboratorResponse(collaborator))
+
+	// Changing permissions doesn't send another invite
+	if existing != nil {
+		w.Write(responseJSON)
+		return
+	}
+
+	sendCollaboratorInvite(user, collaborator)
+	w.WriteHeader(http.StatusCreated)
+	w.Write(responseJSON)
+}
+
+func collaboratorDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Authenticate
+	user := apiAuthenticateUser(r)
+	if user == nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	note := apiOwnedNote(w, r, user)
+	if note == nil {
+		return
+	}
+
+	collaboratorID, _ := strconv.ParseInt(mux.Vars(r)["collaborator_id"], 10, 64)
+	collaborator := findCollaboratorByID(collaboratorID)
+	if collaborator == nil || collaborator.NoteID != note.ID {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	collaborator.Destroy()
+
+	w.Write([]byte("{}"))
+}
+
+// noteSharedWithMeHandler lists notes other users have shared with the user
+func noteSharedWithMeHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Authenticate
+	user := apiAuthenticateUser(r)
+	if user == nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if !apiRequireScope(w, r, user, scopeNotesRead) {
+		return
+	}
+
+	response := []sharedNoteSuccessResponse{}
+	if user.Verified() {
+		for _, shared := range findNotesSharedWithUser(user) {
+			if !user.AllowsNote(shared.Note.ID) {
+				continue
+			}
+			response = append(response, sharedNoteSuccessResponse{
+				ID:          shared.Note.ID,
+				Title:       shared.Note.Title,
+				Body:        shared.Note.Body,
+				OwnerEmail:  shared.OwnerEmail,
+				Permissions: shared.Permissions})
+		}
+	}
+	responseJSON, _ := json.Marshal(response)
+	w.Write(responseJSON)
+}
+
+func collaboratorResponse(collaborator *Collaborator) collaboratorSuccessResponse {
+	return collaboratorSuccessResponse{
+		ID:          collaborator.ID,
+		NoteID:      collaborator.NoteID,
+		Email:       collaborator.Email,
+		Permissions: collaborator.Permissions,
+		Pending:     collaborator.Pending()}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func collaboratorRequest(method string, path string, token string, body string) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("X-Auth-Token", token)
+	w := httptest.NewRecorder()
+	router().ServeHTTP(w, r)
+	return w
+}
+
+func TestCollaboratorCreateHandlerReadAccess(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	owner := factoryCreateUser("owner@site.com")
+	reader := factoryCreateUser("reader@site.com")
+	note := createNote(owner, "Plans", "Secret plans")
+	createShare(note, "readwrite")
+
+	w := collaboratorRequest("POST", fmt.Sprintf("/notes/%d/collaborators", note.ID), owner.AuthToken, "email=Reader@site.com&permissions=read")
+	if w.Code != 201 {
+		t.Fatalf("Expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	if b := w.Body.String(); !strings.Contains(b, "\"email\":\"reader@site.com\",\"permissions\":\"read\",\"pending\":false") {
+		t.Errorf("Unexpected collaborator %q", b)
+	}
+
+	// The reader sees the note but not its share keys
+	w = collaboratorRequest("GET", fmt.Sprintf("/notes/%d", note.ID), reader.AuthToken, "")
+	expectedBody := fmt.Sprintf("{\"id\":%d,\"title\":\"Plans\",\"body\":\"Secret plans\",\"permissions\":\"read\"}", note.ID)
+	if b := w.Body.String(); w.Code != 200 || b != expectedBody {
+		t.Errorf("Expected %q, got %d %q", expectedBody, w.Code, b)
+	}
+
+	w = collaboratorRequest("PUT", fmt.Sprintf("/notes/%d", note.ID), reader.AuthToken, "title=Mine&body=Mine")
+	if w.Code != 403 {
+		t.Errorf("Expected read collaborator not to update, got %d", w.Code)
+	}
+}
+
+func TestCollaboratorReadwriteUpdate(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	owner := factoryCreateUser("owner@site.com")
+	writer := factoryCreateUser("writer@site.com")
+	note := createNote(owner, "Plans", "Secret plans")
+	createCollaborator(note, writer.Email, "readwrite")
+
+	w := collaboratorRequest("PUT", fmt.Sprintf("/notes/%d", note.ID), writer.AuthToken, "title=Plans&body=Better plans")
+	if w.Code != 200 || findNoteByID(int64(note.ID)).Body != "Better plans" {
+		t.Errorf("Expected readwrite collaborator to update, got %d", w.Code)
+	}
+
+	// Collaborators can't manage sharing
+	w = collaboratorRequest("GET", fmt.Sprintf("/notes/%d/collaborators", note.ID), writer.AuthToken, "")
+	if w.Code != 404 {
+		t.Errorf("Expected 404, got %d", w.Code)
+	}
+}
+
+func TestCollaboratorInviteClaimedAtVerification(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	owner := factoryCreateUser("owner@site.com")
+	note := createNote(owner, "Plans", "Secret plans")
+
+	w := collaboratorRequest("POST", fmt.Sprintf("/notes/%d/collaborators", note.ID), owner.AuthToken, "email=new@site.com&permissions=read")
+	if !strings.Contains(w.Body.String(), "\"pending\":true") {
+		t.Fatalf("Expected a pending invite, got %q", w.Body.String())
+	}
+
+	form := UserRegisterForm{Email: "new@site.com", Password: "password"}
+	user := createUser(&form)
+
+	// Access waits for the address to be confirmed
+	w = collaboratorRequest("GET", "/notes/shared-with-me", user.AuthToken, "")
+	if b := w.Body.String(); b != "[]" {
+		t.Errorf("Expected no shared notes before verification, got %q", b)
+	}
+
+	user.MarkEmailVerified()
+	w = collaboratorRequest("GET", "/notes/shared-with-me", user.AuthToken, "")
+
+	var shared []sharedNoteSuccessResponse
+	json.Unmarshal(w.Body.Bytes(), &shared)
+	if len(shared) != 1 || shared[0].ID != note.ID || shared[0].OwnerEmail != owner.Email || shared[0].Permissions != "read" {
+		t.Errorf("Expected the shared note, got %s", w.Body.String())
+	}
+}
+
+func TestCollaboratorInviteNotClaimedByUnverifiedAccount(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	owner := factoryCreateUser("owner@site.com")
+	note := createNote(owner, "Plans", "Secret plans")
+
+	// Someone registers the invitee's address first and never confirms it
+	form := UserRegisterForm{Email: "victim@corp.com", Password: "password"}
+	attacker := createUser(&form)
+	collaborator := createCollaborator(note, "victim@corp.com", "read")
+	if !collaborator.Pending() {
+		t.Fatalf("Expected the invite to wait for a verified address")
+	}
+
+	// They then move the account to an address they do control
+	attacker.ChangeEmail("attacker@evil.com")
+
+	w := collaboratorRequest("GET", fmt.Sprintf("/notes/%d", note.ID), attacker.AuthToken, "")
+	if w.Code != 404 {
+		t.Errorf("Expected no access to the note, got %d", w.Code)
+	}
+	w = collaboratorRequest("GET", "/notes/shared-with-me", attacker.AuthToken, "")
+	if b := w.Body.String(); b != "[]" {
+		t.Errorf("Expected no shared notes, got %q", b)
+	}
+	if !findCollaboratorByEmail(note.ID, "victim@corp.com").Pending() {
+		t.Errorf("Expected the invite to stay pending for the address")
+	}
+}
+
+func TestCollaboratorAccessEndsWithEmailChange(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	owner := factoryCreateUser("owner@site.com")
+	reader := factoryCreateUser("reader@site.com")
+	note := createNote(owner, "Plans", "Secret plans")
+	createCollaborator(note, reader.Email, "read")
+
+	reader.ChangeEmail("elsewhere@site.com")
+
+	w := collaboratorRequest("GET", fmt.Sprintf("/notes/%d", note.ID), reader.AuthToken, "")
+	if w.Code != 404 {
+		t.Errorf("Expected access to stay with the old address, got %d", w.Code)
+	}
+	if !findCollaboratorByEmail(note.ID, "reader@site.com").Pending() {
+		t.Errorf("Expected the grant to be an invite again")
+	}
+}
+
+func TestCollaboratorDeleteHandler(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	owner := factoryCreateUser("owner@site.com")
+	reader := factoryCreateUser("reader@site.com")
+	note := createNote(owner, "Plans", "Secret plans")
+	collaborator := createCollaborator(note, reader.Email, "read")
+
+	w := collaboratorRequest("DELETE", fmt.Sprintf("/notes/%d/collaborators/%d", note.ID, collaborator.ID), owner.AuthToken, "")
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+
+	w = collaboratorRequest("GET", fmt.Sprintf("/notes/%d", note.ID), reader.AuthToken, "")
+	if w.Code != 404 {
+		t.Errorf("Expected access to be revoked, got %d", w.Code)
+	}
+}
+
+func TestCollaboratorCreateHandlerMalformedForm(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	owner := factoryCreateUser("owner@site.com")
+	note := createNote(owner, "Plans", "Secret plans")
+
+	w := collaboratorRequest("POST", fmt.Sprintf("/notes/%d/collaborators", note.ID), owner.AuthToken, "email=%zz")
+	if w.Code != 400 || w.Body.String() != "{\"form\":\"is invalid\"}" {
+		t.Errorf("Expected 400 for the form, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestCollaboratorCreateHandlerFailValidation(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	owner := factoryCreateUser("owner@site.com")
+	note := createNote(owner, "Plans", "Secret plans")
+
+	w := collaboratorRequest("POST", fmt.Sprintf("/notes/%d/collaborators", note.ID), owner.AuthToken, "email=owner@site.com&permissions=admin")
+
+	if w.Code != 400 {
+		t.Errorf("Expected 400, got %d", w.Code)
+	}
+	expectedBody := "{\"email\":\"is the owner\",\"permissions\":\"is invalid\"}"
+	if b := w.Body.String(); b != expectedBody {
+		t.Errorf("Expected %q, got %q", expectedBody, b)
+	}
+}
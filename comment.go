@@ -0,0 +1,176 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Comment is a remark left on a note, by a user when UserID is set or by
+// someone holding ShareID's key otherwise. An anchored comment refers to the
+// runes AnchorStart to AnchorEnd of the body at AnchorVersion, which read
+// AnchorQuote at the time.
+type Comment struct {
+	ID            int
+	NoteID        int
+	UserID        *int
+	ShareID       *int
+	AuthorName    string
+	AuthorEmail   string
+	Body          string
+	AnchorStart   *int
+	AnchorEnd     *int
+	AnchorQuote   string
+	AnchorVersion int
+	ResolvedAt    *time.Time
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// CommentAnchor is the text range a comment refers to
+type CommentAnchor struct {
+	Start   int
+	End     int
+	Quote   string
+	Version int
+}
+
+// commentColumns lists comments columns in the order commentFromDbRows scans
+// them. The author's email is read from users so it follows email changes.
+const commentColumns = "c.id, c.note_id, c.user_id, c.share_id, c.author_name, COALESCE(u.email, ''), c.body, " +
+	"c.anchor_start, c.anchor_end, c.anchor_quote, c.anchor_version, c.resolved_at, c.created_at, c.updated_at"
+
+const commentTables = "comments c LEFT JOIN users u ON u.id = c.user_id"
+
+// createComment adds a comment to note by user, or through share when user
+// is nil. anchor may be nil for a comment on the whole note.
+func createComment(note *Note, user *User, share *Share, authorName string, body string, anchor *CommentAnchor) *Comment {
+	var userID, shareID *int
+	if user != nil {
+		userID = &user.ID
+	} else {
+		shareID = &share.ID
+	}
+
+	var anchorStart, anchorEnd, anchorVersion *int
+	var anchorQuote *string
+	if anchor != nil {
+		anchorStart, anchorEnd, anchorQuote, anchorVersion = &anchor.Start, &anchor.End, &anchor.Quote, &anchor.Version
+	}
+
+	stmt, err := db.Prepare("INSERT comments SET note_id=?, user_id=?, share_id=?, author_name=?, body=?, anchor_start=?, anchor_end=?, anchor_quote=?, anchor_version=?, created_at=?, updated_at=?")
+	if err != nil {
+		checkErr(err, "prepare create comment")
+	} else {
+		defer stmt.Close()
+	}
+	now := time.Now().UTC()
+	res, err := stmt.Exec(note.ID, userID, shareID, authorName, body, anchorStart, anchorEnd, anchorQuote, anchorVersion, now, now)
+	checkErr(err, "create comment")
+
+	id, _ := res.LastInsertId()
+	return findCommentByID(id)
+}
+
+func findCommentByID(id int64) *Comment {
+	var comment *Comment
+	rows, err := db.Query("SELECT "+commentColumns+" FROM "+commentTables+" WHERE c.id=?", id)
+	if err != nil {
+		checkErr(err, "find comment by id")
+	} else {
+		defer rows.Close()
+	}
+
+	if rows.Next() {
+		comment = commentFromDbRows(rows)
+	}
+	return comment
+}
+
+func findCommentsByNote(note *Note) []*Comment {
+	rows, err := db.Query("SELECT "+commentColumns+" FROM "+commentTables+" WHERE c.note_id=? ORDER BY c.id", note.ID)
+	if err != nil {
+		checkErr(err, "find comments by note")
+	} else {
+		defer rows.Close()
+	}
+
+	var comments []*Comment
+	for rows.Next() {
+		comments = append(comments, commentFromDbRows(rows))
+	}
+	return comments
+}
+
+func commentFromDbRows(rows *sql.Rows) *Comment {
+	var anchorQuote sql.NullString
+	var anchorVersion sql.NullInt64
+	comment := new(Comment)
+	rows.Scan(
+		&comment.ID,
+		&comment.NoteID,
+		&comment.UserID,
+		&comment.ShareID,
+		&comment.AuthorName,
+		&comment.AuthorEmail,
+		&comment.Body,
+		&comment.AnchorStart,
+		&comment.AnchorEnd,
+		&anchorQuote,
+		&anchorVersion,
+		&comment.ResolvedAt,
+		&comment.CreatedAt,
+		&comment.UpdatedAt)
+	comment.AnchorQuote = anchorQuote.String
+	comment.AnchorVersion = int(anchorVersion.Int64)
+	return comment
+}
+
+// Anchor returns the text range of an anchored comment, or nil
+func (c Comment) Anchor() *CommentAnchor {
+	if c.AnchorStart == nil || c.AnchorEnd == nil {
+		return nil
+	}
+	return &CommentAnchor{Start: *c.AnchorStart, End: *c.AnchorEnd, Quote: c.AnchorQuote, Version: c.AnchorVersion}
+}
+
+// Resolved returns if the comment has been marked as dealt with
+func (c Comment) Resolved() bool {
+	return c.ResolvedAt != nil
+}
+
+// UpdateBody changes the text of the comment
+func (c *Comment) UpdateBody(body string) {
+	c.Body = body
+	c.UpdatedAt = time.Now().UTC()
+
+	_, err := db.Exec("UPDATE comments SET body=?, updated_at=? WHERE id=?", c.Body, c.UpdatedAt, c.ID)
+	checkErr(err, "update comment")
+}
+
+// SetResolved marks the comment as dealt with, or reopens it
+func (c *Comment) SetResolved(resolved bool) {
+	c.ResolvedAt = nil
+	if resolved {
+		now := time.Now().UTC()
+		c.ResolvedAt = &now
+	}
+
+	_, err := db.Exec("UPDATE comments SET resolved_at=? WHERE id=?", c.ResolvedAt, c.ID)
+	checkErr(err, "resolve comment")
+}
+
+// Destroy removes the comment
+func (c Comment) Destroy() {
+	_, err := db.Exec("DELETE FROM comments WHERE id=?", c.ID)
+	checkErr(err, "destroy comment")
+}
+
+// newCommentAnchor checks that the runes start to end lie within note's body
+// and returns the anchor for them, or nil if they don't
+func newCommentAnchor(note *Note, start int, end int) *CommentAnchor {
+	body := []rune(note.Body)
+	if start < 0 || end <= start || end > len(body) {
+		return nil
+	}
+	return &CommentAnchor{Start: start, End: end, Quote: string(body[start:end]), Version: note.Version}
+}
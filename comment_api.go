@@ -0,0 +1,378 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/schema"
+)
+
+// maxCommentLength limits the runes in a comment body
+const maxCommentLength = 10000
+
+// defaultCommentAuthorName names a share-key author who gave no name on a
+// share without a label
+const defaultCommentAuthorName = "Guest"
+
+type commentRequestParameters struct {
+	Body        string `schema:"body"`
+	AnchorStart string `schema:"anchor_start"`
+	AnchorEnd   string `schema:"anchor_end"`
+	Name        string `schema:"name"`
+}
+
+type commentAuthorResponse struct {
+	// Type is "owner", "collaborator" or "guest" for comments made with a
+	// share key
+	Type  string `json:"type"`
+	Email string `json:"email,omitempty"`
+	Name  string `json:"name,omitempty"`
+}
+
+type commentAnchorResponse struct {
+	Start   int    `json:"start"`
+	End     int    `json:"end"`
+	Quote   string `json:"quote"`
+	Version int    `json:"version"`
+}
+
+type commentSuccessResponse struct {
+	ID         int                    `json:"id"`
+	NoteID     int                    `json:"note_id"`
+	Author     commentAuthorResponse  `json:"author"`
+	Body       string                 `json:"body"`
+	Anchor     *commentAnchorResponse `json:"anchor,omitempty"`
+	Resolved   bool                   `json:"resolved"`
+	ResolvedAt *time.Time             `json:"resolved_at,omitempty"`
+	CreatedAt  time.Time              `json:"created_at"`
+	UpdatedAt  time.Time              `json:"updated_at"`
+}
+
+// commentAccess is who is commenting on Note: User, or the holder of Share
+// when User is nil. Permissions is what they may do with the note.
+type commentAccess struct {
+	Note        *Note
+	User        *User
+	Share       *Share
+	Permissions string
+}
+
+// Authored returns if the comment was written by whoever is accessing it.
+// Comments made with a share key belong to everyone holding that key.
+func (a commentAccess) Authored(comment *Comment) bool {
+	if a.User != nil {
+		return comment.UserID != nil && *comment.UserID == a.User.ID
+	}
+	return comment.UserID == nil && comment.ShareID != nil && *comment.ShareID == a.Share.ID
+}
+
+// RecordShareActivity logs action if the note was reached through a share
+func (a commentAccess) RecordShareActivity(r *http.Request, action string) {
+	if a.Share != nil {
+		recordShareActivity(r, a.Share, action, http.StatusOK, a.Note.Version)
+	}
+}
+
+func commentIndexHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	access := apiAuthorizeComments(w, r, scopeNotesRead)
+	if access == nil {
+		return
+	}
+
+	response := []commentSuccessResponse{}
+	for _, comment := range findCommentsByNote(access.Note) {
+		response = append(response, commentResponse(comment, access))
+	}
+	responseJSON, _ := json.Marshal(response)
+	w.Write(responseJSON)
+}
+
+// commentCreateHandler adds a comment to a note. anchor_start and anchor_end
+// tie it to a range of the current body, counted in Unicode code points.
+func commentCreateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	access := apiAuthorizeComments(w, r, scopeNotesWrite)
+	if access == nil {
+		return
+	}
+
+	params := decodeCommentParameters(w, r)
+	if params == nil {
+		return
+	}
+	errors := validateComment(params.Body)
+
+	// Validate Anchor
+	var anchor *CommentAnchor
+	if len(params.AnchorStart) > 0 || len(params.AnchorEnd) > 0 {
+		start, startErr := strconv.Atoi(params.AnchorStart)
+		end, endErr := strconv.Atoi(params.AnchorEnd)
+		if startErr == nil && endErr == nil {
+			anchor = newCommentAnchor(access.Note, start, end)
+		}
+		if anchor == nil {
+			errors = append(errors, APIError{Field: "anchor", Message: "is invalid"})
+		}
+	}
+
+	// Validate Name
+	if utf8.RuneCountInString(params.Name) > 255 {
+		errors = append(errors, APIError{Field: "name", Message: "is too long"})
+	}
+
+	if len(errors) > 0 {
+		apiErrorHandler(w, r, http.StatusBadRequest, errors)
+		return
+	}
+
+	// Users are named by their account, share-key holders by themselves
+	authorName := ""
+	if access.User == nil {
+		authorName = params.Name
+		if len(authorName) == 0 {
+			authorName = access.Share.Label
+		}
+		if len(authorName) == 0 {
+			authorName = defaultCommentAuthorName
+		}
+	}
+
+	comment := createComment(access.Note, access.User, access.Share, authorName, params.Body, anchor)
+	access.RecordShareActivity(r, shareActionComment)
+
+	w.WriteHeader(http.StatusCreated)
+	w.Write(commentJSON(comment, access))
+}
+
+// commentUpdateHandler lets the author change the text of a comment
+func commentUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	access := apiAuthorizeComments(w, r, scopeNotesWrite)
+	if access == nil {
+		return
+	}
+
+	comment := apiRequireComment(w, r, access)
+	if comment == nil {
+		return
+	}
+
+	if !access.Authored(comment) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	params := decodeCommentParameters(w, r)
+	if params == nil {
+		return
+	}
+	if errors := validateComment(params.Body); len(errors) > 0 {
+		apiErrorHandler(w, r, http.StatusBadRequest, errors)
+		return
+	}
+
+	comment.UpdateBody(params.Body)
+	access.RecordShareActivity(r, shareActionComment)
+
+	w.Write(commentJSON(comment, access))
+}
+
+// commentResolveHandler marks a comment as dealt with on POST and reopens it
+// on DELETE. Its author and anyone who may edit the note can do either.
+func commentResolveHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	access := apiAuthorizeComments(w, r, scopeNotesWrite)
+	if access == nil {
+		return
+	}
+
+	comment := apiRequireComment(w, r, access)
+	if comment == nil {
+		return
+	}
+
+	if !access.Authored(comment) && !permissionAllows(access.Permissions, "readwrite") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	comment.SetResolved(r.Method == "POST")
+	access.RecordShareActivity(r, shareActionComment)
+
+	w.Write(commentJSON(comment, access))
+}
+
+// commentDeleteHandler removes a comment for its author or the note's owner
+func commentDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	access := apiAuthorizeComments(w, r, scopeNotesWrite)
+	if access == nil {
+		return
+	}
+
+	comment := apiRequireComment(w, r, access)
+	if comment == nil {
+		return
+	}
+
+	if !access.Authored(comment) && access.Permissions != noteOwnerPermission {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	comment.Destroy()
+	access.RecordShareActivity(r, shareActionComment)
+
+	w.Write([]byte("{}"))
+}
+
+// apiAuthorizeComments finds the note named in the URL if the request may
+// comment on it, as its owner, a collaborator or through a share key with
+// comment permission or higher. Users also need scope. Otherwise it writes
+// the error and returns nil.
+func apiAuthorizeComments(w http.ResponseWriter, r *http.Request, scope string) *commentAccess {
+	if key := requestShareKey(w, r); len(key) > 0 {
+		share := findShareByAuthKey(key)
+		if share == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return nil
+		}
+		shareAccessTotal.WithLabelValues(share.Permissions).Inc()
+
+		if !permissionAllows(share.Permissions, "comment") {
+			recordShareActivity(r, share, shareActionDenied, http.StatusForbidden, 0)
+			w.WriteHeader(http.StatusForbidden)
+			return nil
+		}
+
+		if !apiRequireShareSession(w, r, share) {
+			return nil
+		}
+
+		note := findNoteByID(int64(share.NoteID))
+		if note == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return nil
+		}
+		return &commentAccess{Note: note, Share: share, Permissions: share.Permissions}
+	}
+
+	// Authenticate
+	user := apiAuthenticateUser(r)
+	if user == nil {
+		w.WriteHeader(http.StatusForbidden)
+		return nil
+	}
+
+	if !apiRequireScope(w, r, user, scope) {
+		return nil
+	}
+
+	// Find the note
+	noteID, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	note := findNoteByID(noteID)
+
+	// Note not found, or neither owned by nor shared with the user
+	var permissions string
+	if note != nil {
+		permissions = NotePermissions(note, user)
+	}
+	if len(permissions) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+
+	if !permissionAllows(permissions, "comment") {
+		w.WriteHeader(http.StatusForbidden)
+		return nil
+	}
+
+	if !apiRequireNote(w, r, user, note.ID) {
+		return nil
+	}
+	return &commentAccess{Note: note, User: user, Permissions: permissions}
+}
+
+// apiRequireComment finds the comment named in the URL on the accessed note,
+// writing a 404 if there isn't one
+func apiRequireComment(w http.ResponseWriter, r *http.Request, access *commentAccess) *Comment {
+	commentID, _ := strconv.ParseInt(mux.Vars(r)["comment_id"], 10, 64)
+	comment := findCommentByID(commentID)
+	if comment == nil || comment.NoteID != access.Note.ID {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	return comment
+}
+
+// decodeCommentParameters reads the comment form, writing a 400 and
+// returning nil if it is malformed
+func decodeCommentParameters(w http.ResponseWriter, r *http.Request) *commentRequestParameters {
+	if !apiParseForm(w, r) {
+		return nil
+	}
+
+	params := new(commentRequestParameters)
+	decoder := schema.NewDecoder()
+	decoder.IgnoreUnknownKeys(true)
+	decoder.Decode(params, r.PostForm)
+	return params
+}
+
+// validateComment checks the text of a comment
+func validateComment(body string) []APIError {
+	var errors []APIError
+
+	// Validate Body
+	if len(body) == 0 {
+		errors = append(errors, APIError{Field: "body", Message: "is required"})
+	} else if utf8.RuneCountInString(body) > maxCommentLength {
+		errors = append(errors, APIError{Field: "body", Message: "is too long"})
+	}
+
+	return errors
+}
+
+// commentResponse identifies the author of comment. Email addresses are
+// left out for anyone reading through a share key.
+func commentResponse(comment *Comment, access *commentAccess) commentSuccessResponse {
+	author := commentAuthorResponse{Type: "guest", Name: comment.AuthorName}
+	if comment.UserID != nil {
+		author = commentAuthorResponse{Type: "collaborator"}
+		if *comment.UserID == access.Note.UserID {
+			author.Type = noteOwnerPermission
+		}
+		if access.User != nil {
+			author.Email = comment.AuthorEmail
+		}
+	}
+
+	response := commentSuccessResponse{
+		ID:         comment.ID,
+		NoteID:     comment.NoteID,
+		Author:     author,
+		Body:       comment.Body,
+		Resolved:   comment.Resolved(),
+		ResolvedAt: comment.ResolvedAt,
+		CreatedAt:  comment.CreatedAt,
+		UpdatedAt:  comment.UpdatedAt}
+	if anchor := comment.Anchor(); anchor != nil {
+		response.Anchor = &commentAnchorResponse{Start: anchor.Start, End: anchor.End, Quote: anchor.Quote, Version: anchor.Version}
+	}
+	return response
+}
+
+func commentJSON(comment *Comment, access *commentAccess) []byte {
+	responseJSON, _ := json.Marshal(commentResponse(comment, access))
+	return responseJSON
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCommentCreateHandlerAnchored(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	owner := factoryCreateUser("owner@site.com")
+	reviewer := factoryCreateUser("reviewer@site.com")
+	reviewer.MarkEmailVerified()
+	note := createNote(owner, "Plans", "Héllo world")
+	createCollaborator(note, reviewer.Email, "comment")
+
+	path := fmt.Sprintf("/notes/%d/comments", note.ID)
+	w := collaboratorRequest("POST", path, reviewer.AuthToken, "body=Which+world%3F&anchor_start=6&anchor_end=11")
+	if w.Code != 201 {
+		t.Fatalf("Expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var comment commentSuccessResponse
+	json.Unmarshal(w.Body.Bytes(), &comment)
+	if comment.Author.Type != "collaborator" || comment.Author.Email != reviewer.Email {
+		t.Errorf("Unexpected author %+v", comment.Author)
+	}
+	if a := comment.Anchor; a == nil || a.Quote != "world" || a.Version != note.Version {
+		t.Errorf("Unexpected anchor %+v", a)
+	}
+
+	// Commenting doesn't allow editing the note
+	w = collaboratorRequest("PUT", fmt.Sprintf("/notes/%d", note.ID), reviewer.AuthToken, "title=Mine&body=Mine")
+	if w.Code != 403 {
+		t.Errorf("Expected comment collaborator not to update, got %d", w.Code)
+	}
+
+	w = collaboratorRequest("GET", path, owner.AuthToken, "")
+	var comments []commentSuccessResponse
+	json.Unmarshal(w.Body.Bytes(), &comments)
+	if len(comments) != 1 || comments[0].Body != "Which world?" {
+		t.Errorf("Expected the comment to be listed, got %s", w.Body.String())
+	}
+}
+
+func TestCommentCreateHandlerFailValidation(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	owner := factoryCreateUser("owner@site.com")
+	note := createNote(owner, "Plans", "Short")
+
+	w := collaboratorRequest("POST", fmt.Sprintf("/notes/%d/comments", note.ID), owner.AuthToken, "anchor_start=2&anchor_end=9")
+	if w.Code != 400 {
+		t.Errorf("Expected 400, got %d", w.Code)
+	}
+	expectedBody := "{\"anchor\":\"is invalid\",\"body\":\"is required\"}"
+	if b := w.Body.String(); b != expectedBody {
+		t.Errorf("Expected %q, got %q", expectedBody, b)
+	}
+}
+
+func TestCommentCreateHandlerMalformedForm(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	share := factoryCreateShare("comment")
+
+	w := shareKeyRequest("POST", "/s/"+share.AuthKey+"/comments", "body=%zz")
+	if w.Code != 400 || w.Body.String() != "{\"form\":\"is invalid\"}" {
+		t.Errorf("Expected 400 for the form, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestCommentShareKey(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	owner := factoryCreateUser("owner@site.com")
+	note := createNote(owner, "Plans", "Secret plans")
+	readShare := createShare(note, "read")
+	share := createShare(note, "comment")
+	share.Update(share.Permissions, "Legal", nil, 0)
+
+	w := shareKeyRequest("POST", "/s/"+readShare.AuthKey+"/comments", "body=Nice")
+	if w.Code != 403 {
+		t.Errorf("Expected read share not to comment, got %d", w.Code)
+	}
+
+	w = shareKeyRequest("POST", "/s/"+share.AuthKey+"/comments", "body=Looks+fine")
+	if w.Code != 201 {
+		t.Fatalf("Expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var comment commentSuccessResponse
+	json.Unmarshal(w.Body.Bytes(), &comment)
+	if comment.Author.Type != "guest" || comment.Author.Name != "Legal" {
+		t.Errorf("Expected the share label to name the author, got %+v", comment.Author)
+	}
+
+	// The owner comments too, but their address isn't shown to share holders
+	createComment(note, owner, nil, "", "Thanks", nil)
+	w = shareKeyRequest("GET", "/s/"+share.AuthKey+"/comments", "")
+	if b := w.Body.String(); strings.Contains(b, owner.Email) || !strings.Contains(b, "\"type\":\"owner\"") {
+		t.Errorf("Expected the owner without their email, got %q", b)
+	}
+
+	// Share holders can edit their own comments but not resolve others'
+	commentPath := fmt.Sprintf("/s/%s/comments/%d", share.AuthKey, comment.ID)
+	w = shareKeyRequest("PATCH", commentPath, "body=Looks+great")
+	if w.Code != 200 || findCommentByID(int64(comment.ID)).Body != "Looks great" {
+		t.Errorf("Expected the author to edit, got %d", w.Code)
+	}
+
+	ownerComment := findCommentsByNote(note)[1]
+	w = shareKeyRequest("POST", fmt.Sprintf("/s/%s/comments/%d/resolve", share.AuthKey, ownerComment.ID), "")
+	if w.Code != 403 {
+		t.Errorf("Expected 403 resolving another author's comment, got %d", w.Code)
+	}
+}
+
+func TestCommentResolveAndDelete(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	owner := factoryCreateUser("owner@site.com")
+	reviewer := factoryCreateUser("reviewer@site.com")
+	reviewer.MarkEmailVerified()
+	note := createNote(owner, "Plans", "Secret plans")
+	createCollaborator(note, reviewer.Email, "comment")
+	comment := createComment(note, reviewer, nil, "", "Typo", nil)
+	commentPath := fmt.Sprintf("/notes/%d/comments/%d", note.ID, comment.ID)
+
+	w := collaboratorRequest("POST", commentPath+"/resolve", owner.AuthToken, "")
+	if w.Code != 200 || !findCommentByID(int64(comment.ID)).Resolved() {
+		t.Errorf("Expected the owner to resolve, got %d", w.Code)
+	}
+
+	w = collaboratorRequest("DELETE", commentPath+"/resolve", reviewer.AuthToken, "")
+	if w.Code != 200 || findCommentByID(int64(comment.ID)).Resolved() {
+		t.Errorf("Expected the author to reopen, got %d", w.Code)
+	}
+
+	w = collaboratorRequest("PATCH", commentPath, owner.AuthToken, "body=Not+a+typo")
+	if w.Code != 403 {
+		t.Errorf("Expected only the author to edit, got %d", w.Code)
+	}
+
+	w = collaboratorRequest("DELETE", commentPath, owner.AuthToken, "")
+	if w.Code != 200 || findCommentByID(int64(comment.ID)) != nil {
+		t.Errorf("Expected the owner to delete, got %d", w.Code)
+	}
+}
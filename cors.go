@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// CorsPolicy decides which browser origins may call the API
+type CorsPolicy struct {
+	AllowedOrigins []string
+	AllowedHeaders []string
+	ExposedHeaders []string
+	MaxAge         int
+}
+
+var corsPolicy = loadCorsPolicy()
+
+// loadCorsPolicy reads a comma separated origin allowlist from the environment.
+// Entries may use wildcards, e.g. "https://*.graynote.com" or "*".
+func loadCorsPolicy() CorsPolicy {
+	policy := CorsPolicy{
+		AllowedHeaders: []string{"Accept", "Content-Type", "Origin", "Idempotency-Key", "X-Auth-Token", "X-CSRF-Token", "X-Share-Token"},
+		ExposedHeaders: []string{"ETag", "Location", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After", "Idempotent-Replayed"},
+		MaxAge:         600,
+	}
+
+	for _, origin := range strings.Split(os.Getenv("GRAYNOTE_CORS_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); len(origin) > 0 {
+			policy.AllowedOrigins = append(policy.AllowedOrigins, origin)
+		}
+	}
+
+	if maxAge, err := strconv.Atoi(os.Getenv("GRAYNOTE_CORS_MAX_AGE")); err == nil {
+		policy.MaxAge = maxAge
+	}
+
+	return policy
+}
+
+// AllowsOrigin returns if the origin matches an allowlist entry
+func (p CorsPolicy) AllowsOrigin(origin string) bool {
+	if len(origin) == 0 {
+		return false
+	}
+
+	for _, pattern := range p.AllowedOrigins {
+		if pattern == "*" {
+			return true
+		}
+		if match, _ := path.Match(pattern, origin); match {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsCredentials returns if the origin may send session cookies. A bare
+// "*" entry never does, or any site could read a signed in user's notes.
+func (p CorsPolicy) AllowsCredentials(origin string) bool {
+	for _, pattern := range p.AllowedOrigins {
+		if pattern == "*" || len(origin) == 0 {
+			continue
+		}
+		if match, _ := path.Match(pattern, origin); match {
+			return true
+		}
+	}
+	return false
+}
+
+func isPreflightRequest(r *http.Request, rm *mux.RouteMatch) bool {
+	return r.Method == "OPTIONS"
+}
+
+// corsMiddleware applies the CORS policy to every route, answering preflight
+// requests through the catch-all OPTIONS route.
+func corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+
+		origin := r.Header.Get("Origin")
+		if corsPolicy.AllowsOrigin(origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(corsPolicy.ExposedHeaders, ", "))
+			if corsPolicy.AllowsCredentials(origin) {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+
+			if r.Method == "OPTIONS" {
+				w.Header().Set("Access-Control-Allow-Headers", strings.Join(corsPolicy.AllowedHeaders, ", "))
+				w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, PATCH, POST, DELETE, OPTIONS")
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(corsPolicy.MaxAge))
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCorsPolicyAllowsOrigin(t *testing.T) {
+	policy := CorsPolicy{AllowedOrigins: []string{"https://graynote.com", "https://*.graynote.com"}}
+
+	if !policy.AllowsOrigin("https://graynote.com") {
+		t.Errorf("Expected exact origin to be allowed")
+	}
+	if !policy.AllowsOrigin("https://app.graynote.com") {
+		t.Errorf("Expected wildcard origin to be allowed")
+	}
+	if policy.AllowsOrigin("https://graynote.com.evil.com") {
+		t.Errorf("Expected unlisted origin to be rejected")
+	}
+	if policy.AllowsOrigin("") {
+		t.Errorf("Expected empty origin to be rejected")
+	}
+}
+
+func TestCorsPreflightAllowedOrigin(t *testing.T) {
+	defer func(policy CorsPolicy) { corsPolicy = policy }(corsPolicy)
+	corsPolicy.AllowedOrigins = []string{"https://*.graynote.com"}
+
+	paths := []string{"/notes", "/notes/1", "/shares", "/shares/abc123", "/users/login", "/users/register"}
+	for _, path := range paths {
+		r, _ := http.NewRequest("OPTIONS", path, nil)
+		r.Header.Set("Origin", "https://app.graynote.com")
+		r.Header.Set("Access-Control-Request-Method", "POST")
+		w := httptest.NewRecorder()
+
+		router().ServeHTTP(w, r)
+
+		if w.Code != 204 {
+			t.Errorf("Expected 204 for %s, got %d", path, w.Code)
+		}
+		if o := w.Header().Get("Access-Control-Allow-Origin"); o != "https://app.graynote.com" {
+			t.Errorf("Expected origin to be allowed for %s, got %q", path, o)
+		}
+		if m := w.Header().Get("Access-Control-Max-Age"); m != "600" {
+			t.Errorf("Expected max age 600 for %s, got %q", path, m)
+		}
+	}
+}
+
+func TestCorsPreflightDisallowedOrigin(t *testing.T) {
+	defer func(policy CorsPolicy) { corsPolicy = policy }(corsPolicy)
+	corsPolicy.AllowedOrigins = []string{"https://graynote.com"}
+
+	r, _ := http.NewRequest("OPTIONS", "/notes", nil)
+	r.Header.Set("Origin", "https://evil.com")
+	w := httptest.NewRecorder()
+
+	router().ServeHTTP(w, r)
+
+	if o := w.Header().Get("Access-Control-Allow-Origin"); o != "" {
+		t.Errorf("Expected no allowed origin, got %q", o)
+	}
+}
+
+func TestCorsExposesHeaders(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	defer func(policy CorsPolicy) { corsPolicy = policy }(corsPolicy)
+	corsPolicy.AllowedOrigins = []string{"*"}
+
+	user := factoryCreateUser("user@site.com")
+
+	r, _ := http.NewRequest("GET", "/notes", nil)
+	r.Header.Set("Origin", "https://graynote.com")
+	r.Header.Add("X-Auth-Token", user.AuthToken)
+	w := httptest.NewRecorder()
+
+	router().ServeHTTP(w, r)
+
+	if o := w.Header().Get("Access-Control-Allow-Origin"); o != "https://graynote.com" {
+		t.Errorf("Expected origin to be allowed, got %q", o)
+	}
+	if e := w.Header().Get("Access-Control-Expose-Headers"); e != "ETag, Location, RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, Retry-After, Idempotent-Replayed" {
+		t.Errorf("Expected exposed headers, got %q", e)
+	}
+}
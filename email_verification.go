@@ -0,0 +1,157 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// emailVerificationTTL is how long a verification link stays valid
+const emailVerificationTTL = 72 * time.Hour
+
+// EmailVerification is a single-use token confirming a User owns Email.
+// Only a hash of the token is stored. EmailChange verifications move the
+// account to Email once followed.
+type EmailVerification struct {
+	ID          int
+	UserID      int
+	Email       string
+	EmailChange bool
+	TokenHash   string
+	ExpiresAt   time.Time
+	UsedAt      *time.Time
+}
+
+// createEmailVerification stores a verification of email for user and returns the plain token
+func createEmailVerification(user *User, email string, change bool) string {
+	token := randomToken()
+
+	stmt, err := db.Prepare("INSERT email_verifications SET user_id=?, email=?, email_change=?, token_hash=?, expires_at=?")
+	if err != nil {
+		checkErr(err, "prepare create email verification")
+	} else {
+		defer stmt.Close()
+	}
+	_, err = stmt.Exec(user.ID, email, change, hashToken(token), time.Now().UTC().Add(emailVerificationTTL))
+	checkErr(err, "create email verification")
+
+	return token
+}
+
+// findEmailVerificationByToken returns the verification for token if unused and unexpired
+func findEmailVerificationByToken(token string) *EmailVerification {
+	var verification *EmailVerification
+
+	rows, err := db.Query(
+		"SELECT id, user_id, email, email_change, token_hash, expires_at, used_at FROM email_verifications WHERE token_hash=? AND used_at IS NULL AND expires_at > ?",
+		hashToken(token),
+		time.Now().UTC())
+	if err != nil {
+		checkErr(err, "find email verification by token")
+	} else {
+		defer rows.Close()
+	}
+
+	if rows.Next() {
+		verification = emailVerificationFromDbRows(rows)
+	}
+	return verification
+}
+
+// Use marks the verification as spent. It returns false if another request used it first.
+func (v *EmailVerification) Use() bool {
+	res, err := db.Exec("UPDATE email_verifications SET used_at=? WHERE id=? AND used_at IS NULL", time.Now().UTC(), v.ID)
+	checkErr(err, "use email verification")
+
+	affected, _ := res.RowsAffected()
+	return affected == 1
+}
+
+func emailVerificationFromDbRows(rows *sql.Rows) *EmailVerification {
+	verification := new(EmailVerification)
+	rows.Scan(
+		&verification.ID,
+		&verification.UserID,
+		&verification.Email,
+		&verification.EmailChange,
+		&verification.TokenHash,
+		&verification.ExpiresAt,
+		&verification.UsedAt)
+	return verification
+}
+
+// sendEmailVerification mails user a link confirming they own email
+func sendEmailVerification(user *User, email string) {
+	token := createEmailVerification(user, email, false)
+	link := appURL("/verify?token=" + url.QueryEscape(token))
+	body := fmt.Sprintf(
+		"Please confirm your email address for Graynote by following this link:\n%s\n\n"+
+			"If you didn't sign up, you can ignore this email.", link)
+
+	if err := mailer.Send(email, "Confirm your Graynote email address", body); err != nil {
+		log.Println("email verification mail failed", err)
+	}
+}
+
+// sendEmailChangeVerification mails email a link that moves user's account to
+// it, and warns the current address that a change was requested
+func sendEmailChangeVerification(user *User, email string) {
+	token := createEmailVerification(user, email, true)
+	link := appURL("/verify?token=" + url.QueryEscape(token))
+	body := fmt.Sprintf(
+		"Please confirm the new email address for your Graynote account by following this link:\n%s\n\n"+
+			"If you didn't ask for this, you can ignore this email.", link)
+
+	if err := mailer.Send(email, "Confirm your new Graynote email address", body); err != nil {
+		log.Println("email change verification mail failed", err)
+	}
+
+	notice := fmt.Sprintf(
+		"Someone asked to change the email address of your Graynote account to %s.\n\n"+
+			"If this wasn't you, change your password now.", email)
+	if err := mailer.Send(user.Email, "Your Graynote email address is changing", notice); err != nil {
+		log.Println("email change notice mail failed", err)
+	}
+}
+
+// destroyEmailVerificationsForUser spends every outstanding verification for user
+func destroyEmailVerificationsForUser(user *User) {
+	_, err := db.Exec("DELETE FROM email_verifications WHERE user_id=?", user.ID)
+	checkErr(err, "destroy email verifications")
+}
+
+// UnverifiedPolicy lists what accounts may do before confirming their email
+type UnverifiedPolicy map[string]bool
+
+// Actions gated by UnverifiedPolicy
+const (
+	actionCreateNotes  = "notes"
+	actionCreateShares = "shares"
+)
+
+var unverifiedPolicy = loadUnverifiedPolicy()
+
+// loadUnverifiedPolicy reads a comma separated list of allowed actions from
+// GRAYNOTE_UNVERIFIED_ALLOW. By default unverified users may write notes but
+// not share them.
+func loadUnverifiedPolicy() UnverifiedPolicy {
+	allowed := os.Getenv("GRAYNOTE_UNVERIFIED_ALLOW")
+	if len(allowed) == 0 {
+		allowed = actionCreateNotes
+	}
+
+	policy := UnverifiedPolicy{}
+	for _, action := range strings.Split(allowed, ",") {
+		policy[strings.TrimSpace(action)] = true
+	}
+	return policy
+}
+
+// Allows returns if user may take action
+func (p UnverifiedPolicy) Allows(user *User, action string) bool {
+	return user.Verified() || p[action]
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Export states
+const (
+	exportPending  = "pending"
+	exportComplete = "complete"
+	exportFailed   = "failed"
+	exportExpired  = "expired"
+)
+
+// defaultExportTTL is how long a finished archive can be downloaded
+const defaultExportTTL = 48 * time.Hour
+
+// defaultExportTimeout is how long an archive may take to build before it is
+// taken to have died with the process building it
+const defaultExportTimeout = 30 * time.Minute
+
+// Export is a takeout archive of everything a User has stored. Archives
+// are built in the background and kept in exportDir until they expire.
+type Export struct {
+	ID          int
+	UserID      int
+	Status      string
+	FileName    string
+	CreatedAt   time.Time
+	CompletedAt *time.Time
+	ExpiresAt   *time.Time
+}
+
+const exportColumns = "id, user_id, status, file_name, created_at, completed_at, expires_at"
+
+// exportDir reads where archives are kept from GRAYNOTE_EXPORT_DIR
+func exportDir() string {
+	if dir := os.Getenv("GRAYNOTE_EXPORT_DIR"); len(dir) > 0 {
+		return dir
+	}
+	return filepath.Join(os.TempDir(), "graynote-exports")
+}
+
+// exportTTL reads how long archives are kept from GRAYNOTE_EXPORT_TTL
+func exportTTL() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("GRAYNOTE_EXPORT_TTL")); err == nil && d > 0 {
+		return d
+	}
+	return defaultExportTTL
+}
+
+// exportTimeout reads how long an archive may take from GRAYNOTE_EXPORT_TIMEOUT
+func exportTimeout() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("GRAYNOTE_EXPORT_TIMEOUT")); err == nil && d > 0 {
+		return d
+	}
+	return defaultExportTimeout
+}
+
+func createExport(user *User) *Export {
+	stmt, err := db.Prepare("INSERT exports SET user_id=?, status=?, file_name=?, created_at=?")
+	if err != nil {
+		checkErr(err, "prepare create export")
+	} else {
+		defer stmt.Close()
+	}
+	res, err := stmt.Exec(user.ID, exportPending, randomToken()+".zip", time.Now().UTC())
+	checkErr(err, "create export")
+
+	exportID, _ := res.LastInsertId()
+	return findExportByID(exportID)
+}
+
+func findExportByID(exportID int64) *Export {
+	var export *Export
+
+	rows, err := db.Query("SELECT "+exportColumns+" FROM exports WHERE id=?", exportID)
+	if err != nil {
+		checkErr(err, "find export by id")
+	} else {
+		defer rows.Close()
+	}
+
+	if rows.Next() {
+		export = exportFromDbRows(rows)
+	}
+	return export
+}
+
+// findPendingExportByUser returns an export still being built for user, if
+// any. Exports pending past the timeout are ignored, as nothing is building
+// them any more.
+func findPendingExportByUser(user *User) *Export {
+	var export *Export
+
+	rows, err := db.Query(
+		"SELECT "+exportColumns+" FROM exports WHERE user_id=? AND status=? AND created_at > ?",
+		user.ID,
+		exportPending,
+		time.Now().UTC().Add(-exportTimeout()))
+	if err != nil {
+		checkErr(err, "find pending export")
+	} else {
+		defer rows.Close()
+	}
+
+	if rows.Next() {
+		export = exportFromDbRows(rows)
+	}
+	return export
+}
+
+func findExportsByUserID(userID int) []*Export {
+	var exports []*Export
+
+	rows, err := db.Query("SELECT "+exportColumns+" FROM exports WHERE user_id=?", userID)
+	if err != nil {
+		checkErr(err, "find exports by user")
+	} else {
+		defer rows.Close()
+	}
+
+	for rows.Next() {
+		exports = append(exports, exportFromDbRows(rows))
+	}
+	return exports
+}
+
+func exportFromDbRows(rows *sql.Rows) *Export {
+	export := new(Export)
+	rows.Scan(
+		&export.ID,
+		&export.UserID,
+		&export.Status,
+		&export.FileName,
+		&export.CreatedAt,
+		&export.CompletedAt,
+		&export.ExpiresAt)
+	return export
+}
+
+// Path is where the archive is written
+func (e Export) Path() string {
+	return filepath.Join(exportDir(), e.FileName)
+}
+
+// CurrentStatus reports finished archives past their expiry as expired
+func (e Export) CurrentStatus() string {
+	if e.Status == exportComplete && e.ExpiresAt != nil && e.ExpiresAt.Before(time.Now()) {
+		return exportExpired
+	}
+	return e.Status
+}
+
+func (e *Export) finish(status string) {
+	now := time.Now().UTC()
+	e.Status = status
+	e.CompletedAt = &now
+	if status == exportComplete {
+		expires := now.Add(exportTTL())
+		e.ExpiresAt = &expires
+	}
+
+	_, err := db.Exec("UPDATE exports SET status=?, completed_at=?, expires_at=? WHERE id=?", e.Status, e.CompletedAt, e.ExpiresAt, e.ID)
+	checkErr(err, "finish export")
+}
+
+// Destroy removes the archive and its record
+func (e Export) Destroy() {
+	os.Remove(e.Path())
+
+	_, err := db.Exec("DELETE FROM exports WHERE id=?", e.ID)
+	checkErr(err, "destroy export")
+}
+
+// Run builds the archive, recording whether it succeeded
+func (e *Export) Run() {
+	user := findUserByID(int64(e.UserID))
+	if user == nil {
+		e.finish(exportFailed)
+		return
+	}
+
+	if err := writeExportArchive(user, e.Path()); err != nil {
+		log.Println("export failed", e.ID, err)
+		e.finish(exportFailed)
+		return
+	}
+	e.finish(exportComplete)
+}
+
+// writeExportArchive writes user's data as a zip at path. The archive is
+// built under a temporary name so a partial file is never served.
+func writeExportArchive(user *User, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	archive := zip.NewWriter(f)
+	err = writeExportContents(archive, user)
+	if closeErr := archive.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+type exportAccount struct {
+	ID               int              `json:"id"`
+	Email            string           `json:"email"`
+	EmailVerifiedAt  *time.Time       `json:"email_verified_at"`
+	TwoFactorEnabled bool             `json:"two_factor_enabled"`
+	Identities       []exportIdentity `json:"identities"`
+	APIKeys          []exportAPIKey   `json:"api_keys"`
+	ExportedAt       time.Time        `json:"exported_at"`
+}
+
+type exportIdentity struct {
+	Issuer  string `json:"issuer"`
+	Subject string `json:"subject"`
+}
+
+type exportAPIKey struct {
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+type exportShare struct {
+	AuthKey     string `json:"auth_key"`
+	NoteID      int    `json:"note_id"`
+	Permissions string `json:"permissions"`
+}
+
+func writeExportContents(archive *zip.Writer, user *User) error {
+	account := exportAccount{
+		ID:               user.ID,
+		Email:            user.Email,
+		EmailVerifiedAt:  user.EmailVerifiedAt,
+		TwoFactorEnabled: user.TOTPEnabled,
+		Identities:       []exportIdentity{},
+		APIKeys:          []exportAPIKey{},
+		ExportedAt:       time.Now().UTC(),
+	}
+	for _, identity := range user.Identities() {
+		account.Identities = append(account.Identities, exportIdentity{Issuer: identity.Issuer, Subject: identity.Subject})
+	}
+	for _, key := range findAPIKeysByUser(user) {
+		account.APIKeys = append(account.APIKeys, exportAPIKey{
+			Name: key.Name, Prefix: key.KeyPrefix, Scopes: key.Scopes, CreatedAt: key.CreatedAt, LastUsedAt: key.LastUsedAt,
+		})
+	}
+	if err := writeExportJSON(archive, "account.json", account); err != nil {
+		return err
+	}
+
+	shares := []exportShare{}
+	for _, note := range findNotesByUser(user, "") {
+		noteShares := note.Shares()
+		for _, share := range noteShares {
+			shares = append(shares, exportShare{AuthKey: share.AuthKey, NoteID: share.NoteID, Permissions: share.Permissions})
+		}
+
+		w, err := archive.Create(exportNoteName(note))
+		if err != nil {
+			return err
+		}
+		if _, err = io.WriteString(w, noteMarkdown(note, noteShares)); err != nil {
+			return err
+		}
+	}
+	return writeExportJSON(archive, "shares.json", shares)
+}
+
+func writeExportJSON(archive *zip.Writer, name string, v interface{}) error {
+	w, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+var slugUnsafe = regexp.MustCompile(`[^a-z0-9]+`)
+
+// exportNoteName names a note's file by ID and a slug of its title
+func exportNoteName(note *Note) string {
+	slug := strings.Trim(slugUnsafe.ReplaceAllString(strings.ToLower(note.Title), "-"), "-")
+	if len(slug) > 50 {
+		slug = strings.TrimRight(slug[:50], "-")
+	}
+	if len(slug) == 0 {
+		return fmt.Sprintf("notes/%d.md", note.ID)
+	}
+	return fmt.Sprintf("notes/%d-%s.md", note.ID, slug)
+}
+
+// noteMarkdown renders a note as Markdown with YAML front matter. Strings are
+// written as JSON, which YAML reads as double quoted scalars.
+func noteMarkdown(note *Note, shares []*Share) string {
+	var b strings.Builder
+	title, _ := json.Marshal(note.Title)
+
+	b.WriteString("---\n")
+	fmt.Fprintf(&b, "id: %d\n", note.ID)
+	fmt.Fprintf(&b, "title: %s\n", title)
+	if note.CreatedAt != nil {
+		fmt.Fprintf(&b, "created_at: %s\n", note.CreatedAt.Format(time.RFC3339))
+	}
+	if note.UpdatedAt != nil {
+		fmt.Fprintf(&b, "updated_at: %s\n", note.UpdatedAt.Format(time.RFC3339))
+	}
+	if len(shares) > 0 {
+		b.WriteString("shares:\n")
+		for _, share := range shares {
+			fmt.Fprintf(&b, "  - auth_key: %q\n    permissions: %q\n", share.AuthKey, share.Permissions)
+		}
+	}
+	b.WriteString("---\n\n")
+	b.WriteString(note.Body)
+	if !strings.HasSuffix(note.Body, "\n") {
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// purgeExpiredExports removes archives past their expiry and returns how many
+func purgeExpiredExports() int {
+	rows, err := db.Query(
+		"SELECT "+exportColumns+" FROM exports WHERE expires_at IS NOT NULL AND expires_at < ?",
+		time.Now().UTC())
+	checkErr(err, "find expired exports")
+
+	var exports []*Export
+	for rows.Next() {
+		exports = append(exports, exportFromDbRows(rows))
+	}
+	rows.Close()
+
+	for _, export := range exports {
+		export.Destroy()
+	}
+	return len(exports)
+}
+
+// failStaleExports marks exports pending past the timeout as failed. Their
+// build died with the process that ran it.
+func failStaleExports() int64 {
+	now := time.Now().UTC()
+	res, err := db.Exec(
+		"UPDATE exports SET status=?, completed_at=? WHERE status=? AND created_at < ?",
+		exportFailed,
+		now,
+		exportPending,
+		now.Add(-exportTimeout()))
+	checkErr(err, "fail stale exports")
+
+	failed, _ := res.RowsAffected()
+	return failed
+}
+
+// sweepExpiredExports fails abandoned builds and purges expired archives
+// every interval
+func sweepExpiredExports(interval time.Duration) {
+	for range time.Tick(interval) {
+		if failed := failStaleExports(); failed > 0 {
+			log.Printf("failed %d abandoned exports", failed)
+		}
+		if purged := purgeExpiredExports(); purged > 0 {
+			log.Printf("purged %d expired exports", purged)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type exportSuccessResponse struct {
+	ID          int        `json:"id"`
+	Status      string     `json:"status"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+	DownloadURL string     `json:"download_url,omitempty"`
+}
+
+// exportCreateHandler starts building an archive in the background. Asking
+// again while one is being built returns the pending export.
+func exportCreateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Authenticate
+	user := apiAuthenticateUser(r)
+	if user == nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if !apiRequireScope(w, r, user, scopeAccount) {
+		return
+	}
+
+	export := findPendingExportByUser(user)
+	if export == nil {
+		export = createExport(user)
+		go export.Run()
+	}
+
+	w.Header().Set("Location", exportPath(export))
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(exportJSON(export))
+}
+
+func exportShowHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Authenticate
+	user := apiAuthenticateUser(r)
+	if user == nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if !apiRequireScope(w, r, user, scopeAccount) {
+		return
+	}
+
+	exportID, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	export := findExportByID(exportID)
+
+	// Export not found or invalid owner
+	if export == nil || export.UserID != user.ID {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Write(exportJSON(export))
+}
+
+func exportDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Authenticate
+	user := apiAuthenticateUser(r)
+	if user == nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if !apiRequireScope(w, r, user, scopeAccount) {
+		return
+	}
+
+	exportID, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	export := findExportByID(exportID)
+
+	// Export not found or invalid owner
+	if export == nil || export.UserID != user.ID {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	status := export.CurrentStatus()
+	if status == exportExpired {
+		apiErrorHandler(w, r, http.StatusGone, []APIError{{Field: "export", Message: "has expired"}})
+		return
+	}
+	if status != exportComplete {
+		apiErrorHandler(w, r, http.StatusConflict, []APIError{{Field: "export", Message: "is not ready"}})
+		return
+	}
+
+	f, err := os.Open(export.Path())
+	if err != nil {
+		apiErrorHandler(w, r, http.StatusGone, []APIError{{Field: "export", Message: "has expired"}})
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"graynote-export-%d.zip\"", export.ID))
+	http.ServeContent(w, r, "", *export.CompletedAt, f)
+}
+
+func exportPath(export *Export) string {
+	return fmt.Sprintf("/users/me/exports/%d", export.ID)
+}
+
+func exportJSON(export *Export) []byte {
+	response := exportSuccessResponse{
+		ID:          export.ID,
+		Status:      export.CurrentStatus(),
+		CreatedAt:   export.CreatedAt,
+		CompletedAt: export.CompletedAt,
+		ExpiresAt:   export.ExpiresAt,
+	}
+	if response.Status == exportComplete {
+		response.DownloadURL = exportPath(export) + "/download"
+	}
+	responseJSON, _ := json.Marshal(response)
+	return responseJSON
+}
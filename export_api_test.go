@@ -0,0 +1,113 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func exportRequest(method string, path string, token string) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest(method, path, nil)
+	r.Header.Set("X-Auth-Token", token)
+	w := httptest.NewRecorder()
+	router().ServeHTTP(w, r)
+	return w
+}
+
+func TestExportFlow(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	os.Setenv("GRAYNOTE_EXPORT_DIR", t.TempDir())
+	defer os.Unsetenv("GRAYNOTE_EXPORT_DIR")
+
+	share := factoryCreateShare("read")
+	user := findUserByEmail("user@site.com")
+
+	w := exportRequest("POST", "/users/me/exports", user.AuthToken)
+	if w.Code != 202 {
+		t.Fatalf("Expected 202, got %d", w.Code)
+	}
+	location := w.Header().Get("Location")
+
+	// Poll until the background job finishes
+	var status exportSuccessResponse
+	for i := 0; i < 50; i++ {
+		w = exportRequest("GET", location, user.AuthToken)
+		json.Unmarshal(w.Body.Bytes(), &status)
+		if status.Status != exportPending {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if status.Status != exportComplete || status.DownloadURL != location+"/download" {
+		t.Fatalf("Expected a complete export, got %q", w.Body.String())
+	}
+
+	w = exportRequest("GET", status.DownloadURL, user.AuthToken)
+	if w.Code != 200 || w.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("Expected a zip, got %d", w.Code)
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatalf("Expected a valid zip: %v", err)
+	}
+	files := map[string]string{}
+	for _, f := range archive.File {
+		rc, _ := f.Open()
+		contents, _ := io.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = string(contents)
+	}
+
+	if !strings.Contains(files["account.json"], "\"email\": \"user@site.com\"") {
+		t.Errorf("Expected account.json, got %q", files["account.json"])
+	}
+	if !strings.Contains(files["shares.json"], share.AuthKey) {
+		t.Errorf("Expected shares.json to list the share")
+	}
+	note := findNoteByID(int64(share.NoteID))
+	if md := files[exportNoteName(note)]; !strings.Contains(md, "title: \"title\"") || !strings.HasSuffix(md, "body\n") {
+		t.Errorf("Expected the note as Markdown, got %q", md)
+	}
+}
+
+func TestExportDownloadExpired(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	os.Setenv("GRAYNOTE_EXPORT_DIR", t.TempDir())
+	defer os.Unsetenv("GRAYNOTE_EXPORT_DIR")
+
+	user := factoryCreateUser("user@site.com")
+	export := createExport(user)
+	export.Run()
+	db.Exec("UPDATE exports SET expires_at=? WHERE id=?", time.Now().UTC().Add(-time.Minute), export.ID)
+
+	w := exportRequest("GET", exportPath(export)+"/download", user.AuthToken)
+	if w.Code != 410 {
+		t.Errorf("Expected 410, got %d", w.Code)
+	}
+}
+
+func TestExportShowHandlerOtherUser(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	other := factoryCreateUser("other@site.com")
+	export := createExport(user)
+
+	w := exportRequest("GET", exportPath(export), other.AuthToken)
+	if w.Code != 404 {
+		t.Errorf("Expected 404, got %d", w.Code)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNoteMarkdown(t *testing.T) {
+	note := &Note{ID: 7, Title: "Say \"hi\"", Body: "# Heading"}
+	shares := []*Share{{AuthKey: "abc", Permissions: "read"}}
+
+	expected := "---\nid: 7\ntitle: \"Say \\\"hi\\\"\"\nshares:\n  - auth_key: \"abc\"\n    permissions: \"read\"\n---\n\n# Heading\n"
+	if md := noteMarkdown(note, shares); md != expected {
+		t.Errorf("Expected %q, got %q", expected, md)
+	}
+}
+
+func TestExportNoteName(t *testing.T) {
+	cases := map[string]string{
+		"Shopping List!": "notes/3-shopping-list.md",
+		"../../etc":      "notes/3-etc.md",
+		"":               "notes/3.md",
+	}
+	for title, expected := range cases {
+		if name := exportNoteName(&Note{ID: 3, Title: title}); name != expected {
+			t.Errorf("Expected %q, got %q", expected, name)
+		}
+	}
+}
+
+func TestPurgeExpiredExports(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	dir := t.TempDir()
+	os.Setenv("GRAYNOTE_EXPORT_DIR", dir)
+	defer os.Unsetenv("GRAYNOTE_EXPORT_DIR")
+
+	user := factoryCreateUser("user@site.com")
+	export := createExport(user)
+	export.Run()
+
+	if _, err := os.Stat(export.Path()); err != nil {
+		t.Fatalf("Expected archive to be written")
+	}
+	if purgeExpiredExports() != 0 {
+		t.Errorf("Expected a fresh archive to be kept")
+	}
+
+	past := time.Now().UTC().Add(-time.Minute)
+	db.Exec("UPDATE exports SET expires_at=? WHERE id=?", past, export.ID)
+
+	if purgeExpiredExports() != 1 {
+		t.Errorf("Expected the expired archive to be purged")
+	}
+	if _, err := os.Stat(export.Path()); !os.IsNotExist(err) {
+		t.Errorf("Expected archive file to be removed")
+	}
+}
+
+func TestFailStaleExports(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	export := createExport(user)
+
+	if failStaleExports() != 0 || findPendingExportByUser(user) == nil {
+		t.Fatalf("Expected a fresh export to be left pending")
+	}
+
+	// The process building it died over an hour ago
+	past := time.Now().UTC().Add(-time.Hour)
+	db.Exec("UPDATE exports SET created_at=? WHERE id=?", past, export.ID)
+
+	if findPendingExportByUser(user) != nil {
+		t.Errorf("Expected a stale export not to block a new one")
+	}
+	if failStaleExports() != 1 || findExportByID(int64(export.ID)).Status != exportFailed {
+		t.Errorf("Expected the stale export to be failed")
+	}
+}
@@ -1,24 +1,31 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
-	"github.com/gorilla/sessions"
 
 	_ "github.com/go-sql-driver/mysql"
 )
 
 var db *sql.DB
 
-var sessionStore = sessions.NewCookieStore([]byte(os.Getenv("GRAYNOTE_SESSION_KEY")))
-
 func main() {
 	fmt.Println("Graynote Server")
+
+	// Session cookies can't be signed without a key
+	if len(os.Getenv("GRAYNOTE_SESSION_KEY")) == 0 {
+		log.Fatalln("GRAYNOTE_SESSION_KEY must be set")
+	}
+
 	dbSetup(
 		os.Getenv("GRAYNOTE_DB_USER"),
 		os.Getenv("GRAYNOTE_DB_PASS"),
@@ -27,35 +34,162 @@ func main() {
 
 	defer db.Close()
 
-	r := router()
-	http.Handle("/", r)
-	http.ListenAndServe(":8181", nil)
+	// Metrics may be kept off the public listener
+	if adminAddr := os.Getenv("GRAYNOTE_ADMIN_ADDR"); len(adminAddr) > 0 {
+		go func() {
+			err := http.ListenAndServe(adminAddr, adminRouter())
+			checkErr(err, "admin listen failed")
+		}()
+	}
+
+	// Exports left pending by a previous run will never finish
+	failStaleExports()
+
+	// Deleted accounts, expired exports, idempotency keys, share sessions and
+	// old share activity are purged in the background
+	go sweepDeletedUsers(time.Hour)
+	go sweepExpiredExports(time.Hour)
+	go sweepIdempotencyKeys(time.Hour)
+	go sweepShareSessions(time.Hour)
+	go sweepShareActivity(time.Hour)
+
+	server := &http.Server{Addr: ":8181", Handler: router()}
+	shutdown := make(chan struct{})
+	go shutdownOnSignal(server, shutdown)
+
+	err := server.ListenAndServe()
+	if err != http.ErrServerClosed {
+		checkErr(err, "listen failed")
+	}
+
+	// ListenAndServe returns as soon as Shutdown starts; requests still in
+	// flight need the database until it is done
+	<-shutdown
+}
+
+// shutdownOnSignal fails readiness checks for a drain period, so load
+// balancers stop sending traffic, then shuts the server down gracefully.
+// done is closed once in-flight requests have finished.
+func shutdownOnSignal(server *http.Server, done chan struct{}) {
+	defer close(done)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+
+	shuttingDown.Store(true)
+
+	drain := 5 * time.Second
+	if d, err := time.ParseDuration(os.Getenv("GRAYNOTE_SHUTDOWN_DRAIN")); err == nil {
+		drain = d
+	}
+	time.Sleep(drain)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("shutdown did not finish", err)
+	}
 }
 
 func router() *mux.Router {
 	r := mux.NewRouter()
-	r.HandleFunc("/notes", optionsHandler).Methods("OPTIONS")
-	r.HandleFunc("/notes/{id:[0-9]+}", optionsHandler).Methods("OPTIONS")
+	r.Use(metricsMiddleware)
+	r.Use(corsMiddleware)
+	r.Use(rateLimitMiddleware)
+	r.Use(idempotencyMiddleware)
+
+	// Preflight for every route. A plain matcher rather than Methods keeps
+	// unknown paths answering 404 instead of 405.
+	r.MatcherFunc(isPreflightRequest).HandlerFunc(optionsHandler)
+
+	if len(os.Getenv("GRAYNOTE_ADMIN_ADDR")) == 0 {
+		r.Handle("/metrics", metricsHandler()).Methods("GET")
+	}
+
+	r.HandleFunc("/healthz", healthzHandler).Methods("GET")
+	r.HandleFunc("/readyz", readyzHandler).Methods("GET")
 
 	r.HandleFunc("/users/register", userRegisterHandler).Methods("POST")
 	r.HandleFunc("/users/login", userLoginHandler).Methods("POST")
+	r.HandleFunc("/users/logout", userLogoutHandler).Methods("POST")
+	r.HandleFunc("/users/oidc/login", oidcLoginHandler).Methods("GET")
+	r.HandleFunc("/users/oidc/callback", oidcCallbackHandler).Methods("GET")
+	r.HandleFunc("/users/login/2fa", userLoginTwoFactorHandler).Methods("POST")
+	r.HandleFunc("/users/2fa/enroll", userTwoFactorEnrollHandler).Methods("POST")
+	r.HandleFunc("/users/2fa/confirm", userTwoFactorConfirmHandler).Methods("POST")
+	r.HandleFunc("/users/2fa/disable", userTwoFactorDisableHandler).Methods("POST")
+	r.HandleFunc("/users/2fa/recovery-codes", userRecoveryCodesHandler).Methods("POST")
+	r.HandleFunc("/users/verify", userVerifyHandler).Methods("POST")
+	r.HandleFunc("/users/verify/resend", userVerifyResendHandler).Methods("POST")
+	r.HandleFunc("/users/password/forgot", userPasswordForgotHandler).Methods("POST")
+	r.HandleFunc("/users/password/reset", userPasswordResetHandler).Methods("POST")
+	r.HandleFunc("/users/me", userMeHandler).Methods("GET")
+	r.HandleFunc("/users/me", userDeleteHandler).Methods("DELETE")
+	r.HandleFunc("/users/me/password", userChangePasswordHandler).Methods("PUT")
+	r.HandleFunc("/users/me/email", userChangeEmailHandler).Methods("PUT")
+	r.HandleFunc("/users/me/exports", exportCreateHandler).Methods("POST")
+	r.HandleFunc("/users/me/exports/{id:[0-9]+}", exportShowHandler).Methods("GET")
+	r.HandleFunc("/users/me/exports/{id:[0-9]+}/download", exportDownloadHandler).Methods("GET")
+	r.HandleFunc("/users/api-keys", apiKeyIndexHandler).Methods("GET")
+	r.HandleFunc("/users/api-keys", apiKeyCreateHandler).Methods("POST")
+	r.HandleFunc("/users/api-keys/{id:[0-9]+}", apiKeyDeleteHandler).Methods("DELETE")
 
 	r.HandleFunc("/notes", noteIndexHandler).Methods("GET")
 	r.HandleFunc("/notes", noteCreateHandler).Methods("POST")
+	r.HandleFunc("/notes/import", noteImportHandler).Methods("POST")
+	r.HandleFunc("/notes/batch", noteBatchHandler).Methods("POST")
+	r.HandleFunc("/notes/shared-with-me", noteSharedWithMeHandler).Methods("GET")
+	r.HandleFunc("/notes/{id:[0-9]+}/shares", noteSharesDeleteHandler).Methods("DELETE")
+	r.HandleFunc("/notes/{id:[0-9]+}/share-activity", noteShareActivityHandler).Methods("GET")
+	r.HandleFunc("/notes/{id:[0-9]+}/collaborators", collaboratorIndexHandler).Methods("GET")
+	r.HandleFunc("/notes/{id:[0-9]+}/collaborators", collaboratorCreateHandler).Methods("POST")
+	r.HandleFunc("/notes/{id:[0-9]+}/collaborators/{collaborator_id:[0-9]+}", collaboratorDeleteHandler).Methods("DELETE")
+	r.HandleFunc("/notes/{id:[0-9]+}/comments", commentIndexHandler).Methods("GET")
+	r.HandleFunc("/notes/{id:[0-9]+}/comments", commentCreateHandler).Methods("POST")
+	r.HandleFunc("/notes/{id:[0-9]+}/comments/{comment_id:[0-9]+}", commentUpdateHandler).Methods("PATCH")
+	r.HandleFunc("/notes/{id:[0-9]+}/comments/{comment_id:[0-9]+}", commentDeleteHandler).Methods("DELETE")
+	r.HandleFunc("/notes/{id:[0-9]+}/comments/{comment_id:[0-9]+}/resolve", commentResolveHandler).Methods("POST", "DELETE")
+	// Share keys in place of a note ID are deprecated in favour of /s/{key}
 	r.HandleFunc("/notes/{id:[a-z0-9]+}", noteShowHandler).Methods("GET")
 	r.HandleFunc("/notes/{id:[a-z0-9]+}", noteUpdateHandler).Methods("PUT")
+	r.HandleFunc("/notes/{id:[a-z0-9]+}", notePatchHandler).Methods("PATCH")
+	r.HandleFunc("/notes/{id:[a-z0-9]+}/delta", noteDeltaHandler).Methods("POST")
 	r.HandleFunc("/notes/{id:[0-9]+}", noteDeleteHandler).Methods("DELETE")
-
+	r.HandleFunc("/s/{key:[a-z0-9]+}", sharePageHandler).Methods("GET").MatcherFunc(acceptsHTML)
+	r.HandleFunc("/s/{key:[a-z0-9]+}", sharePageUpdateHandler).Methods("POST")
+	r.HandleFunc("/s/{key:[a-z0-9]+}/unlock", sharePageUnlockHandler).Methods("POST")
+	r.HandleFunc("/s/{key:[a-z0-9]+}", noteShowHandler).Methods("GET")
+	r.HandleFunc("/s/{key:[a-z0-9]+}", noteUpdateHandler).Methods("PUT")
+	r.HandleFunc("/s/{key:[a-z0-9]+}", notePatchHandler).Methods("PATCH")
+	r.HandleFunc("/s/{key:[a-z0-9]+}/delta", noteDeltaHandler).Methods("POST")
+	r.HandleFunc("/s/{key:[a-z0-9]+}/comments", commentIndexHandler).Methods("GET")
+	r.HandleFunc("/s/{key:[a-z0-9]+}/comments", commentCreateHandler).Methods("POST")
+	r.HandleFunc("/s/{key:[a-z0-9]+}/comments/{comment_id:[0-9]+}", commentUpdateHandler).Methods("PATCH")
+	r.HandleFunc("/s/{key:[a-z0-9]+}/comments/{comment_id:[0-9]+}", commentDeleteHandler).Methods("DELETE")
+	r.HandleFunc("/s/{key:[a-z0-9]+}/comments/{comment_id:[0-9]+}/resolve", commentResolveHandler).Methods("POST", "DELETE")
+
+	r.HandleFunc("/shares", shareIndexHandler).Methods("GET")
 	r.HandleFunc("/shares", shareCreateHandler).Methods("POST")
+	r.HandleFunc("/shares/{id:[A-z0-9]+}", shareShowHandler).Methods("GET")
+	r.HandleFunc("/shares/{id:[A-z0-9]+}", shareUpdateHandler).Methods("PATCH")
 	r.HandleFunc("/shares/{id:[A-z0-9]+}", shareDeleteHandler).Methods("DELETE")
+	r.HandleFunc("/shares/{id:[A-z0-9]+}/session", shareSessionCreateHandler).Methods("POST")
+	r.HandleFunc("/shares/{id:[A-z0-9]+}/activity", shareActivityHandler).Methods("GET")
 
 	return r
 }
 
+func adminRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.Handle("/metrics", metricsHandler()).Methods("GET")
+	return r
+}
+
 func dbSetup(dbUser string, dbPass string, dbName string, wipe bool) {
 	var err error
 
-	dbConnect := fmt.Sprintf("%s:%s@tcp(127.0.0.1:3306)/%s", dbUser, dbPass, dbName)
+	dbConnect := fmt.Sprintf("%s:%s@tcp(127.0.0.1:3306)/%s?parseTime=true", dbUser, dbPass, dbName)
 
 	db, err = sql.Open("mysql", dbConnect)
 	db.SetMaxIdleConns(10000)
@@ -66,22 +200,13 @@ func dbSetup(dbUser string, dbPass string, dbName string, wipe bool) {
 	checkErr(err, "db ping failed")
 
 	if wipe {
-		_, err = db.Exec("DROP TABLE IF EXISTS users")
-		checkErr(err, "drop table users")
-		_, err = db.Exec("DROP TABLE IF EXISTS notes")
-		checkErr(err, "drop table notes")
-		_, err = db.Exec("DROP TABLE IF EXISTS shares")
-		checkErr(err, "drop table shares")
+		for _, table := range schemaTables {
+			_, err = db.Exec("DROP TABLE IF EXISTS " + table)
+			checkErr(err, "drop table "+table)
+		}
 	}
 
-	_, err = db.Exec("CREATE TABLE IF NOT EXISTS notes (id integer AUTO_INCREMENT NOT NULL PRIMARY KEY, user_id integer, title varchar(255), body text)")
-	checkErr(err, "create table Notes failed")
-
-	_, err = db.Exec("CREATE TABLE IF NOT EXISTS users (id integer AUTO_INCREMENT NOT NULL PRIMARY KEY, email varchar(255), password_hash varchar(255), auth_token varchar(64))")
-	checkErr(err, "create table Users failed")
-
-	_, err = db.Exec("CREATE TABLE IF NOT EXISTS shares (id integer AUTO_INCREMENT NOT NULL PRIMARY KEY, auth_key varchar(255), note_id integer, permissions varchar(255))")
-	checkErr(err, "create table Shares failed")
+	runMigrations()
 }
 
 func checkErr(err error, msg string) {
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// shuttingDown is set once the server starts draining connections
+var shuttingDown atomic.Bool
+
+type readinessResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// healthzHandler reports that the process is up, without touching dependencies
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte("{\"status\":\"ok\"}"))
+}
+
+// readyzHandler reports whether this instance should receive traffic
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+
+	response := readinessResponse{Status: "ok", Checks: map[string]string{}}
+
+	// Database. Errors are only logged, as they may name hosts or accounts.
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		log.Println("readiness database check failed", err)
+		response.Checks["database"] = "unavailable"
+	} else {
+		response.Checks["database"] = "ok"
+	}
+
+	// Migrations
+	if version, err := schemaVersion(); err != nil {
+		log.Println("readiness migrations check failed", err)
+		response.Checks["migrations"] = "unavailable"
+	} else if version != len(migrations) {
+		log.Printf("readiness migrations check: at version %d, expected %d", version, len(migrations))
+		response.Checks["migrations"] = "pending"
+	} else {
+		response.Checks["migrations"] = "ok"
+	}
+
+	for _, check := range response.Checks {
+		if check != "ok" {
+			response.Status = "degraded"
+		}
+	}
+
+	if shuttingDown.Load() {
+		response.Status = "shutting_down"
+	}
+
+	if response.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	responseJSON, _ := json.Marshal(response)
+	w.Write(responseJSON)
+}
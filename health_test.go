@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealthzHandler(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/healthz", nil)
+	w := httptest.NewRecorder()
+
+	router().ServeHTTP(w, r)
+
+	if w.Code != 200 {
+		t.Errorf("Expected 200, got %d", w.Code)
+	}
+}
+
+func TestReadyzHandlerSuccess(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	r, _ := http.NewRequest("GET", "/readyz", nil)
+	w := httptest.NewRecorder()
+
+	router().ServeHTTP(w, r)
+
+	if w.Code != 200 {
+		t.Errorf("Expected 200, got %d", w.Code)
+	}
+
+	expectedBody := "{\"status\":\"ok\",\"checks\":{\"database\":\"ok\",\"migrations\":\"ok\"}}"
+	if b := w.Body.String(); b != expectedBody {
+		t.Errorf("Expected %q, got %q", expectedBody, b)
+	}
+}
+
+func TestReadyzHandlerFailPendingMigrations(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	_, err := db.Exec("DELETE FROM schema_migrations WHERE version=?", len(migrations))
+	checkErr(err, "delete migration")
+
+	r, _ := http.NewRequest("GET", "/readyz", nil)
+	w := httptest.NewRecorder()
+
+	router().ServeHTTP(w, r)
+
+	if w.Code != 503 {
+		t.Errorf("Expected 503, got %d", w.Code)
+	}
+
+	expectedBody := "{\"status\":\"degraded\",\"checks\":{\"database\":\"ok\",\"migrations\":\"pending\"}}"
+	if b := w.Body.String(); b != expectedBody {
+		t.Errorf("Expected %q, got %q", expectedBody, b)
+	}
+}
+
+func TestReadyzHandlerFailDatabase(t *testing.T) {
+	db := testDbSetup()
+	db.Close()
+
+	r, _ := http.NewRequest("GET", "/readyz", nil)
+	w := httptest.NewRecorder()
+
+	router().ServeHTTP(w, r)
+
+	if w.Code != 503 {
+		t.Errorf("Expected 503, got %d", w.Code)
+	}
+
+	// Driver errors aren't passed on
+	expectedBody := "{\"status\":\"degraded\",\"checks\":{\"database\":\"unavailable\",\"migrations\":\"unavailable\"}}"
+	if b := w.Body.String(); b != expectedBody {
+		t.Errorf("Expected %q, got %q", expectedBody, b)
+	}
+}
+
+func TestReadyzHandlerFailShuttingDown(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	shuttingDown.Store(true)
+	defer shuttingDown.Store(false)
+
+	r, _ := http.NewRequest("GET", "/readyz", nil)
+	w := httptest.NewRecorder()
+
+	router().ServeHTTP(w, r)
+
+	if w.Code != 503 {
+		t.Errorf("Expected 503, got %d", w.Code)
+	}
+}
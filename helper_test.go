@@ -2,10 +2,14 @@ package main
 
 import (
 	"database/sql"
+	"io"
 	"os"
 )
 
 func testDbSetup() *sql.DB {
+	rateLimitSetup()
+	sessionSetup("graynote-test-session-key")
+	mailer = &LogMailer{W: io.Discard}
 	dbSetup(
 		os.Getenv("GRAYNOTE_DB_USER"),
 		os.Getenv("GRAYNOTE_DB_PASS"),
@@ -16,7 +20,8 @@ func testDbSetup() *sql.DB {
 
 func factoryCreateUser(email string) *User {
 	form := UserRegisterForm{Email: email, Password: "password"}
-	createUser(&form)
+	user := createUser(&form)
+	user.MarkEmailVerified()
 	return findUserByEmail(email)
 }
 
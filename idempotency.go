@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const idempotencyHeader = "Idempotency-Key"
+
+// defaultIdempotencyWindow is how long responses are kept for replay
+const defaultIdempotencyWindow = 24 * time.Hour
+
+// idempotencyInFlightTimeout is how long a request may hold its key before
+// it is taken to have died without answering
+const idempotencyInFlightTimeout = 5 * time.Minute
+
+// Limits on idempotent requests
+const (
+	maxIdempotencyKeyLength = 255
+	maxIdempotentBodyBytes  = 64 << 20
+)
+
+// idempotentRoutes are the POST routes that accept an Idempotency-Key. They
+// create content whose responses are safe to store; routes that issue tokens,
+// keys or sessions are left out so no secret is ever kept for replay.
+var idempotentRoutes = map[string]bool{
+	"/notes":        true,
+	"/notes/batch":  true,
+	"/notes/import": true,
+	"/shares":       true,
+}
+
+// IdempotencyRecord is the stored outcome of a POST made with an
+// Idempotency-Key. Status is zero while the first request is in flight.
+type IdempotencyRecord struct {
+	ID          int
+	UserID      int
+	Key         string
+	RequestHash string
+	Status      int
+	ContentType string
+	Location    string
+	Body        []byte
+	CreatedAt   time.Time
+}
+
+const idempotencyColumns = "id, user_id, idem_key, request_hash, status, content_type, location, body, created_at"
+
+// idempotencyWindow reads the replay window from GRAYNOTE_IDEMPOTENCY_WINDOW
+func idempotencyWindow() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("GRAYNOTE_IDEMPOTENCY_WINDOW")); err == nil && d > 0 {
+		return d
+	}
+	return defaultIdempotencyWindow
+}
+
+// claimIdempotencyKey records that a request with key is in flight. It
+// returns nil if the key is already taken within the window.
+func claimIdempotencyKey(user *User, key string, requestHash string) *IdempotencyRecord {
+	now := time.Now().UTC()
+
+	// An expired record no longer holds the key, nor does one left in flight
+	// by a request that crashed
+	_, err := db.Exec(
+		"DELETE FROM idempotency_keys WHERE user_id=? AND idem_key=? AND (created_at < ? OR (status=0 AND created_at < ?))",
+		user.ID,
+		key,
+		now.Add(-idempotencyWindow()),
+		now.Add(-idempotencyInFlightTimeout))
+	checkErr(err, "expire idempotency key")
+
+	res, err := db.Exec(
+		"INSERT IGNORE INTO idempotency_keys (user_id, idem_key, request_hash, status, content_type, location, body, created_at) VALUES (?, ?, ?, 0, '', '', '', ?)",
+		user.ID, key, requestHash, now)
+	checkErr(err, "claim idempotency key")
+
+	if affected, _ := res.RowsAffected(); affected != 1 {
+		return nil
+	}
+	id, _ := res.LastInsertId()
+	return &IdempotencyRecord{ID: int(id), UserID: user.ID, Key: key, RequestHash: requestHash, CreatedAt: now}
+}
+
+// findIdempotencyRecord returns the record for key if it is within the window
+func findIdempotencyRecord(user *User, key string) *IdempotencyRecord {
+	var record *IdempotencyRecord
+
+	rows, err := db.Query(
+		"SELECT "+idempotencyColumns+" FROM idempotency_keys WHERE user_id=? AND idem_key=? AND created_at >= ?",
+		user.ID,
+		key,
+		time.Now().UTC().Add(-idempotencyWindow()))
+	if err != nil {
+		checkErr(err, "find idempotency record")
+	} else {
+		defer rows.Close()
+	}
+
+	if rows.Next() {
+		record = idempotencyRecordFromDbRows(rows)
+	}
+	return record
+}
+
+func idempotencyRecordFromDbRows(rows *sql.Rows) *IdempotencyRecord {
+	record := new(IdempotencyRecord)
+	rows.Scan(
+		&record.ID,
+		&record.UserID,
+		&record.Key,
+		&record.RequestHash,
+		&record.Status,
+		&record.ContentType,
+		&record.Location,
+		&record.Body,
+		&record.CreatedAt)
+	return record
+}
+
+// Complete stores the response to replay
+func (i *IdempotencyRecord) Complete(status int, contentType string, location string, body []byte) {
+	i.Status, i.ContentType, i.Location, i.Body = status, contentType, location, body
+
+	_, err := db.Exec(
+		"UPDATE idempotency_keys SET status=?, content_type=?, location=?, body=? WHERE id=?",
+		status, contentType, location, body, i.ID)
+	checkErr(err, "complete idempotency record")
+}
+
+// Destroy releases the key so the request can be tried again
+func (i IdempotencyRecord) Destroy() {
+	_, err := db.Exec("DELETE FROM idempotency_keys WHERE id=?", i.ID)
+	checkErr(err, "destroy idempotency record")
+}
+
+// Replay writes the stored response
+func (i IdempotencyRecord) Replay(w http.ResponseWriter) {
+	if len(i.ContentType) > 0 {
+		w.Header().Set("Content-Type", i.ContentType)
+	}
+	if len(i.Location) > 0 {
+		w.Header().Set("Location", i.Location)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(i.Status)
+	w.Write(i.Body)
+}
+
+// idempotentStatus returns if a response is final enough to replay. Server
+// errors and refusals that may pass on retry, such as rate limits or a
+// missing scope, are not kept.
+func idempotentStatus(status int) bool {
+	return status < 500 &&
+		status != http.StatusUnauthorized &&
+		status != http.StatusForbidden &&
+		status != http.StatusTooManyRequests
+}
+
+// requestFingerprint hashes what makes two requests the same
+func requestFingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.RequestURI()+"\n"+r.Header.Get("Content-Type")+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// idempotencyMiddleware replays the first response to an authenticated POST
+// on one of the idempotentRoutes retried with the same Idempotency-Key, so
+// retries don't create duplicates
+func idempotencyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyHeader)
+		if r.Method != "POST" || len(key) == 0 || !idempotentRoute(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Keys are kept per user; unauthenticated requests are left to the handler
+		user, _ := requestUser(r)
+		if user == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if len(key) > maxIdempotencyKeyLength {
+			apiErrorHandler(w, r, http.StatusBadRequest, []APIError{{Field: "idempotency_key", Message: "is invalid"}})
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxIdempotentBodyBytes+1))
+		if err != nil || len(body) > maxIdempotentBodyBytes {
+			apiErrorHandler(w, r, http.StatusRequestEntityTooLarge, []APIError{{Field: "body", Message: "is too large"}})
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		requestHash := requestFingerprint(r, body)
+
+		record := claimIdempotencyKey(user, key, requestHash)
+		if record == nil {
+			existing := findIdempotencyRecord(user, key)
+			switch {
+			case existing == nil || existing.Status == 0:
+				apiErrorHandler(w, r, http.StatusConflict, []APIError{{Field: "idempotency_key", Message: "is in use"}})
+			case existing.RequestHash != requestHash:
+				apiErrorHandler(w, r, http.StatusConflict, []APIError{{Field: "idempotency_key", Message: "was used with a different request"}})
+			default:
+				existing.Replay(w)
+			}
+			return
+		}
+
+		rw := &recordingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rw, r)
+
+		if idempotentStatus(rw.status) {
+			record.Complete(rw.status, w.Header().Get("Content-Type"), w.Header().Get("Location"), rw.body.Bytes())
+		} else {
+			record.Destroy()
+		}
+	})
+}
+
+// idempotentRoute returns if the route matched for r is an idempotentRoute
+func idempotentRoute(r *http.Request) bool {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return false
+	}
+	template, err := route.GetPathTemplate()
+	return err == nil && idempotentRoutes[template]
+}
+
+// recordingResponseWriter keeps a copy of the status and body written
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingResponseWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// purgeExpiredIdempotencyKeys removes records older than the window
+func purgeExpiredIdempotencyKeys() int64 {
+	res, err := db.Exec("DELETE FROM idempotency_keys WHERE created_at < ?", time.Now().UTC().Add(-idempotencyWindow()))
+	checkErr(err, "purge idempotency keys")
+
+	purged, _ := res.RowsAffected()
+	return purged
+}
+
+// sweepIdempotencyKeys purges expired records every interval
+func sweepIdempotencyKeys(interval time.Duration) {
+	for range time.Tick(interval) {
+		if purged := purgeExpiredIdempotencyKeys(); purged > 0 {
+			log.Printf("purged %d idempotency keys", purged)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func idempotentNoteRequest(token string, key string, body string) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest("POST", "/notes", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("X-Auth-Token", token)
+	r.Header.Set("Idempotency-Key", key)
+	w := httptest.NewRecorder()
+	router().ServeHTTP(w, r)
+	return w
+}
+
+func TestIdempotencyReplay(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+
+	first := idempotentNoteRequest(user.AuthToken, "abc", "title=Once&body=only")
+	second := idempotentNoteRequest(user.AuthToken, "abc", "title=Once&body=only")
+
+	if first.Code != 201 || second.Code != 201 {
+		t.Fatalf("Expected 201 twice, got %d and %d", first.Code, second.Code)
+	}
+	if first.Body.String() != second.Body.String() {
+		t.Errorf("Expected %q to be replayed, got %q", first.Body.String(), second.Body.String())
+	}
+	if second.Header().Get("Idempotent-Replayed") != "true" || first.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("Expected only the retry to be marked as replayed")
+	}
+	if notes := findNotesByUser(user, ""); len(notes) != 1 {
+		t.Errorf("Expected 1 note, got %d", len(notes))
+	}
+}
+
+func TestIdempotencyDifferentRequest(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+
+	idempotentNoteRequest(user.AuthToken, "abc", "title=Once&body=only")
+	w := idempotentNoteRequest(user.AuthToken, "abc", "title=Twice&body=again")
+
+	if w.Code != 409 {
+		t.Errorf("Expected 409, got %d", w.Code)
+	}
+	expectedBody := "{\"idempotency_key\":\"was used with a different request\"}"
+	if b := w.Body.String(); b != expectedBody {
+		t.Errorf("Expected %q, got %q", expectedBody, b)
+	}
+}
+
+func TestIdempotencyKeysArePerUser(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	other := factoryCreateUser("other@site.com")
+
+	idempotentNoteRequest(user.AuthToken, "abc", "title=Mine&body=mine")
+	w := idempotentNoteRequest(other.AuthToken, "abc", "title=Theirs&body=theirs")
+
+	if w.Code != 201 || w.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("Expected a new note for another user, got %d", w.Code)
+	}
+	if notes := findNotesByUser(other, ""); len(notes) != 1 {
+		t.Errorf("Expected 1 note, got %d", len(notes))
+	}
+}
+
+func TestIdempotencyFailuresAreNotKept(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	_, plain := createAPIKey(user, "reader", []string{scopeNotesRead}, nil, nil)
+
+	if w := idempotentNoteRequest(plain, "abc", "title=Once&body=only"); w.Code != 403 {
+		t.Fatalf("Expected 403, got %d", w.Code)
+	}
+	if w := idempotentNoteRequest(user.AuthToken, "abc", "title=Once&body=only"); w.Code != 201 || w.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("Expected the key to be free after a refusal, got %d", w.Code)
+	}
+}
+
+func TestIdempotencyWindowExpires(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	idempotentNoteRequest(user.AuthToken, "abc", "title=Once&body=only")
+
+	_, err := db.Exec("UPDATE idempotency_keys SET created_at = DATE_SUB(created_at, INTERVAL 2 DAY)")
+	checkErr(err, "age idempotency key")
+
+	if w := idempotentNoteRequest(user.AuthToken, "abc", "title=Twice&body=again"); w.Code != 201 {
+		t.Errorf("Expected an expired key to be reusable, got %d", w.Code)
+	}
+
+	os.Setenv("GRAYNOTE_IDEMPOTENCY_WINDOW", "1h")
+	defer os.Unsetenv("GRAYNOTE_IDEMPOTENCY_WINDOW")
+	_, err = db.Exec("UPDATE idempotency_keys SET created_at = DATE_SUB(created_at, INTERVAL 2 HOUR)")
+	checkErr(err, "age idempotency key")
+
+	if purged := purgeExpiredIdempotencyKeys(); purged != 1 {
+		t.Errorf("Expected 1 key to be purged, got %d", purged)
+	}
+}
+
+func TestIdempotencySkipsSecretRoutes(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+
+	r, _ := http.NewRequest("POST", "/users/api-keys", strings.NewReader("name=ci&scopes=notes:read"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("X-Auth-Token", user.AuthToken)
+	r.Header.Set("Idempotency-Key", "abc")
+	w := httptest.NewRecorder()
+	router().ServeHTTP(w, r)
+
+	if w.Code != 201 {
+		t.Fatalf("Expected 201, got %d", w.Code)
+	}
+	if record := findIdempotencyRecord(user, "abc"); record != nil {
+		t.Errorf("Expected the API key response not to be stored")
+	}
+}
+
+func TestIdempotencyAbandonedKeyIsReclaimed(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	if claimIdempotencyKey(user, "abc", "crashed") == nil {
+		t.Fatalf("Expected the key to be claimed")
+	}
+
+	if w := idempotentNoteRequest(user.AuthToken, "abc", "title=Once&body=only"); w.Code != 409 {
+		t.Errorf("Expected a key in flight to be refused, got %d", w.Code)
+	}
+
+	_, err := db.Exec("UPDATE idempotency_keys SET created_at = DATE_SUB(created_at, INTERVAL 10 MINUTE)")
+	checkErr(err, "age idempotency key")
+
+	if w := idempotentNoteRequest(user.AuthToken, "abc", "title=Once&body=only"); w.Code != 201 {
+		t.Errorf("Expected an abandoned key to be reclaimed, got %d", w.Code)
+	}
+}
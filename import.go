@@ -0,0 +1,513 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Import formats
+const (
+	importKeep       = "keep"
+	importENEX       = "enex"
+	importSimplenote = "simplenote"
+	importMarkdown   = "markdown"
+)
+
+// Limits protecting the notes table and the server while importing
+const (
+	maxNoteTitleLength = 255
+	maxNoteBodyBytes   = 65535
+	maxImportNotes     = 5000
+)
+
+// Import item outcomes
+const (
+	importImported = "imported"
+	importSkipped  = "skipped"
+	importFailed   = "failed"
+)
+
+// importItem is one note read from an export. Skip or Err explain why it
+// won't be imported.
+type importItem struct {
+	Source    string
+	Title     string
+	Body      string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	Tags      []string
+	Skip      string
+	Err       error
+}
+
+// ImportResult reports what happened to one item of an import
+type ImportResult struct {
+	Source  string `json:"source"`
+	Status  string `json:"status"`
+	NoteID  int    `json:"note_id,omitempty"`
+	Title   string `json:"title,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// ImportReport totals the results of an import
+type ImportReport struct {
+	Format   string         `json:"format"`
+	Imported int            `json:"imported"`
+	Skipped  int            `json:"skipped"`
+	Failed   int            `json:"failed"`
+	Items    []ImportResult `json:"items"`
+}
+
+var errUnknownImportFormat = errors.New("unknown import format")
+
+// detectImportFormat guesses the format of an uploaded export
+func detectImportFormat(data []byte) string {
+	if bytes.HasPrefix(data, []byte("PK\x03\x04")) {
+		archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return ""
+		}
+		for _, f := range archive.File {
+			if strings.Contains(f.Name, "Keep/") && strings.HasSuffix(f.Name, ".json") {
+				return importKeep
+			}
+		}
+		return importMarkdown
+	}
+
+	trimmed := bytes.TrimSpace(data)
+	if bytes.HasPrefix(trimmed, []byte("<")) && bytes.Contains(trimmed, []byte("<en-export")) {
+		return importENEX
+	}
+	if bytes.HasPrefix(trimmed, []byte("{")) && bytes.Contains(trimmed, []byte("\"activeNotes\"")) {
+		return importSimplenote
+	}
+	return ""
+}
+
+// parseImport reads the notes out of an export in format
+func parseImport(format string, data []byte) ([]importItem, error) {
+	switch format {
+	case importKeep:
+		return parseKeepImport(data)
+	case importENEX:
+		return parseENEXImport(data)
+	case importSimplenote:
+		return parseSimplenoteImport(data)
+	case importMarkdown:
+		return parseMarkdownImport(data)
+	}
+	return nil, errUnknownImportFormat
+}
+
+// importNotes creates a note for every importable item and reports on each
+func importNotes(user *User, format string, items []importItem) *ImportReport {
+	report := &ImportReport{Format: format, Items: []ImportResult{}}
+
+	for i, item := range items {
+		result := ImportResult{Source: item.Source, Title: item.Title}
+
+		switch {
+		case item.Err != nil:
+			result.Status, result.Message = importFailed, item.Err.Error()
+		case len(item.Skip) > 0:
+			result.Status, result.Message = importSkipped, item.Skip
+		case i >= maxImportNotes:
+			result.Status, result.Message = importSkipped, "import limit reached"
+		default:
+			result = importNote(user, item)
+		}
+
+		switch result.Status {
+		case importImported:
+			report.Imported++
+		case importSkipped:
+			report.Skipped++
+		default:
+			report.Failed++
+		}
+		report.Items = append(report.Items, result)
+	}
+	return report
+}
+
+// importNote validates and stores a single item
+func importNote(user *User, item importItem) ImportResult {
+	result := ImportResult{Source: item.Source}
+
+	body := strings.TrimSpace(item.Body)
+	title := strings.TrimSpace(item.Title)
+	if len(title) == 0 {
+		title = firstLine(body)
+	}
+	title = truncateRunes(title, maxNoteTitleLength)
+	result.Title = title
+
+	if len(title) == 0 && len(body) == 0 {
+		result.Status, result.Message = importSkipped, "note is empty"
+		return result
+	}
+	if !utf8.ValidString(title) || !utf8.ValidString(body) {
+		result.Status, result.Message = importFailed, "note is not valid UTF-8"
+		return result
+	}
+	if len(body) > maxNoteBodyBytes {
+		result.Status, result.Message = importFailed, "body is too long"
+		return result
+	}
+
+	now := time.Now().UTC()
+	createdAt, updatedAt := item.CreatedAt, item.UpdatedAt
+	if createdAt.IsZero() {
+		createdAt = now
+	}
+	if updatedAt.IsZero() {
+		updatedAt = createdAt
+	}
+
+	note := createNoteAt(user, title, body, createdAt, updatedAt)
+	result.Status, result.NoteID = importImported, note.ID
+	if len(item.Tags) > 0 {
+		result.Message = "tags are not supported: " + strings.Join(item.Tags, ", ")
+	}
+	return result
+}
+
+func firstLine(text string) string {
+	line := strings.TrimSpace(strings.SplitN(text, "\n", 2)[0])
+	return strings.TrimSpace(strings.TrimLeft(line, "#"))
+}
+
+func truncateRunes(s string, max int) string {
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	return string([]rune(s)[:max])
+}
+
+// readZipFile reads an archive entry, refusing entries too large to be a note
+func readZipFile(f *zip.File) (string, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(io.LimitReader(rc, 4*maxNoteBodyBytes+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > 4*maxNoteBodyBytes {
+		return "", errors.New("file is too large")
+	}
+	return string(data), nil
+}
+
+// keepNote is a note in a Google Keep Takeout archive
+type keepNote struct {
+	Title                   string `json:"title"`
+	TextContent             string `json:"textContent"`
+	IsTrashed               bool   `json:"isTrashed"`
+	CreatedTimestampUsec    int64  `json:"createdTimestampUsec"`
+	UserEditedTimestampUsec int64  `json:"userEditedTimestampUsec"`
+	ListContent             []struct {
+		Text      string `json:"text"`
+		IsChecked bool   `json:"isChecked"`
+	} `json:"listContent"`
+	Labels []struct {
+		Name string `json:"name"`
+	} `json:"labels"`
+}
+
+func parseKeepImport(data []byte) ([]importItem, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	var items []importItem
+	for _, f := range archive.File {
+		if !strings.Contains(f.Name, "Keep/") || !strings.HasSuffix(f.Name, ".json") {
+			continue
+		}
+
+		item := importItem{Source: f.Name}
+		contents, err := readZipFile(f)
+		if err != nil {
+			item.Err = err
+			items = append(items, item)
+			continue
+		}
+
+		var note keepNote
+		if err = json.Unmarshal([]byte(contents), &note); err != nil {
+			item.Err = errors.New("note is not valid JSON")
+			items = append(items, item)
+			continue
+		}
+
+		item.Title = note.Title
+		item.Body = note.TextContent
+		for _, entry := range note.ListContent {
+			mark := " "
+			if entry.IsChecked {
+				mark = "x"
+			}
+			item.Body += fmt.Sprintf("- [%s] %s\n", mark, entry.Text)
+		}
+		if note.CreatedTimestampUsec > 0 {
+			item.CreatedAt = time.UnixMicro(note.CreatedTimestampUsec).UTC()
+		}
+		if note.UserEditedTimestampUsec > 0 {
+			item.UpdatedAt = time.UnixMicro(note.UserEditedTimestampUsec).UTC()
+		}
+		for _, label := range note.Labels {
+			item.Tags = append(item.Tags, label.Name)
+		}
+		if note.IsTrashed {
+			item.Skip = "note is in the trash"
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// enexNote is a note in an Evernote export
+type enexNote struct {
+	Title   string   `xml:"title"`
+	Content string   `xml:"content"`
+	Created string   `xml:"created"`
+	Updated string   `xml:"updated"`
+	Tags    []string `xml:"tag"`
+}
+
+const enexTimeFormat = "20060102T150405Z"
+
+func parseENEXImport(data []byte) ([]importItem, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Strict = false
+
+	var items []importItem
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil && len(items) == 0 {
+			return nil, err
+		}
+		if err != nil {
+			items = append(items, importItem{Source: fmt.Sprintf("note %d", len(items)+1), Err: errors.New("export is not valid XML")})
+			return items, nil
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "note" {
+			continue
+		}
+
+		item := importItem{Source: fmt.Sprintf("note %d", len(items)+1)}
+		var note enexNote
+		if err = decoder.DecodeElement(&note, &start); err != nil {
+			item.Err = errors.New("note is not valid XML")
+			items = append(items, item)
+			return items, nil
+		}
+
+		item.Title = note.Title
+		item.Tags = note.Tags
+		item.Body, item.Err = enmlToText(note.Content)
+		item.CreatedAt, _ = time.Parse(enexTimeFormat, note.Created)
+		item.UpdatedAt, _ = time.Parse(enexTimeFormat, note.Updated)
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// enmlToText flattens Evernote's XHTML note content to plain text, keeping
+// line breaks and checkboxes
+func enmlToText(content string) (string, error) {
+	decoder := xml.NewDecoder(strings.NewReader(content))
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+
+	var b strings.Builder
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", errors.New("note content is not valid ENML")
+		}
+
+		switch t := token.(type) {
+		case xml.CharData:
+			b.Write(t)
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "br":
+				b.WriteString("\n")
+			case "li":
+				b.WriteString("- ")
+			case "en-todo":
+				checked := false
+				for _, attr := range t.Attr {
+					if attr.Name.Local == "checked" && attr.Value == "true" {
+						checked = true
+					}
+				}
+				if checked {
+					b.WriteString("[x] ")
+				} else {
+					b.WriteString("[ ] ")
+				}
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "div", "p", "li", "h1", "h2", "h3", "h4", "h5", "h6", "tr":
+				b.WriteString("\n")
+			}
+		}
+	}
+	// Evernote pads text with non-breaking spaces
+	return strings.TrimSpace(strings.ReplaceAll(b.String(), "\u00a0", " ")), nil
+}
+
+// simplenoteNote is a note in a Simplenote JSON export. The first line of
+// the content is the title.
+type simplenoteNote struct {
+	ID           string   `json:"id"`
+	Content      string   `json:"content"`
+	CreationDate string   `json:"creationDate"`
+	LastModified string   `json:"lastModified"`
+	Tags         []string `json:"tags"`
+}
+
+type simplenoteExport struct {
+	ActiveNotes  []simplenoteNote `json:"activeNotes"`
+	TrashedNotes []simplenoteNote `json:"trashedNotes"`
+}
+
+func parseSimplenoteImport(data []byte) ([]importItem, error) {
+	var export simplenoteExport
+	if err := json.Unmarshal(data, &export); err != nil {
+		return nil, err
+	}
+
+	var items []importItem
+	add := func(note simplenoteNote, skip string) {
+		parts := strings.SplitN(strings.TrimLeft(note.Content, "\r\n"), "\n", 2)
+		item := importItem{Source: note.ID, Title: parts[0], Tags: note.Tags, Skip: skip}
+		if len(parts) > 1 {
+			item.Body = parts[1]
+		}
+		item.CreatedAt, _ = time.Parse(time.RFC3339, note.CreationDate)
+		item.UpdatedAt, _ = time.Parse(time.RFC3339, note.LastModified)
+		items = append(items, item)
+	}
+
+	for _, note := range export.ActiveNotes {
+		add(note, "")
+	}
+	for _, note := range export.TrashedNotes {
+		add(note, "note is in the trash")
+	}
+	return items, nil
+}
+
+// parseMarkdownImport reads a zip of Markdown or text files, one note each.
+// Front matter as written by exports supplies the title and timestamps.
+func parseMarkdownImport(data []byte) ([]importItem, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	var items []importItem
+	for _, f := range archive.File {
+		name := path.Base(f.Name)
+		if f.FileInfo().IsDir() || strings.HasPrefix(name, ".") || strings.HasPrefix(f.Name, "__MACOSX/") {
+			continue
+		}
+
+		item := importItem{Source: f.Name}
+		switch strings.ToLower(path.Ext(name)) {
+		case ".md", ".markdown", ".txt":
+		default:
+			item.Skip = "file is not Markdown"
+			items = append(items, item)
+			continue
+		}
+
+		contents, err := readZipFile(f)
+		if err != nil {
+			item.Err = err
+			items = append(items, item)
+			continue
+		}
+
+		frontMatter, body := splitFrontMatter(contents)
+		item.Body = body
+		item.Title = frontMatterString(frontMatter["title"])
+		item.CreatedAt, _ = time.Parse(time.RFC3339, frontMatter["created_at"])
+		item.UpdatedAt, _ = time.Parse(time.RFC3339, frontMatter["updated_at"])
+		if len(item.Title) == 0 && !strings.HasPrefix(strings.TrimSpace(body), "#") {
+			item.Title = strings.TrimSuffix(name, path.Ext(name))
+		}
+		if item.UpdatedAt.IsZero() && !f.Modified.IsZero() {
+			item.UpdatedAt = f.Modified.UTC()
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// splitFrontMatter separates top level "key: value" pairs of a YAML front
+// matter block from the rest of a Markdown file
+func splitFrontMatter(contents string) (map[string]string, string) {
+	values := map[string]string{}
+	contents = strings.ReplaceAll(contents, "\r\n", "\n")
+	if !strings.HasPrefix(contents, "---\n") {
+		return values, contents
+	}
+
+	end := strings.Index(contents[4:], "\n---\n")
+	if end < 0 {
+		return values, contents
+	}
+
+	for _, line := range strings.Split(contents[4:4+end], "\n") {
+		if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "-") {
+			continue
+		}
+		if key, value, ok := strings.Cut(line, ":"); ok {
+			values[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	return values, contents[4+end+5:]
+}
+
+// frontMatterString unquotes a scalar written as a JSON or single quoted string
+func frontMatterString(value string) string {
+	if strings.HasPrefix(value, "\"") {
+		var s string
+		if json.Unmarshal([]byte(value), &s) == nil {
+			return s
+		}
+	}
+	if len(value) >= 2 && strings.HasPrefix(value, "'") && strings.HasSuffix(value, "'") {
+		return strings.ReplaceAll(value[1:len(value)-1], "''", "'")
+	}
+	return value
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// defaultImportMaxBytes caps uploads unless GRAYNOTE_IMPORT_MAX_BYTES is set
+const defaultImportMaxBytes = 32 << 20
+
+func importMaxBytes() int64 {
+	if n, err := strconv.ParseInt(os.Getenv("GRAYNOTE_IMPORT_MAX_BYTES"), 10, 64); err == nil && n > 0 {
+		return n
+	}
+	return defaultImportMaxBytes
+}
+
+// noteImportHandler creates notes from another app's export uploaded as the
+// multipart "file" field. The format is detected unless "format" is given.
+func noteImportHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Authenticate
+	user := apiAuthenticateUser(r)
+	if user == nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if !apiRequireScope(w, r, user, scopeNotesWrite) {
+		return
+	}
+
+	// Keys restricted to particular notes can't add new ones
+	if user.APIKey != nil && user.APIKey.Restricted() {
+		apiErrorHandler(w, r, http.StatusForbidden, []APIError{{Field: "error", Message: "note_not_permitted"}})
+		return
+	}
+
+	if !apiRequireVerified(w, r, user, actionCreateNotes) {
+		return
+	}
+
+	maxBytes := importMaxBytes()
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes+1<<20)
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		apiErrorHandler(w, r, http.StatusBadRequest, []APIError{{Field: "file", Message: "is required"}})
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		apiErrorHandler(w, r, http.StatusBadRequest, []APIError{{Field: "file", Message: "is required"}})
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxBytes+1))
+	checkErr(err, "read import")
+	if int64(len(data)) > maxBytes {
+		apiErrorHandler(w, r, http.StatusRequestEntityTooLarge, []APIError{{Field: "file", Message: "is too large"}})
+		return
+	}
+
+	format := r.FormValue("format")
+	if len(format) == 0 {
+		format = detectImportFormat(data)
+	}
+
+	items, err := parseImport(format, data)
+	if err == errUnknownImportFormat {
+		apiErrorHandler(w, r, http.StatusBadRequest, []APIError{{Field: "format", Message: "is not supported"}})
+		return
+	}
+	if err != nil && len(items) == 0 {
+		apiErrorHandler(w, r, http.StatusBadRequest, []APIError{{Field: "file", Message: "is invalid"}})
+		return
+	}
+
+	report := importNotes(user, format, items)
+
+	responseJSON, _ := json.Marshal(report)
+	w.Write(responseJSON)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func importRequest(token string, filename string, data []byte) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("file", filename)
+	part.Write(data)
+	form.Close()
+
+	r, _ := http.NewRequest("POST", "/notes/import", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	r.Header.Set("X-Auth-Token", token)
+	w := httptest.NewRecorder()
+	router().ServeHTTP(w, r)
+	return w
+}
+
+func TestNoteImportHandler(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	data := []byte(`{"activeNotes":[
+		{"id":"a","content":"First\nHello","lastModified":"2019-05-01T10:00:00Z","tags":["work"]},
+		{"id":"b","content":"  "},
+		{"id":"c","content":"Big\n` + strings.Repeat("x", maxNoteBodyBytes+1) + `"}]}`)
+
+	w := importRequest(user.AuthToken, "notes.json", data)
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var report ImportReport
+	json.Unmarshal(w.Body.Bytes(), &report)
+	if report.Format != importSimplenote || report.Imported != 1 || report.Skipped != 1 || report.Failed != 1 {
+		t.Fatalf("Unexpected report %s", w.Body.String())
+	}
+
+	imported := report.Items[0]
+	if imported.Status != importImported || !strings.Contains(imported.Message, "work") {
+		t.Errorf("Expected unsupported tags to be reported, got %+v", imported)
+	}
+
+	note := findNoteByID(int64(imported.NoteID))
+	if note == nil || note.UserID != user.ID || note.Title != "First" || note.Body != "Hello" {
+		t.Fatalf("Expected note to be imported")
+	}
+	if note.UpdatedAt == nil || note.UpdatedAt.Year() != 2019 {
+		t.Errorf("Expected timestamp to be preserved, got %v", note.UpdatedAt)
+	}
+}
+
+func TestNoteImportHandlerUnknownFormat(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+
+	w := importRequest(user.AuthToken, "notes.bin", []byte("not an export"))
+
+	if w.Code != 400 {
+		t.Errorf("Expected 400, got %d", w.Code)
+	}
+	expectedBody := "{\"format\":\"is not supported\"}"
+	if b := w.Body.String(); b != expectedBody {
+		t.Errorf("Expected %q, got %q", expectedBody, b)
+	}
+}
+
+func TestNoteImportHandlerRequiresWriteScope(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	_, plain := createAPIKey(user, "reader", []string{scopeNotesRead}, nil, nil)
+
+	w := importRequest(plain, "notes.json", []byte(`{"activeNotes":[]}`))
+
+	if w.Code != 403 {
+		t.Errorf("Expected 403, got %d", w.Code)
+	}
+}
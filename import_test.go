@@ -0,0 +1,134 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"testing"
+	"time"
+)
+
+func testZip(files map[string]string) []byte {
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for name, contents := range files {
+		w, _ := archive.Create(name)
+		w.Write([]byte(contents))
+	}
+	archive.Close()
+	return buf.Bytes()
+}
+
+func TestDetectImportFormat(t *testing.T) {
+	cases := map[string][]byte{
+		importKeep:       testZip(map[string]string{"Takeout/Keep/a.json": "{}"}),
+		importMarkdown:   testZip(map[string]string{"notes/a.md": "# A"}),
+		importENEX:       []byte("<?xml version=\"1.0\"?>\n<en-export><note></note></en-export>"),
+		importSimplenote: []byte("{\"activeNotes\": []}"),
+		"":               []byte("hello"),
+	}
+	for expected, data := range cases {
+		if format := detectImportFormat(data); format != expected {
+			t.Errorf("Expected %q, got %q", expected, format)
+		}
+	}
+}
+
+func TestParseKeepImport(t *testing.T) {
+	data := testZip(map[string]string{
+		"Takeout/Keep/list.json": `{"title":"Groceries","textContent":"","createdTimestampUsec":1600000000000000,
+			"listContent":[{"text":"milk","isChecked":true},{"text":"eggs","isChecked":false}],"labels":[{"name":"home"}]}`,
+		"Takeout/Keep/old.json":  `{"title":"Old","textContent":"gone","isTrashed":true}`,
+		"Takeout/Keep/list.html": "<html></html>",
+	})
+
+	items, err := parseKeepImport(data)
+	if err != nil || len(items) != 2 {
+		t.Fatalf("Expected 2 items, got %d (%v)", len(items), err)
+	}
+
+	for _, item := range items {
+		switch item.Title {
+		case "Groceries":
+			if item.Body != "- [x] milk\n- [ ] eggs\n" || !item.CreatedAt.Equal(time.Unix(1600000000, 0)) || item.Tags[0] != "home" {
+				t.Errorf("Unexpected list item %+v", item)
+			}
+		case "Old":
+			if len(item.Skip) == 0 {
+				t.Errorf("Expected trashed note to be skipped")
+			}
+		}
+	}
+}
+
+func TestParseENEXImport(t *testing.T) {
+	data := []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE en-export SYSTEM "http://xml.evernote.com/pub/evernote-export3.dtd">
+<en-export>
+<note><title>Trip</title><content><![CDATA[<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE en-note SYSTEM "http://xml.evernote.com/pub/enml2.dtd">
+<en-note><div>Pack&nbsp;bags</div><div><en-todo checked="true"/>Passport</div></en-note>]]></content>
+<created>20200102T030405Z</created><updated>20200103T030405Z</updated><tag>travel</tag></note>
+</en-export>`)
+
+	items, err := parseENEXImport(data)
+	if err != nil || len(items) != 1 {
+		t.Fatalf("Expected 1 item, got %d (%v)", len(items), err)
+	}
+
+	item := items[0]
+	if item.Title != "Trip" || item.Body != "Pack bags\n[x] Passport" {
+		t.Errorf("Unexpected note %q %q", item.Title, item.Body)
+	}
+	if !item.CreatedAt.Equal(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)) || len(item.Tags) != 1 {
+		t.Errorf("Expected timestamps and tags, got %+v", item)
+	}
+}
+
+func TestParseSimplenoteImport(t *testing.T) {
+	data := []byte(`{"activeNotes":[{"id":"a1","content":"Title line\nBody line","creationDate":"2019-05-01T10:00:00.000Z"}],
+		"trashedNotes":[{"id":"b2","content":"Trashed"}]}`)
+
+	items, err := parseSimplenoteImport(data)
+	if err != nil || len(items) != 2 {
+		t.Fatalf("Expected 2 items, got %d (%v)", len(items), err)
+	}
+	if items[0].Title != "Title line" || items[0].Body != "Body line" || items[0].CreatedAt.IsZero() {
+		t.Errorf("Unexpected note %+v", items[0])
+	}
+	if len(items[1].Skip) == 0 {
+		t.Errorf("Expected trashed note to be skipped")
+	}
+}
+
+func TestParseMarkdownImportRoundTrip(t *testing.T) {
+	created := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	note := &Note{ID: 1, Title: "Quoted \"title\"", Body: "Body text", CreatedAt: &created, UpdatedAt: &created}
+
+	data := testZip(map[string]string{
+		exportNoteName(note): noteMarkdown(note, nil),
+		"plain.txt":          "No front matter",
+		"image.png":          "binary",
+	})
+
+	items, err := parseMarkdownImport(data)
+	if err != nil || len(items) != 3 {
+		t.Fatalf("Expected 3 items, got %d (%v)", len(items), err)
+	}
+
+	for _, item := range items {
+		switch item.Source {
+		case exportNoteName(note):
+			if item.Title != note.Title || item.Body != "\nBody text\n" || !item.CreatedAt.Equal(created) {
+				t.Errorf("Expected exported note to round trip, got %+v", item)
+			}
+		case "plain.txt":
+			if item.Title != "plain" {
+				t.Errorf("Expected title from file name, got %q", item.Title)
+			}
+		case "image.png":
+			if len(item.Skip) == 0 {
+				t.Errorf("Expected non Markdown file to be skipped")
+			}
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mailer delivers outgoing email
+type Mailer interface {
+	Send(to string, subject string, body string) error
+}
+
+// SMTPMailer sends mail through an SMTP relay
+type SMTPMailer struct {
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+// Send delivers a plain text message
+func (m SMTPMailer) Send(to string, subject string, body string) error {
+	var auth smtp.Auth
+	if len(m.Username) > 0 {
+		host, _, _ := net.SplitHostPort(m.Addr)
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+
+	return smtp.SendMail(m.Addr, auth, m.From, []string{to}, formatMessage(m.From, to, subject, body))
+}
+
+// LogMailer writes messages to W instead of sending them, for local
+// development and tests
+type LogMailer struct {
+	W io.Writer
+
+	mu sync.Mutex
+}
+
+// Send writes the message to the log
+func (m *LogMailer) Send(to string, subject string, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, err := m.W.Write(formatMessage("graynote", to, subject, body))
+	return err
+}
+
+var mailer = mailerSetup()
+
+// mailerSetup picks SMTP delivery when GRAYNOTE_SMTP_ADDR is set, otherwise
+// appends messages to GRAYNOTE_MAIL_FILE or stdout
+func mailerSetup() Mailer {
+	if addr := os.Getenv("GRAYNOTE_SMTP_ADDR"); len(addr) > 0 {
+		return SMTPMailer{
+			Addr:     addr,
+			From:     os.Getenv("GRAYNOTE_SMTP_FROM"),
+			Username: os.Getenv("GRAYNOTE_SMTP_USER"),
+			Password: os.Getenv("GRAYNOTE_SMTP_PASS"),
+		}
+	}
+
+	if path := os.Getenv("GRAYNOTE_MAIL_FILE"); len(path) > 0 {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		checkErr(err, "open mail file")
+		return &LogMailer{W: f}
+	}
+
+	return &LogMailer{W: os.Stdout}
+}
+
+// headerReplacer strips line breaks that could inject extra headers
+var headerReplacer = strings.NewReplacer("\r", "", "\n", "")
+
+func formatMessage(from string, to string, subject string, body string) []byte {
+	headers := []string{
+		"From: " + headerReplacer.Replace(from),
+		"To: " + headerReplacer.Replace(to),
+		"Subject: " + headerReplacer.Replace(subject),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"Content-Type: text/plain; charset=utf-8",
+	}
+	return []byte(fmt.Sprintf("%s\r\n\r\n%s\r\n", strings.Join(headers, "\r\n"), body))
+}
+
+// appURL builds a link into the client application
+func appURL(path string) string {
+	base := os.Getenv("GRAYNOTE_APP_URL")
+	if len(base) == 0 {
+		base = "http://localhost:8181"
+	}
+	return strings.TrimRight(base, "/") + path
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"html"
+	"html/template"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// renderMarkdown renders the common subset of Markdown notes are written in:
+// ATX headings, paragraphs, block quotes, flat lists, fenced code blocks,
+// rules, code spans, emphasis and links. Raw HTML isn't supported; the
+// source is escaped before any markup is added, so the output only ever
+// contains the tags produced here. Links are limited to http, https and
+// mailto.
+func renderMarkdown(source string) template.HTML {
+	lines := strings.Split(strings.Replace(source, "\r\n", "\n", -1), "\n")
+
+	var out strings.Builder
+	var paragraph []string
+	var listTag string
+
+	flushParagraph := func() {
+		if len(paragraph) > 0 {
+			out.WriteString("<p>" + renderMarkdownInline(strings.Join(paragraph, "\n")) + "</p>\n")
+			paragraph = nil
+		}
+	}
+	closeList := func() {
+		if len(listTag) > 0 {
+			out.WriteString("</" + listTag + ">\n")
+			listTag = ""
+		}
+	}
+	openList := func(tag string) {
+		flushParagraph()
+		if listTag != tag {
+			closeList()
+			out.WriteString("<" + tag + ">\n")
+			listTag = tag
+		}
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+
+		switch {
+		case strings.HasPrefix(trimmed, "```"):
+			flushParagraph()
+			closeList()
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), "```"); i++ {
+				code = append(code, lines[i])
+			}
+			out.WriteString("<pre><code>" + html.EscapeString(strings.Join(code, "\n")) + "</code></pre>\n")
+
+		case len(trimmed) == 0:
+			flushParagraph()
+			closeList()
+
+		case markdownHeading.MatchString(trimmed):
+			flushParagraph()
+			closeList()
+			match := markdownHeading.FindStringSubmatch(trimmed)
+			tag := "h" + strconv.Itoa(len(match[1]))
+			out.WriteString("<" + tag + ">" + renderMarkdownInline(match[2]) + "</" + tag + ">\n")
+
+		case markdownRule.MatchString(trimmed):
+			flushParagraph()
+			closeList()
+			out.WriteString("<hr>\n")
+
+		case strings.HasPrefix(trimmed, ">"):
+			flushParagraph()
+			closeList()
+			var quote []string
+			for ; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), ">"); i++ {
+				quote = append(quote, strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(lines[i]), ">"), " "))
+			}
+			i--
+			out.WriteString("<blockquote>\n" + string(renderMarkdown(strings.Join(quote, "\n"))) + "</blockquote>\n")
+
+		case markdownBullet.MatchString(trimmed):
+			openList("ul")
+			out.WriteString("<li>" + renderMarkdownInline(markdownBullet.FindStringSubmatch(trimmed)[1]) + "</li>\n")
+
+		case markdownNumbered.MatchString(trimmed):
+			openList("ol")
+			out.WriteString("<li>" + renderMarkdownInline(markdownNumbered.FindStringSubmatch(trimmed)[1]) + "</li>\n")
+
+		default:
+			closeList()
+			paragraph = append(paragraph, trimmed)
+		}
+	}
+	flushParagraph()
+	closeList()
+
+	return template.HTML(out.String())
+}
+
+var (
+	markdownHeading  = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*$`)
+	markdownRule     = regexp.MustCompile(`^([-*_])(\s*([-*_])){2,}$`)
+	markdownBullet   = regexp.MustCompile(`^[-*+]\s+(.*)$`)
+	markdownNumbered = regexp.MustCompile(`^\d+[.)]\s+(.*)$`)
+
+	markdownCode   = regexp.MustCompile("`([^`]+)`")
+	markdownLink   = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+	markdownStrong = regexp.MustCompile(`\*\*([^*]+)\*\*|__([^_]+)__`)
+	markdownEm     = regexp.MustCompile(`\*([^*\s][^*]*)\*|(^|[^\w])_([^_\s][^_]*)_`)
+	markdownHold   = regexp.MustCompile("\x00(\\d+)\x00")
+)
+
+// renderMarkdownInline renders code spans, links and emphasis in text.
+// Code spans and links are set aside while emphasis is applied so that
+// markers inside them, such as underscores in a URL, are left alone.
+func renderMarkdownInline(text string) string {
+	text = strings.Replace(text, "\x00", "", -1)
+
+	var held []string
+	hold := func(rendered string) string {
+		held = append(held, rendered)
+		return "\x00" + strconv.Itoa(len(held)-1) + "\x00"
+	}
+
+	text = markdownCode.ReplaceAllStringFunc(text, func(match string) string {
+		return hold("<code>" + html.EscapeString(markdownCode.FindStringSubmatch(match)[1]) + "</code>")
+	})
+	text = markdownLink.ReplaceAllStringFunc(text, func(match string) string {
+		parts := markdownLink.FindStringSubmatch(match)
+		label := renderMarkdownEmphasis(html.EscapeString(parts[1]))
+		if !safeMarkdownURL(parts[2]) {
+			return hold(label)
+		}
+		return hold("<a href=\"" + html.EscapeString(parts[2]) + "\" rel=\"nofollow noopener noreferrer\">" + label + "</a>")
+	})
+
+	// Link labels may hold code spans of their own
+	text = renderMarkdownEmphasis(html.EscapeString(text))
+	for markdownHold.MatchString(text) {
+		text = markdownHold.ReplaceAllStringFunc(text, func(match string) string {
+			index, _ := strconv.Atoi(markdownHold.FindStringSubmatch(match)[1])
+			return held[index]
+		})
+	}
+	return text
+}
+
+// renderMarkdownEmphasis marks up emphasis in already escaped text
+func renderMarkdownEmphasis(escaped string) string {
+	escaped = markdownStrong.ReplaceAllString(escaped, "<strong>$1$2</strong>")
+	return markdownEm.ReplaceAllStringFunc(escaped, func(match string) string {
+		parts := markdownEm.FindStringSubmatch(match)
+		if len(parts[1]) > 0 {
+			return "<em>" + parts[1] + "</em>"
+		}
+		return parts[2] + "<em>" + parts[3] + "</em>"
+	})
+}
+
+// safeMarkdownURL returns if a link target can't run script when followed
+func safeMarkdownURL(target string) bool {
+	u, err := url.Parse(target)
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https", "mailto":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	source := "# Plans\n\nSome **bold** and *soft* text with `a_b` and snake_case.\n\n- one\n- [two](https://example.com/a_b?x=1&y=2)\n\n> quoted\n\n```\n<b>code</b>\n```"
+	expected := "<h1>Plans</h1>\n" +
+		"<p>Some <strong>bold</strong> and <em>soft</em> text with <code>a_b</code> and snake_case.</p>\n" +
+		"<ul>\n<li>one</li>\n<li><a href=\"https://example.com/a_b?x=1&amp;y=2\" rel=\"nofollow noopener noreferrer\">two</a></li>\n</ul>\n" +
+		"<blockquote>\n<p>quoted</p>\n</blockquote>\n" +
+		"<pre><code>&lt;b&gt;code&lt;/b&gt;</code></pre>\n"
+
+	if html := string(renderMarkdown(source)); html != expected {
+		t.Errorf("Expected %q, got %q", expected, html)
+	}
+}
+
+func TestRenderMarkdownSanitizes(t *testing.T) {
+	cases := map[string]string{
+		"<script>alert(1)</script>":             "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>\n",
+		"[click](JavaScript:void)":              "<p>click</p>\n",
+		"[x](https://a.com/\"onmouseover=\"x)":  "<p><a href=\"https://a.com/&#34;onmouseover=&#34;x\" rel=\"nofollow noopener noreferrer\">x</a></p>\n",
+		"<img src=x onerror=alert(1)> **hi**":   "<p>&lt;img src=x onerror=alert(1)&gt; <strong>hi</strong></p>\n",
+		"# <i>title</i>":                        "<h1>&lt;i&gt;title&lt;/i&gt;</h1>\n",
+		"before\x000\x00 after [`a`](http://b)": "<p>before0 after <a href=\"http://b\" rel=\"nofollow noopener noreferrer\"><code>a</code></a></p>\n",
+	}
+	for source, expected := range cases {
+		if html := string(renderMarkdown(source)); html != expected {
+			t.Errorf("Expected %q for %q, got %q", expected, source, html)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var metricsRegistry = prometheus.NewRegistry()
+
+var httpRequestsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "graynote_http_requests_total",
+		Help: "HTTP requests handled, by route template, method and status code.",
+	},
+	[]string{"route", "method", "code"})
+
+var httpRequestDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "graynote_http_request_duration_seconds",
+		Help:    "HTTP request latency, by route template and method.",
+		Buckets: prometheus.DefBuckets,
+	},
+	[]string{"route", "method"})
+
+var authFailuresTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "graynote_auth_failures_total",
+		Help: "Failed request authentications, by reason.",
+	},
+	[]string{"reason"})
+
+var shareAccessTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "graynote_share_access_total",
+		Help: "Notes accessed through a share key, by share permissions.",
+	},
+	[]string{"permissions"})
+
+var legacyShareRouteTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "graynote_legacy_share_route_total",
+		Help: "Share keys used in place of a note ID on /notes instead of /s.",
+	})
+
+func init() {
+	metricsRegistry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		httpRequestsTotal,
+		httpRequestDuration,
+		authFailuresTotal,
+		shareAccessTotal,
+		legacyShareRouteTotal,
+		dbStatsCollector{},
+		newTableCountGauge("graynote_users", "Registered users.", "users"),
+		newTableCountGauge("graynote_notes", "Stored notes.", "notes"),
+		newTableCountGauge("graynote_shares", "Share keys handed out.", "shares"))
+}
+
+// metricsHandler serves the registry in Prometheus text format
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// metricsMiddleware counts and times every request against its route template
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		start := time.Now()
+		sw := &statusResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+
+		httpRequestDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+		httpRequestsTotal.WithLabelValues(route, r.Method, strconv.Itoa(sw.status)).Inc()
+	})
+}
+
+// statusResponseWriter remembers the status code written by a handler
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// dbStatsCollector exports sql.DB connection pool statistics
+type dbStatsCollector struct{}
+
+var (
+	dbMaxOpenDesc      = prometheus.NewDesc("graynote_db_max_open_connections", "Maximum number of open connections to the database.", nil, nil)
+	dbOpenDesc         = prometheus.NewDesc("graynote_db_open_connections", "Established connections, both in use and idle.", nil, nil)
+	dbInUseDesc        = prometheus.NewDesc("graynote_db_in_use_connections", "Connections currently in use.", nil, nil)
+	dbIdleDesc         = prometheus.NewDesc("graynote_db_idle_connections", "Idle connections.", nil, nil)
+	dbWaitCountDesc    = prometheus.NewDesc("graynote_db_wait_count_total", "Connections waited for.", nil, nil)
+	dbWaitDurationDesc = prometheus.NewDesc("graynote_db_wait_duration_seconds_total", "Time blocked waiting for a new connection.", nil, nil)
+)
+
+func (c dbStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- dbMaxOpenDesc
+	ch <- dbOpenDesc
+	ch <- dbInUseDesc
+	ch <- dbIdleDesc
+	ch <- dbWaitCountDesc
+	ch <- dbWaitDurationDesc
+}
+
+func (c dbStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	if db == nil {
+		return
+	}
+
+	stats := db.Stats()
+	ch <- prometheus.MustNewConstMetric(dbMaxOpenDesc, prometheus.GaugeValue, float64(stats.MaxOpenConnections))
+	ch <- prometheus.MustNewConstMetric(dbOpenDesc, prometheus.GaugeValue, float64(stats.OpenConnections))
+	ch <- prometheus.MustNewConstMetric(dbInUseDesc, prometheus.GaugeValue, float64(stats.InUse))
+	ch <- prometheus.MustNewConstMetric(dbIdleDesc, prometheus.GaugeValue, float64(stats.Idle))
+	ch <- prometheus.MustNewConstMetric(dbWaitCountDesc, prometheus.CounterValue, float64(stats.WaitCount))
+	ch <- prometheus.MustNewConstMetric(dbWaitDurationDesc, prometheus.CounterValue, stats.WaitDuration.Seconds())
+}
+
+// newTableCountGauge reports the row count of a table at scrape time
+func newTableCountGauge(name string, help string, table string) prometheus.GaugeFunc {
+	return prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{Name: name, Help: help},
+		func() float64 {
+			if db == nil {
+				return 0
+			}
+
+			var count int64
+			if err := db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count); err != nil {
+				return 0
+			}
+			return float64(count)
+		})
+}
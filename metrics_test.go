@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	createNote(user, "title", "body")
+
+	// Make a request that should be counted
+	r, _ := http.NewRequest("GET", "/notes", nil)
+	r.Header.Add("X-Auth-Token", user.AuthToken)
+	router().ServeHTTP(httptest.NewRecorder(), r)
+
+	r, _ = http.NewRequest("GET", "/metrics", nil)
+	w := httptest.NewRecorder()
+
+	router().ServeHTTP(w, r)
+
+	if w.Code != 200 {
+		t.Errorf("Expected 200, got %d", w.Code)
+	}
+
+	b := w.Body.String()
+	expected := []string{
+		"graynote_http_requests_total{code=\"200\",method=\"GET\",route=\"/notes\"}",
+		"graynote_http_request_duration_seconds_bucket{method=\"GET\",route=\"/notes\"",
+		"graynote_db_open_connections",
+		"graynote_notes 1",
+	}
+	for _, e := range expected {
+		if !strings.Contains(b, e) {
+			t.Errorf("Expected metrics to contain %q", e)
+		}
+	}
+}
+
+func TestMetricsAuthFailures(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	r, _ := http.NewRequest("GET", "/notes", nil)
+	r.Header.Add("X-Auth-Token", "not_a_token")
+	router().ServeHTTP(httptest.NewRecorder(), r)
+
+	r, _ = http.NewRequest("GET", "/metrics", nil)
+	w := httptest.NewRecorder()
+
+	router().ServeHTTP(w, r)
+
+	expected := fmt.Sprintf("graynote_auth_failures_total{reason=%q}", "invalid")
+	if b := w.Body.String(); !strings.Contains(b, expected) {
+		t.Errorf("Expected metrics to contain %q", expected)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// migrations are applied in order, once each, and recorded in schema_migrations.
+// Append new schema changes to the end; never edit or reorder existing entries.
+var migrations = []string{
+	"CREATE TABLE IF NOT EXISTS notes (id integer AUTO_INCREMENT NOT NULL PRIMARY KEY, user_id integer, title varchar(255), body text)",
+	"CREATE TABLE IF NOT EXISTS users (id integer AUTO_INCREMENT NOT NULL PRIMARY KEY, email varchar(255), password_hash varchar(255), auth_token varchar(64))",
+	"CREATE TABLE IF NOT EXISTS shares (id integer AUTO_INCREMENT NOT NULL PRIMARY KEY, auth_key varchar(255), note_id integer, permissions varchar(255))",
+	"CREATE TABLE IF NOT EXISTS password_resets (id integer AUTO_INCREMENT NOT NULL PRIMARY KEY, user_id integer NOT NULL, token_hash varchar(64) NOT NULL, expires_at datetime NOT NULL, used_at datetime NULL)",
+	"ALTER TABLE users ADD COLUMN email_verified_at datetime NULL",
+	// Accounts created before verification existed are trusted as they are
+	"UPDATE users SET email = LOWER(TRIM(email)), email_verified_at = NOW()",
+	"CREATE TABLE IF NOT EXISTS email_verifications (id integer AUTO_INCREMENT NOT NULL PRIMARY KEY, user_id integer NOT NULL, email varchar(255) NOT NULL, token_hash varchar(64) NOT NULL, expires_at datetime NOT NULL, used_at datetime NULL)",
+	"ALTER TABLE users ADD COLUMN totp_secret varchar(64) NOT NULL DEFAULT ''",
+	"ALTER TABLE users ADD COLUMN totp_enabled boolean NOT NULL DEFAULT false",
+	"ALTER TABLE users ADD COLUMN totp_last_step bigint NOT NULL DEFAULT 0",
+	"CREATE TABLE IF NOT EXISTS recovery_codes (id integer AUTO_INCREMENT NOT NULL PRIMARY KEY, user_id integer NOT NULL, code_hash varchar(64) NOT NULL, used_at datetime NULL)",
+	"CREATE TABLE IF NOT EXISTS two_factor_challenges (id integer AUTO_INCREMENT NOT NULL PRIMARY KEY, user_id integer NOT NULL, token_hash varchar(64) NOT NULL, expires_at datetime NOT NULL, used_at datetime NULL)",
+	"CREATE TABLE IF NOT EXISTS oidc_logins (id integer AUTO_INCREMENT NOT NULL PRIMARY KEY, state_hash varchar(64) NOT NULL, nonce varchar(64) NOT NULL, code_verifier varchar(128) NOT NULL, expires_at datetime NOT NULL, used_at datetime NULL)",
+	"CREATE TABLE IF NOT EXISTS user_identities (id integer AUTO_INCREMENT NOT NULL PRIMARY KEY, user_id integer NOT NULL, issuer varchar(255) NOT NULL, subject varchar(255) NOT NULL, created_at datetime NOT NULL, UNIQUE KEY issuer_subject (issuer, subject))",
+	"CREATE TABLE IF NOT EXISTS api_keys (id integer AUTO_INCREMENT NOT NULL PRIMARY KEY, user_id integer NOT NULL, name varchar(255) NOT NULL, key_hash varchar(64) NOT NULL, key_prefix varchar(16) NOT NULL, scopes varchar(255) NOT NULL, note_ids varchar(1024) NOT NULL DEFAULT '', expires_at datetime NULL, last_used_at datetime NULL, created_at datetime NOT NULL, UNIQUE KEY key_hash (key_hash))",
+	"ALTER TABLE users ADD COLUMN deletion_requested_at datetime NULL",
+	"ALTER TABLE email_verifications ADD COLUMN email_change boolean NOT NULL DEFAULT false",
+	"CREATE TABLE IF NOT EXISTS exports (id integer AUTO_INCREMENT NOT NULL PRIMARY KEY, user_id integer NOT NULL, status varchar(16) NOT NULL, file_name varchar(64) NOT NULL, created_at datetime NOT NULL, completed_at datetime NULL, expires_at datetime NULL)",
+	"ALTER TABLE notes ADD COLUMN created_at datetime NULL",
+	"ALTER TABLE notes ADD COLUMN updated_at datetime NULL",
+	"CREATE TABLE IF NOT EXISTS idempotency_keys (id integer AUTO_INCREMENT NOT NULL PRIMARY KEY, user_id integer NOT NULL, idem_key varchar(255) NOT NULL, request_hash varchar(64) NOT NULL, status integer NOT NULL, content_type varchar(255) NOT NULL, location varchar(255) NOT NULL, body mediumblob NOT NULL, created_at datetime NOT NULL, UNIQUE KEY user_key (user_id, idem_key))",
+	"ALTER TABLE notes ADD COLUMN version integer NOT NULL DEFAULT 1",
+	"ALTER TABLE shares ADD COLUMN expires_at datetime NULL",
+	"ALTER TABLE shares ADD COLUMN max_views integer NOT NULL DEFAULT 0",
+	"ALTER TABLE shares ADD COLUMN views integer NOT NULL DEFAULT 0",
+	"ALTER TABLE shares ADD COLUMN password_hash varchar(255) NOT NULL DEFAULT ''",
+	"CREATE TABLE IF NOT EXISTS share_sessions (id integer AUTO_INCREMENT NOT NULL PRIMARY KEY, share_id integer NOT NULL, token_hash varchar(64) NOT NULL, expires_at datetime NOT NULL, created_at datetime NOT NULL, UNIQUE KEY token_hash (token_hash))",
+	"CREATE TABLE IF NOT EXISTS collaborators (id integer AUTO_INCREMENT NOT NULL PRIMARY KEY, note_id integer NOT NULL, user_id integer NULL, email varchar(255) NOT NULL, permissions varchar(255) NOT NULL, created_at datetime NOT NULL, UNIQUE KEY note_email (note_id, email), KEY user_id (user_id))",
+	"ALTER TABLE shares ADD COLUMN label varchar(255) NOT NULL DEFAULT ''",
+	"CREATE TABLE IF NOT EXISTS share_activity (id integer AUTO_INCREMENT NOT NULL PRIMARY KEY, share_id integer NOT NULL, note_id integer NOT NULL, key_prefix varchar(16) NOT NULL, action varchar(32) NOT NULL, status integer NOT NULL, client varchar(64) NOT NULL, ip_hash varchar(64) NULL, version integer NOT NULL, created_at datetime NOT NULL, KEY share_id (share_id), KEY note_id (note_id))",
+	"CREATE TABLE IF NOT EXISTS comments (id integer AUTO_INCREMENT NOT NULL PRIMARY KEY, note_id integer NOT NULL, user_id integer NULL, share_id integer NULL, author_name varchar(255) NOT NULL DEFAULT '', body text NOT NULL, anchor_start integer NULL, anchor_end integer NULL, anchor_quote text NULL, anchor_version integer NULL, resolved_at datetime NULL, created_at datetime NOT NULL, updated_at datetime NOT NULL, KEY note_id (note_id), KEY user_id (user_id))",
+	"ALTER TABLE shares ADD COLUMN suspended tinyint(1) NOT NULL DEFAULT 0",
+}
+
+// schemaTables lists every table created by migrations, dropped when wiping
+var schemaTables = []string{"users", "notes", "shares", "password_resets", "email_verifications", "recovery_codes", "two_factor_challenges", "oidc_logins", "user_identities", "api_keys", "exports", "idempotency_keys", "share_sessions", "collaborators", "share_activity", "comments", "schema_migrations"}
+
+func runMigrations() {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (version integer NOT NULL PRIMARY KEY, applied_at datetime)")
+	checkErr(err, "create table schema_migrations failed")
+
+	current, err := schemaVersion()
+	checkErr(err, "read schema version")
+
+	for i := current; i < len(migrations); i++ {
+		_, err = db.Exec(migrations[i])
+		checkErr(err, fmt.Sprintf("migration %d failed", i+1))
+
+		_, err = db.Exec("INSERT INTO schema_migrations (version, applied_at) VALUES (?, NOW())", i+1)
+		checkErr(err, fmt.Sprintf("record migration %d", i+1))
+	}
+}
+
+// schemaVersion returns the number of migrations applied to the database
+func schemaVersion() (int, error) {
+	var version int
+	err := db.QueryRow("SELECT version FROM schema_migrations ORDER BY version DESC LIMIT 1").Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return version, err
+}
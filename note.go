@@ -3,36 +3,65 @@ package main
 import (
 	"database/sql"
 	"fmt"
+	"time"
 )
 
 //_, err = db.Exec("CREATE TABLE IF NOT EXISTS notes (id integer AUTO_INCREMENT NOT NULL PRIMARY KEY, user_id integer, title varchar(255), body text)")
 
 // Note stores user note
 type Note struct {
-	ID     int
-	UserID int
-	Title  string
-	Body   string
+	ID        int
+	UserID    int
+	Title     string
+	Body      string
+	CreatedAt *time.Time
+	UpdatedAt *time.Time
+	Version   int
+}
+
+// noteColumns lists notes columns in the order noteFromDbRows scans them
+const noteColumns = "id, user_id, title, body, created_at, updated_at, version"
+
+// sqlExecutor is satisfied by both *sql.DB and *sql.Tx, letting note changes
+// run alone or as part of a transaction
+type sqlExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	Prepare(query string) (*sql.Stmt, error)
 }
 
 func createNote(user *User, title string, body string) *Note {
-	stmt, err := db.Prepare("INSERT notes SET user_id=?, title=?, body=?")
+	now := time.Now().UTC()
+	return createNoteAt(user, title, body, now, now)
+}
+
+// createNoteAt creates a note with the given timestamps, as when importing
+func createNoteAt(user *User, title string, body string, createdAt time.Time, updatedAt time.Time) *Note {
+	return createNoteWith(db, user, title, body, createdAt, updatedAt)
+}
+
+func createNoteWith(ex sqlExecutor, user *User, title string, body string, createdAt time.Time, updatedAt time.Time) *Note {
+	stmt, err := ex.Prepare("INSERT notes SET user_id=?, title=?, body=?, created_at=?, updated_at=?")
 	if err != nil {
 		checkErr(err, "prepare create note")
 	} else {
 		defer stmt.Close()
 	}
-	res, err := stmt.Exec(user.ID, title, body)
+	res, err := stmt.Exec(user.ID, title, body, createdAt.UTC(), updatedAt.UTC())
 	checkErr(err, "create note")
 
 	noteID, _ := res.LastInsertId()
-	return findNoteByID(noteID)
+	return findNoteByIDWith(ex, noteID)
 }
 
 func findNoteByID(noteID int64) *Note {
+	return findNoteByIDWith(db, noteID)
+}
+
+func findNoteByIDWith(ex sqlExecutor, noteID int64) *Note {
 	var note *Note
 
-	rows, err := db.Query("SELECT * FROM notes WHERE id=?", noteID)
+	rows, err := ex.Query("SELECT "+noteColumns+" FROM notes WHERE id=?", noteID)
 	if err != nil {
 		checkErr(err, "findNoteByID")
 	} else {
@@ -50,11 +79,11 @@ func findNotesByUser(user *User, query string) []*Note {
 	var rows *sql.Rows
 
 	if len(query) == 0 {
-		rows, err = db.Query("SELECT * FROM notes WHERE user_id=?", user.ID)
+		rows, err = db.Query("SELECT "+noteColumns+" FROM notes WHERE user_id=?", user.ID)
 	} else {
 		queryFmt := fmt.Sprintf("%%%s%%", query)
 		rows, err = db.Query(
-			"SELECT * FROM notes WHERE user_id=? AND (body LIKE ? OR title LIKE ?)",
+			"SELECT "+noteColumns+" FROM notes WHERE user_id=? AND (body LIKE ? OR title LIKE ?)",
 			user.ID,
 			queryFmt,
 			queryFmt)
@@ -75,29 +104,83 @@ func findNotesByUser(user *User, query string) []*Note {
 
 func noteFromDbRows(rows *sql.Rows) *Note {
 	note := new(Note)
-	rows.Scan(&note.ID, &note.UserID, &note.Title, &note.Body)
+	rows.Scan(&note.ID, &note.UserID, &note.Title, &note.Body, &note.CreatedAt, &note.UpdatedAt, &note.Version)
 	return note
 }
 
 // Update a note in the database
 func (n *Note) Update(title string, body string) {
+	n.updateWith(db, title, body)
+}
+
+func (n *Note) updateWith(ex sqlExecutor, title string, body string) {
+	now := time.Now().UTC()
 	n.Title = title
 	n.Body = body
+	n.UpdatedAt = &now
+	n.Version++
 
-	stmt, err := db.Prepare("UPDATE notes SET title=?, body=? WHERE id=?")
+	stmt, err := ex.Prepare("UPDATE notes SET title=?, body=?, updated_at=?, version=version+1 WHERE id=?")
 	if err != nil {
 		checkErr(err, "prepare update note")
 	} else {
 		defer stmt.Close()
 	}
 
-	_, err = stmt.Exec(title, body, n.ID)
+	_, err = stmt.Exec(title, body, now, n.ID)
 	checkErr(err, "exec update note")
 }
 
+// UpdateBody replaces the body only if the note is still at baseVersion. It
+// returns false if another update got there first.
+func (n *Note) UpdateBody(body string, baseVersion int) bool {
+	now := time.Now().UTC()
+
+	stmt, err := db.Prepare("UPDATE notes SET body=?, updated_at=?, version=version+1 WHERE id=? AND version=?")
+	if err != nil {
+		checkErr(err, "prepare update note body")
+	} else {
+		defer stmt.Close()
+	}
+
+	res, err := stmt.Exec(body, now, n.ID, baseVersion)
+	checkErr(err, "exec update note body")
+
+	if affected, _ := res.RowsAffected(); affected != 1 {
+		return false
+	}
+	n.Body = body
+	n.UpdatedAt = &now
+	n.Version = baseVersion + 1
+	return true
+}
+
 // Destroy deletes a Note from the database
 func (n Note) Destroy() {
-	stmt, err := db.Prepare("DELETE FROM notes WHERE id=?")
+	tx, err := db.Begin()
+	checkErr(err, "begin destroy note")
+
+	n.destroyWith(tx)
+
+	checkErr(tx.Commit(), "commit destroy note")
+}
+
+// noteTables lists tables holding rows that belong to a note through a
+// note_id column, removed along with it
+var noteTables = []string{"shares", "collaborators", "comments", "share_activity"}
+
+// destroyWith deletes the note and everything hanging off it, so nothing
+// comes back if the ID is reused
+func (n Note) destroyWith(ex sqlExecutor) {
+	_, err := ex.Exec("DELETE FROM share_sessions WHERE share_id IN (SELECT id FROM shares WHERE note_id=?)", n.ID)
+	checkErr(err, "destroy note share sessions")
+
+	for _, table := range noteTables {
+		_, err = ex.Exec("DELETE FROM "+table+" WHERE note_id=?", n.ID)
+		checkErr(err, "destroy note "+table)
+	}
+
+	stmt, err := ex.Prepare("DELETE FROM notes WHERE id=?")
 	if err != nil {
 		checkErr(err, "destroy prepare")
 	} else {
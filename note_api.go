@@ -21,9 +21,17 @@ type noteSuccessResponse struct {
 	Shares []shareSuccessResponse `json:"shares"`
 }
 
+// visitorNoteSuccessResponse is a note as seen by anyone but its owner,
+// with what they may do instead of its shares
+type visitorNoteSuccessResponse struct {
+	ID          int    `json:"id"`
+	Title       string `json:"title"`
+	Body        string `json:"body"`
+	Permissions string `json:"permissions"`
+}
+
 func noteIndexHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	apiApplyCorsHeaders(w, r)
 
 	// Authenticate
 	user := apiAuthenticateUser(r)
@@ -32,17 +40,25 @@ func noteIndexHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !apiRequireScope(w, r, user, scopeNotesRead) {
+		return
+	}
+
 	err := r.ParseForm()
 	checkErr(err, "parsing form")
 	query := r.FormValue("q")
 
-	notes := findNotesByUser(user, query)
+	var notes []*Note
+	for _, note := range findNotesByUser(user, query) {
+		if user.AllowsNote(note.ID) {
+			notes = append(notes, note)
+		}
+	}
 	w.Write(notesJSON(notes))
 }
 
 func noteCreateHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	apiApplyCorsHeaders(w, r)
 
 	// Authenticate
 	user := apiAuthenticateUser(r)
@@ -51,6 +67,20 @@ func noteCreateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !apiRequireScope(w, r, user, scopeNotesWrite) {
+		return
+	}
+
+	// Keys restricted to particular notes can't add new ones
+	if user.APIKey != nil && user.APIKey.Restricted() {
+		apiErrorHandler(w, r, http.StatusForbidden, []APIError{{Field: "error", Message: "note_not_permitted"}})
+		return
+	}
+
+	if !apiRequireVerified(w, r, user, actionCreateNotes) {
+		return
+	}
+
 	err := r.ParseForm()
 	checkErr(err, "parsing form")
 
@@ -59,18 +89,7 @@ func noteCreateHandler(w http.ResponseWriter, r *http.Request) {
 	err = decoder.Decode(noteParameters, r.PostForm)
 	checkErr(err, "decoding note create")
 
-	var errors []APIError
-
-	// Validate Title
-	if len(noteParameters.Title) == 0 {
-		errors = append(errors, APIError{Field: "title", Message: "is required"})
-	}
-
-	// Validate Body
-	if len(noteParameters.Body) == 0 {
-		errors = append(errors, APIError{Field: "body", Message: "is required"})
-	}
-
+	errors := validateNote(noteParameters.Title, noteParameters.Body)
 	if len(errors) > 0 {
 		apiErrorHandler(w, r, http.StatusBadRequest, errors)
 		return
@@ -80,69 +99,66 @@ func noteCreateHandler(w http.ResponseWriter, r *http.Request) {
 	note := createNote(user, noteParameters.Title, noteParameters.Body)
 
 	// Success message
+	w.Header().Set("ETag", noteETag(note))
 	w.WriteHeader(http.StatusCreated)
 	w.Write(noteJSON(note))
 }
 
+// noteShowHandler serves a note to its owner or a collaborator. Share keys
+// are served by shareNoteShow.
 func noteShowHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	apiApplyCorsHeaders(w, r)
+
+	if key := requestShareKey(w, r); len(key) > 0 {
+		shareNoteShow(w, r, key)
+		return
+	}
 
 	// Authenticate
 	user := apiAuthenticateUser(r)
-
-	// Find the note or share
-	noteIDStr := mux.Vars(r)["id"]
-	noteID, _ := strconv.ParseInt(noteIDStr, 10, 64)
-	note := findNoteByID(noteID)
-	share := findShareByAuthKey(noteIDStr)
-
-	if share != nil {
-		note = findNoteByID(int64(share.NoteID))
-	} else if user == nil {
+	if user == nil {
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
 
-	// Note not found or invalid owner
-	if note == nil || (user != nil && note.UserID != user.ID) {
-		w.WriteHeader(http.StatusNotFound)
+	if !apiRequireScope(w, r, user, scopeNotesRead) {
 		return
 	}
 
-	w.Write(noteJSON(note))
-}
-
-func noteUpdateHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	apiApplyCorsHeaders(w, r)
-
-	// Authenticate
-	user := apiAuthenticateUser(r)
-
-	// Find the note or share
-	noteIDStr := mux.Vars(r)["id"]
-	noteID, _ := strconv.ParseInt(noteIDStr, 10, 64)
+	// Find the note
+	noteID, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
 	note := findNoteByID(noteID)
-	share := findShareByAuthKey(noteIDStr)
 
-	if share != nil {
-		note = findNoteByID(int64(share.NoteID))
-	} else if user == nil {
-		w.WriteHeader(http.StatusForbidden)
+	// Note not found, or neither owned by nor shared with the user
+	var permissions string
+	if note != nil {
+		permissions = NotePermissions(note, user)
+	}
+	if len(permissions) == 0 {
+		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
-	if share != nil && share.Permissions != "readwrite" {
-		w.WriteHeader(http.StatusForbidden)
+	if !apiRequireNote(w, r, user, note.ID) {
 		return
 	}
 
-	// Note not found or invalid owner
-	if note == nil || (user != nil && note.UserID != user.ID) {
-		w.WriteHeader(http.StatusNotFound)
+	w.Header().Set("ETag", noteETag(note))
+	if permissions != noteOwnerPermission {
+		w.Write(collaboratorNoteJSON(note, permissions))
 		return
 	}
+	w.Write(noteJSON(note))
+}
+
+func noteUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	access := apiAuthorizeNoteUpdate(w, r)
+	if access == nil {
+		return
+	}
+	note := access.Note
 
 	err := r.ParseForm()
 	checkErr(err, "parsing form")
@@ -152,31 +168,21 @@ func noteUpdateHandler(w http.ResponseWriter, r *http.Request) {
 	err = decoder.Decode(noteParameters, r.PostForm)
 	checkErr(err, "decoding note create")
 
-	var errors []APIError
-
-	// Validate Title
-	if len(noteParameters.Title) == 0 {
-		errors = append(errors, APIError{Field: "title", Message: "is required"})
-	}
-
-	// Validate Body
-	if len(noteParameters.Body) == 0 {
-		errors = append(errors, APIError{Field: "body", Message: "is required"})
-	}
-
+	errors := validateNote(noteParameters.Title, noteParameters.Body)
 	if len(errors) > 0 {
 		apiErrorHandler(w, r, http.StatusBadRequest, errors)
 		return
 	}
 
 	note.Update(noteParameters.Title, noteParameters.Body)
+	access.RecordShareActivity(r, shareActionUpdate)
 
-	w.Write(noteJSON(note))
+	w.Header().Set("ETag", noteETag(note))
+	w.Write(access.JSON())
 }
 
 func noteDeleteHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	apiApplyCorsHeaders(w, r)
 
 	// Authenticate
 	user := apiAuthenticateUser(r)
@@ -185,6 +191,10 @@ func noteDeleteHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !apiRequireScope(w, r, user, scopeNotesWrite) {
+		return
+	}
+
 	// Find the note
 	noteIDStr := mux.Vars(r)["id"]
 	noteID, _ := strconv.ParseInt(noteIDStr, 10, 64)
@@ -196,16 +206,132 @@ func noteDeleteHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !apiRequireNote(w, r, user, note.ID) {
+		return
+	}
+
 	note.Destroy()
 	w.Write([]byte("{}"))
 }
 
+// noteAccess is how a request reached a note: through Share, as a
+// collaborator, or as its owner when both are empty. Permissions is empty
+// for the owner, who alone sees the note's shares.
+type noteAccess struct {
+	Note        *Note
+	Share       *Share
+	Permissions string
+}
+
+// JSON renders the note for whoever is accessing it
+func (a noteAccess) JSON() []byte {
+	return noteJSONFor(a.Note, a.Permissions)
+}
+
+// RecordShareActivity logs action if the note was reached through a share
+func (a noteAccess) RecordShareActivity(r *http.Request, action string) {
+	if a.Share != nil {
+		recordShareActivity(r, a.Share, action, http.StatusOK, a.Note.Version)
+	}
+}
+
+// apiAuthorizeNoteUpdate finds the note named in the URL if the request may
+// change it, as its owner, a readwrite collaborator or through a readwrite
+// share. Otherwise it writes the error and returns nil.
+func apiAuthorizeNoteUpdate(w http.ResponseWriter, r *http.Request) *noteAccess {
+	if key := requestShareKey(w, r); len(key) > 0 {
+		return apiAuthorizeShareUpdate(w, r, key)
+	}
+
+	// Authenticate
+	user := apiAuthenticateUser(r)
+	if user == nil {
+		w.WriteHeader(http.StatusForbidden)
+		return nil
+	}
+
+	if !apiRequireScope(w, r, user, scopeNotesWrite) {
+		return nil
+	}
+
+	// Find the note
+	noteID, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	note := findNoteByID(noteID)
+
+	// Note not found, or neither owned by nor shared with the user
+	var permissions string
+	if note != nil {
+		permissions = NotePermissions(note, user)
+	}
+	if len(permissions) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+
+	if !permissionAllows(permissions, "readwrite") {
+		w.WriteHeader(http.StatusForbidden)
+		return nil
+	}
+
+	if !apiRequireNote(w, r, user, note.ID) {
+		return nil
+	}
+
+	if permissions == noteOwnerPermission {
+		return &noteAccess{Note: note}
+	}
+	return &noteAccess{Note: note, Permissions: permissions}
+}
+
+// apiOwnedNote finds the note named in the URL for its owner, checking the
+// shares:manage scope. Otherwise it writes the error and returns nil.
+func apiOwnedNote(w http.ResponseWriter, r *http.Request, user *User) *Note {
+	if !apiRequireScope(w, r, user, scopeSharesManage) {
+		return nil
+	}
+
+	noteID, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	note := findNoteByID(noteID)
+
+	// Note not found or invalid owner
+	if note == nil || note.UserID != user.ID {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+
+	if !apiRequireNote(w, r, user, note.ID) {
+		return nil
+	}
+	return note
+}
+
+// validateNote checks the fields every note needs
+func validateNote(title string, body string) []APIError {
+	var errors []APIError
+
+	// Validate Title
+	if len(title) == 0 {
+		errors = append(errors, APIError{Field: "title", Message: "is required"})
+	}
+
+	// Validate Body
+	if len(body) == 0 {
+		errors = append(errors, APIError{Field: "body", Message: "is required"})
+	}
+
+	return errors
+}
+
+// noteETag identifies the version of a note, which is the base_version for
+// a text delta
+func noteETag(note *Note) string {
+	return "\"" + strconv.Itoa(note.Version) + "\""
+}
+
 func noteJSON(note *Note) []byte {
 	var shareResponses []shareSuccessResponse
 	for _, share := range note.Shares() {
-		shareResponses = append(
-			shareResponses,
-			shareSuccessResponse{AuthKey: share.AuthKey, NoteID: share.NoteID, Permissions: share.Permissions})
+		shareResponses = append(shareResponses, shareResponse(share))
 	}
 
 	response := noteSuccessResponse{ID: note.ID, Title: note.Title, Body: note.Body, Shares: shareResponses}
@@ -213,6 +339,23 @@ func noteJSON(note *Note) []byte {
 	return responseJSON
 }
 
+// noteJSONFor renders note for a collaborator with the given permissions, or
+// for its owner if permissions is empty
+func noteJSONFor(note *Note, permissions string) []byte {
+	if len(permissions) > 0 {
+		return collaboratorNoteJSON(note, permissions)
+	}
+	return noteJSON(note)
+}
+
+// collaboratorNoteJSON leaves out the note's shares, which only its owner
+// may see. Share-key visitors get the same view.
+func collaboratorNoteJSON(note *Note, permissions string) []byte {
+	response := visitorNoteSuccessResponse{ID: note.ID, Title: note.Title, Body: note.Body, Permissions: permissions}
+	responseJSON, _ := json.Marshal(response)
+	return responseJSON
+}
+
 func notesJSON(notes []*Note) []byte {
 	var response []noteSuccessResponse
 	for _, note := range notes {
@@ -30,7 +30,7 @@ func TestNoteCreateHandlerSuccess(t *testing.T) {
 	router().ServeHTTP(w, r)
 
 	if w.Code != 201 {
-		t.Errorf("Expected 201, got %q", w.Code)
+		t.Errorf("Expected 201, got %d", w.Code)
 	}
 
 	expectedBody := "{\"id\":1,\"title\":\"My Note!\",\"body\":\"Some exciting things are documented here.\",\"shares\":null}"
@@ -57,7 +57,7 @@ func TestNoteCreateFailMissingParams(t *testing.T) {
 	router().ServeHTTP(w, r)
 
 	if w.Code != 400 {
-		t.Errorf("Expected 400, got %q", w.Code)
+		t.Errorf("Expected 400, got %d", w.Code)
 	}
 
 	expectedBody := "{\"body\":\"is required\",\"title\":\"is required\"}"
@@ -86,7 +86,7 @@ func TestNoteDeleteHandlerSuccess(t *testing.T) {
 	router().ServeHTTP(w, r)
 
 	if w.Code != 200 {
-		t.Errorf("Expected 200, got %q", w.Code)
+		t.Errorf("Expected 200, got %d", w.Code)
 	}
 
 	if findNoteByID(int64(note.ID)) != nil {
@@ -115,7 +115,7 @@ func TestNoteDeleteHandlerFailInvalidUser(t *testing.T) {
 	router().ServeHTTP(w, r)
 
 	if w.Code != 404 {
-		t.Errorf("Expected 404, got %q", w.Code)
+		t.Errorf("Expected 404, got %d", w.Code)
 	}
 
 	if findNoteByID(int64(note.ID)) == nil {
@@ -140,7 +140,7 @@ func TestNoteDeleteHandlerFailNotFound(t *testing.T) {
 	router().ServeHTTP(w, r)
 
 	if w.Code != 404 {
-		t.Errorf("Expected 404, got %q", w.Code)
+		t.Errorf("Expected 404, got %d", w.Code)
 	}
 }
 
@@ -164,7 +164,7 @@ func TestNoteIndexHandler(t *testing.T) {
 	router().ServeHTTP(w, r)
 
 	if w.Code != 200 {
-		t.Errorf("Expected code 200, got %q", w.Code)
+		t.Errorf("Expected code 200, got %d", w.Code)
 	}
 	expectedBody := "[{\"id\":1,\"title\":\"My Note\",\"body\":\"Note Body!\",\"shares\":null},{\"id\":2,\"title\":\"Second Note\",\"body\":\"Second Note Body!\",\"shares\":null}]"
 	if b := w.Body.String(); b != expectedBody {
@@ -192,7 +192,7 @@ func TestNoteShowHandlerSuccess(t *testing.T) {
 	router().ServeHTTP(w, r)
 
 	if w.Code != 200 {
-		t.Errorf("Expected 200, got %q", w.Code)
+		t.Errorf("Expected 200, got %d", w.Code)
 	}
 
 	expectedBody := "{\"id\":1,\"title\":\"My Note\",\"body\":\"Note Body!\",\"shares\":null}"
@@ -221,7 +221,7 @@ func TestNoteShowHandlerSuccessReadShare(t *testing.T) {
 	router().ServeHTTP(w, r)
 
 	if w.Code != 200 {
-		t.Errorf("Expected 200, got %q", w.Code)
+		t.Errorf("Expected 200, got %d", w.Code)
 	}
 }
 
@@ -245,7 +245,7 @@ func TestNoteShowHandlerSuccessFailInvalidShareKey(t *testing.T) {
 	router().ServeHTTP(w, r)
 
 	if w.Code != 404 {
-		t.Errorf("Expected 404, got %q", w.Code)
+		t.Errorf("Expected 404, got %d", w.Code)
 	}
 }
 
@@ -272,7 +272,7 @@ func TestNoteShowHandlerSuccessWithShares(t *testing.T) {
 	router().ServeHTTP(w, r)
 
 	if w.Code != 200 {
-		t.Errorf("Expected 200, got %q", w.Code)
+		t.Errorf("Expected 200, got %d", w.Code)
 	}
 
 	b := w.Body.String()
@@ -299,7 +299,7 @@ func TestNoteShowHandlerFailDoesNotExist(t *testing.T) {
 	router().ServeHTTP(w, r)
 
 	if w.Code != 404 {
-		t.Errorf("Expected 404, got %q", w.Code)
+		t.Errorf("Expected 404, got %d", w.Code)
 	}
 }
 
@@ -324,7 +324,7 @@ func TestNoteShowHandlerFailDifferentOwner(t *testing.T) {
 	router().ServeHTTP(w, r)
 
 	if w.Code != 404 {
-		t.Errorf("Expected 404, got %q", w.Code)
+		t.Errorf("Expected 404, got %d", w.Code)
 	}
 }
 
@@ -353,7 +353,7 @@ func TestNoteUpdateHandlerSuccess(t *testing.T) {
 	router().ServeHTTP(w, r)
 
 	if w.Code != 200 {
-		t.Errorf("Expected 200, got %q", w.Code)
+		t.Errorf("Expected 200, got %d", w.Code)
 	}
 	expectedBody := "{\"id\":1,\"title\":\"Updated Title\",\"body\":\"Updated Body\",\"shares\":null}"
 	if b := w.Body.String(); b != expectedBody {
@@ -391,7 +391,7 @@ func TestNoteUpdateHandlerSuccessShare(t *testing.T) {
 	router().ServeHTTP(w, r)
 
 	if w.Code != 200 {
-		t.Errorf("Expected 200, got %q", w.Code)
+		t.Errorf("Expected 200, got %d", w.Code)
 	}
 }
 
@@ -420,7 +420,7 @@ func TestNoteUpdateHandlerSuccessFailReadOnlyKey(t *testing.T) {
 	router().ServeHTTP(w, r)
 
 	if w.Code != 403 {
-		t.Errorf("Expected 403, got %q", w.Code)
+		t.Errorf("Expected 403, got %d", w.Code)
 	}
 }
 
@@ -449,7 +449,7 @@ func TestNoteUpdateHandlerSuccessFailInvalidShare(t *testing.T) {
 	router().ServeHTTP(w, r)
 
 	if w.Code != 404 {
-		t.Errorf("Expected 404, got %q", w.Code)
+		t.Errorf("Expected 404, got %d", w.Code)
 	}
 }
 
@@ -475,7 +475,7 @@ func TestNoteUpdateHandlerFailMissingParameters(t *testing.T) {
 	router().ServeHTTP(w, r)
 
 	if w.Code != 400 {
-		t.Errorf("Expected 400, got %q", w.Code)
+		t.Errorf("Expected 400, got %d", w.Code)
 	}
 	expectedBody := "{\"body\":\"is required\",\"title\":\"is required\"}"
 	if b := w.Body.String(); b != expectedBody {
@@ -502,7 +502,7 @@ func TestNoteUpdateHandlerFailNotFound(t *testing.T) {
 	router().ServeHTTP(w, r)
 
 	if w.Code != 404 {
-		t.Errorf("Expected 404, got %q", w.Code)
+		t.Errorf("Expected 404, got %d", w.Code)
 	}
 }
 
@@ -532,6 +532,6 @@ func TestNoteUpdateHandlerFailInvalidOwner(t *testing.T) {
 	router().ServeHTTP(w, r)
 
 	if w.Code != 404 {
-		t.Errorf("Expected 404, got %q", w.Code)
+		t.Errorf("Expected 404, got %d", w.Code)
 	}
 }
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Batch modes
+const (
+	batchTransaction = "transaction"
+	batchBestEffort  = "best_effort"
+)
+
+// Limits on a single batch request
+const (
+	maxBatchOperations = 100
+	maxBatchBytes      = 8 << 20
+)
+
+type noteBatchRequest struct {
+	Mode       string               `json:"mode"`
+	Operations []noteBatchOperation `json:"operations"`
+}
+
+type noteBatchOperation struct {
+	Op    string `json:"op"`
+	ID    int    `json:"id"`
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+type noteBatchResult struct {
+	Op     string               `json:"op"`
+	ID     int                  `json:"id,omitempty"`
+	Status int                  `json:"status"`
+	Errors map[string]string    `json:"errors,omitempty"`
+	Note   *noteSuccessResponse `json:"note,omitempty"`
+}
+
+type noteBatchResponse struct {
+	Committed bool              `json:"committed"`
+	Results   []noteBatchResult `json:"results"`
+}
+
+// noteBatchHandler applies a list of create, update and delete operations.
+// By default they run in one transaction and any failure rolls them all
+// back; in best_effort mode each operation stands alone.
+func noteBatchHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Authenticate
+	user := apiAuthenticateUser(r)
+	if user == nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if !apiRequireScope(w, r, user, scopeNotesWrite) {
+		return
+	}
+
+	batch := new(noteBatchRequest)
+	r.Body = http.MaxBytesReader(w, r.Body, maxBatchBytes)
+	if err := json.NewDecoder(r.Body).Decode(batch); err != nil {
+		apiErrorHandler(w, r, http.StatusBadRequest, []APIError{{Field: "operations", Message: "is invalid"}})
+		return
+	}
+
+	var errors []APIError
+
+	// Validate Mode
+	if len(batch.Mode) == 0 {
+		batch.Mode = batchTransaction
+	} else if batch.Mode != batchTransaction && batch.Mode != batchBestEffort {
+		errors = append(errors, APIError{Field: "mode", Message: "is invalid"})
+	}
+
+	// Validate Operations
+	if len(batch.Operations) == 0 {
+		errors = append(errors, APIError{Field: "operations", Message: "is required"})
+	} else if len(batch.Operations) > maxBatchOperations {
+		errors = append(errors, APIError{Field: "operations", Message: "has too many operations"})
+	}
+
+	if len(errors) > 0 {
+		apiErrorHandler(w, r, http.StatusBadRequest, errors)
+		return
+	}
+
+	var response noteBatchResponse
+	if batch.Mode == batchBestEffort {
+		response = runNoteBatchBestEffort(user, batch.Operations)
+	} else {
+		response = runNoteBatchTransaction(user, batch.Operations)
+	}
+
+	responseJSON, _ := json.Marshal(response)
+	w.Write(responseJSON)
+}
+
+func runNoteBatchBestEffort(user *User, operations []noteBatchOperation) noteBatchResponse {
+	response := noteBatchResponse{Committed: true}
+	for _, operation := range operations {
+		response.Results = append(response.Results, applyNoteOperation(db, user, operation))
+	}
+	return response
+}
+
+// runNoteBatchTransaction stops at the first failure, reporting every other
+// operation as 424 Failed Dependency once the transaction is rolled back
+func runNoteBatchTransaction(user *User, operations []noteBatchOperation) noteBatchResponse {
+	tx, err := db.Begin()
+	checkErr(err, "begin note batch")
+
+	response := noteBatchResponse{}
+	failed := -1
+	for i, operation := range operations {
+		result := applyNoteOperation(tx, user, operation)
+		response.Results = append(response.Results, result)
+		if result.Status >= 400 {
+			failed = i
+			break
+		}
+	}
+
+	if failed < 0 {
+		checkErr(tx.Commit(), "commit note batch")
+		response.Committed = true
+		return response
+	}
+
+	checkErr(tx.Rollback(), "rollback note batch")
+	for i, operation := range operations {
+		if i == failed {
+			continue
+		}
+		result := noteBatchResult{Op: operation.Op, ID: operation.ID, Status: http.StatusFailedDependency}
+		if i < len(response.Results) {
+			response.Results[i] = result
+		} else {
+			response.Results = append(response.Results, result)
+		}
+	}
+	return response
+}
+
+// applyNoteOperation runs one operation with the same checks as the single
+// note handlers: scope and verification for creates, ownership and API key
+// note restrictions for updates and deletes. Collaborators with readwrite
+// access may update, as with PUT /notes/{id}.
+func applyNoteOperation(ex sqlExecutor, user *User, operation noteBatchOperation) noteBatchResult {
+	result := noteBatchResult{Op: operation.Op, ID: operation.ID}
+	fail := func(status int, errors []APIError) noteBatchResult {
+		result.Status = status
+		if len(errors) > 0 {
+			result.Errors = map[string]string{}
+			for _, error := range errors {
+				result.Errors[error.Field] = error.Message
+			}
+		}
+		return result
+	}
+
+	switch operation.Op {
+	case "create":
+		if user.APIKey != nil && user.APIKey.Restricted() {
+			return fail(http.StatusForbidden, []APIError{{Field: "error", Message: "note_not_permitted"}})
+		}
+		if !unverifiedPolicy.Allows(user, actionCreateNotes) {
+			return fail(http.StatusForbidden, []APIError{{Field: "email", Message: "is not verified"}})
+		}
+		if errors := validateNote(operation.Title, operation.Body); len(errors) > 0 {
+			return fail(http.StatusBadRequest, errors)
+		}
+
+		now := time.Now().UTC()
+		note := createNoteWith(ex, user, operation.Title, operation.Body, now, now)
+		result.ID, result.Status, result.Note = note.ID, http.StatusCreated, noteBatchNote(note)
+		return result
+
+	case "update", "delete":
+		// Note not found, or neither owned by nor shared with the user
+		note := findNoteByIDWith(ex, int64(operation.ID))
+		var permissions string
+		if note != nil {
+			permissions = NotePermissions(note, user)
+		}
+		if len(permissions) == 0 {
+			return fail(http.StatusNotFound, nil)
+		}
+
+		// Collaborators may update a note they can write, but only its owner
+		// can delete it
+		required := "readwrite"
+		if operation.Op == "delete" {
+			required = noteOwnerPermission
+		}
+		if !permissionAllows(permissions, required) {
+			if operation.Op == "delete" {
+				return fail(http.StatusNotFound, nil)
+			}
+			return fail(http.StatusForbidden, nil)
+		}
+		if !user.AllowsNote(note.ID) {
+			return fail(http.StatusForbidden, []APIError{{Field: "error", Message: "note_not_permitted"}})
+		}
+
+		if operation.Op == "delete" {
+			note.destroyWith(ex)
+			result.Status = http.StatusOK
+			return result
+		}
+
+		if errors := validateNote(operation.Title, operation.Body); len(errors) > 0 {
+			return fail(http.StatusBadRequest, errors)
+		}
+		note.updateWith(ex, operation.Title, operation.Body)
+		result.Status, result.Note = http.StatusOK, noteBatchNote(note)
+		return result
+	}
+
+	return fail(http.StatusBadRequest, []APIError{{Field: "op", Message: "is invalid"}})
+}
+
+func noteBatchNote(note *Note) *noteSuccessResponse {
+	return &noteSuccessResponse{ID: note.ID, Title: note.Title, Body: note.Body}
+}
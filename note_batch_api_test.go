@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func noteBatchRequestJSON(token string, body string) (*httptest.ResponseRecorder, noteBatchResponse) {
+	r, _ := http.NewRequest("POST", "/notes/batch", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("X-Auth-Token", token)
+	w := httptest.NewRecorder()
+	router().ServeHTTP(w, r)
+
+	var response noteBatchResponse
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return w, response
+}
+
+func TestNoteBatchHandlerTransaction(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	updated := createNote(user, "old", "old")
+	deleted := createNote(user, "gone", "gone")
+
+	w, response := noteBatchRequestJSON(user.AuthToken, fmt.Sprintf(`{"operations":[
+		{"op":"create","title":"new","body":"new"},
+		{"op":"update","id":%d,"title":"changed","body":"changed"},
+		{"op":"delete","id":%d}]}`, updated.ID, deleted.ID))
+
+	if w.Code != 200 || !response.Committed || len(response.Results) != 3 {
+		t.Fatalf("Expected a committed batch, got %d: %s", w.Code, w.Body.String())
+	}
+	if response.Results[0].Status != 201 || response.Results[1].Status != 200 || response.Results[2].Status != 200 {
+		t.Errorf("Unexpected results %s", w.Body.String())
+	}
+	if findNoteByID(int64(response.Results[0].ID)) == nil {
+		t.Errorf("Expected note to be created")
+	}
+	if findNoteByID(int64(updated.ID)).Title != "changed" {
+		t.Errorf("Expected note to be updated")
+	}
+	if findNoteByID(int64(deleted.ID)) != nil {
+		t.Errorf("Expected note to be deleted")
+	}
+}
+
+func TestNoteBatchHandlerTransactionRollsBack(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	other := factoryCreateUser("other@site.com")
+	mine := createNote(user, "mine", "mine")
+	theirs := createNote(other, "theirs", "theirs")
+
+	w, response := noteBatchRequestJSON(user.AuthToken, fmt.Sprintf(`{"operations":[
+		{"op":"delete","id":%d},
+		{"op":"delete","id":%d},
+		{"op":"create","title":"new","body":"new"}]}`, mine.ID, theirs.ID))
+
+	if w.Code != 200 || response.Committed {
+		t.Fatalf("Expected the batch to be rolled back, got %s", w.Body.String())
+	}
+	statuses := []int{response.Results[0].Status, response.Results[1].Status, response.Results[2].Status}
+	if statuses[0] != 424 || statuses[1] != 404 || statuses[2] != 424 {
+		t.Errorf("Expected [424 404 424], got %v", statuses)
+	}
+	if findNoteByID(int64(mine.ID)) == nil || findNoteByID(int64(theirs.ID)) == nil {
+		t.Errorf("Expected no notes to be deleted")
+	}
+}
+
+func TestNoteBatchHandlerBestEffort(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	mine := createNote(user, "mine", "mine")
+
+	w, response := noteBatchRequestJSON(user.AuthToken, fmt.Sprintf(`{"mode":"best_effort","operations":[
+		{"op":"update","id":%d,"title":"","body":"changed"},
+		{"op":"delete","id":%d}]}`, mine.ID, mine.ID))
+
+	if w.Code != 200 || !response.Committed {
+		t.Fatalf("Expected a best effort batch, got %s", w.Body.String())
+	}
+	if r := response.Results[0]; r.Status != 400 || r.Errors["title"] != "is required" {
+		t.Errorf("Expected a validation error, got %+v", r)
+	}
+	if response.Results[1].Status != 200 || findNoteByID(int64(mine.ID)) != nil {
+		t.Errorf("Expected the delete to go ahead")
+	}
+}
+
+func TestNoteBatchHandlerAPIKeyRestriction(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	allowed := createNote(user, "allowed", "body")
+	other := createNote(user, "other", "body")
+	_, plain := createAPIKey(user, "key", []string{scopeNotesWrite}, []int{allowed.ID}, nil)
+
+	_, response := noteBatchRequestJSON(plain, fmt.Sprintf(`{"mode":"best_effort","operations":[
+		{"op":"delete","id":%d},{"op":"delete","id":%d}]}`, allowed.ID, other.ID))
+
+	if response.Results[0].Status != 200 || response.Results[1].Status != 403 {
+		t.Errorf("Expected the restriction to apply per note, got %+v", response.Results)
+	}
+}
+
+func TestNoteBatchHandlerCollaborator(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	owner := factoryCreateUser("user@site.com")
+	writer := factoryCreateUser("writer@site.com")
+	writable := createNote(owner, "writable", "body")
+	readable := createNote(owner, "readable", "body")
+	createCollaborator(writable, writer.Email, "readwrite")
+	createCollaborator(readable, writer.Email, "read")
+
+	_, response := noteBatchRequestJSON(writer.AuthToken, fmt.Sprintf(`{"mode":"best_effort","operations":[
+		{"op":"update","id":%d,"title":"changed","body":"changed"},
+		{"op":"update","id":%d,"title":"changed","body":"changed"},
+		{"op":"delete","id":%d}]}`, writable.ID, readable.ID, writable.ID))
+
+	if len(response.Results) != 3 || response.Results[0].Status != 200 || response.Results[1].Status != 403 || response.Results[2].Status != 404 {
+		t.Fatalf("Expected only the readwrite update to pass, got %+v", response.Results)
+	}
+	if findNoteByID(int64(writable.ID)).Title != "changed" || findNoteByID(int64(readable.ID)).Title != "readable" {
+		t.Errorf("Expected only the writable note to change")
+	}
+}
+
+func TestNoteBatchHandlerFailValidation(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+
+	w, _ := noteBatchRequestJSON(user.AuthToken, `{"mode":"sometimes","operations":[]}`)
+
+	if w.Code != 400 {
+		t.Errorf("Expected 400, got %d", w.Code)
+	}
+	expectedBody := "{\"mode\":\"is invalid\",\"operations\":\"is required\"}"
+	if b := w.Body.String(); b != expectedBody {
+		t.Errorf("Expected %q, got %q", expectedBody, b)
+	}
+}
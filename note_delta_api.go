@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// noteDeltaRequest changes a note body with a list of ops applied to the
+// body at BaseVersion. Checksum is the hex SHA-256 of the body the client
+// expects, so any drift between client and server is caught.
+type noteDeltaRequest struct {
+	BaseVersion int         `json:"base_version"`
+	Ops         []textDelta `json:"ops"`
+	Checksum    string      `json:"checksum"`
+}
+
+// textDelta is one op of a delta. Exactly one of Retain, Insert or Delete is
+// set; lengths count Unicode code points. Text after the last op is kept.
+type textDelta struct {
+	Retain int     `json:"retain,omitempty"`
+	Insert *string `json:"insert,omitempty"`
+	Delete int     `json:"delete,omitempty"`
+}
+
+type noteDeltaResponse struct {
+	ID       int    `json:"id"`
+	Version  int    `json:"version"`
+	Checksum string `json:"checksum"`
+}
+
+// noteDeltaHandler applies a text delta to a note body so autosave only has
+// to send what changed. The response omits the body for the same reason.
+func noteDeltaHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	access := apiAuthorizeNoteUpdate(w, r)
+	if access == nil {
+		return
+	}
+	note := access.Note
+
+	delta := new(noteDeltaRequest)
+	r.Body = http.MaxBytesReader(w, r.Body, maxNotePatchBytes)
+	if err := json.NewDecoder(r.Body).Decode(delta); err != nil {
+		apiErrorHandler(w, r, http.StatusBadRequest, []APIError{{Field: "ops", Message: "is invalid"}})
+		return
+	}
+
+	var errors []APIError
+
+	// Validate Base Version
+	if delta.BaseVersion < 1 {
+		errors = append(errors, APIError{Field: "base_version", Message: "is required"})
+	}
+
+	// Validate Checksum
+	if len(delta.Checksum) == 0 {
+		errors = append(errors, APIError{Field: "checksum", Message: "is required"})
+	}
+
+	if len(errors) > 0 {
+		apiErrorHandler(w, r, http.StatusBadRequest, errors)
+		return
+	}
+
+	// The client must fetch the note again before sending more deltas
+	if delta.BaseVersion != note.Version {
+		w.Header().Set("ETag", noteETag(note))
+		apiErrorHandler(w, r, http.StatusConflict, []APIError{{Field: "base_version", Message: "is not the current version"}})
+		return
+	}
+
+	body, err := applyTextDelta(note.Body, delta.Ops)
+	if err != nil {
+		apiErrorHandler(w, r, http.StatusBadRequest, []APIError{{Field: "ops", Message: err.Error()}})
+		return
+	}
+
+	if !strings.EqualFold(delta.Checksum, bodyChecksum(body)) {
+		w.Header().Set("ETag", noteETag(note))
+		apiErrorHandler(w, r, http.StatusConflict, []APIError{{Field: "checksum", Message: "does not match"}})
+		return
+	}
+
+	if errors := validateNote(note.Title, body); len(errors) > 0 {
+		apiErrorHandler(w, r, http.StatusBadRequest, errors)
+		return
+	}
+
+	if !note.UpdateBody(body, delta.BaseVersion) {
+		note = findNoteByID(int64(note.ID))
+		w.Header().Set("ETag", noteETag(note))
+		apiErrorHandler(w, r, http.StatusConflict, []APIError{{Field: "base_version", Message: "is not the current version"}})
+		return
+	}
+
+	access.RecordShareActivity(r, shareActionDelta)
+
+	w.Header().Set("ETag", noteETag(note))
+	responseJSON, _ := json.Marshal(noteDeltaResponse{ID: note.ID, Version: note.Version, Checksum: bodyChecksum(body)})
+	w.Write(responseJSON)
+}
+
+// applyTextDelta applies ops to text, counting in code points
+func applyTextDelta(text string, ops []textDelta) (string, error) {
+	if len(ops) == 0 {
+		return "", errors.New("is required")
+	}
+
+	var result strings.Builder
+	rest := text
+	for i, op := range ops {
+		at := " at op " + strconv.Itoa(i)
+
+		set := 0
+		if op.Retain != 0 {
+			set++
+		}
+		if op.Insert != nil {
+			set++
+		}
+		if op.Delete != 0 {
+			set++
+		}
+		if set != 1 || op.Retain < 0 || op.Delete < 0 {
+			return "", errors.New("is invalid" + at)
+		}
+
+		switch {
+		case op.Insert != nil:
+			result.WriteString(*op.Insert)
+		case op.Retain > 0:
+			n, ok := runeOffset(rest, op.Retain)
+			if !ok {
+				return "", errors.New("retains past the end" + at)
+			}
+			result.WriteString(rest[:n])
+			rest = rest[n:]
+		default:
+			n, ok := runeOffset(rest, op.Delete)
+			if !ok {
+				return "", errors.New("deletes past the end" + at)
+			}
+			rest = rest[n:]
+		}
+	}
+	result.WriteString(rest)
+	return result.String(), nil
+}
+
+// runeOffset returns the byte offset of the nth code point of s
+func runeOffset(s string, n int) (int, bool) {
+	offset := 0
+	for ; n > 0; n-- {
+		if offset >= len(s) {
+			return 0, false
+		}
+		_, size := utf8.DecodeRuneInString(s[offset:])
+		offset += size
+	}
+	return offset, true
+}
+
+// bodyChecksum is the hex SHA-256 of a note body
+func bodyChecksum(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
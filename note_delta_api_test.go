@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func noteDeltaRequestJSON(token string, id int, body string) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest("POST", fmt.Sprintf("/notes/%d/delta", id), strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("X-Auth-Token", token)
+	w := httptest.NewRecorder()
+	router().ServeHTTP(w, r)
+	return w
+}
+
+func TestApplyTextDelta(t *testing.T) {
+	insert := func(s string) *string { return &s }
+
+	cases := []struct {
+		text     string
+		ops      []textDelta
+		expected string
+	}{
+		{"hello world", []textDelta{{Retain: 6}, {Delete: 5}, {Insert: insert("there")}}, "hello there"},
+		{"héllo", []textDelta{{Retain: 2}, {Insert: insert("!")}}, "hé!llo"},
+		{"abc", []textDelta{{Insert: insert("> ")}}, "> abc"},
+	}
+	for _, c := range cases {
+		if result, err := applyTextDelta(c.text, c.ops); err != nil || result != c.expected {
+			t.Errorf("Expected %q, got %q (%v)", c.expected, result, err)
+		}
+	}
+
+	if _, err := applyTextDelta("abc", []textDelta{{Retain: 4}}); err == nil {
+		t.Errorf("Expected retaining past the end to fail")
+	}
+	if _, err := applyTextDelta("abc", []textDelta{{Retain: 1, Delete: 1}}); err == nil {
+		t.Errorf("Expected an op with two actions to fail")
+	}
+}
+
+func TestNoteDeltaHandlerSuccess(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	note := createNote(user, "Title", "Dear diary, today was fine.")
+	expected := "Dear diary, today was great."
+
+	w := noteDeltaRequestJSON(user.AuthToken, note.ID, fmt.Sprintf(
+		`{"base_version":1,"ops":[{"retain":22},{"delete":4},{"insert":"great"}],"checksum":%q}`, bodyChecksum(expected)))
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var response noteDeltaResponse
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if response.Version != 2 || w.Header().Get("ETag") != "\"2\"" {
+		t.Errorf("Expected version 2, got %s", w.Body.String())
+	}
+	if note = findNoteByID(int64(note.ID)); note.Body != expected || note.Version != 2 {
+		t.Errorf("Expected body %q at version 2, got %q at %d", expected, note.Body, note.Version)
+	}
+}
+
+func TestNoteDeltaHandlerStaleVersion(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	note := createNote(user, "Title", "Body")
+	note.Update("Title", "Body changed elsewhere")
+
+	w := noteDeltaRequestJSON(user.AuthToken, note.ID, fmt.Sprintf(
+		`{"base_version":1,"ops":[{"insert":"New "}],"checksum":%q}`, bodyChecksum("New Body")))
+
+	if w.Code != 409 || w.Header().Get("ETag") != "\"2\"" {
+		t.Errorf("Expected 409 with the current version, got %d %q", w.Code, w.Header().Get("ETag"))
+	}
+}
+
+func TestNoteDeltaHandlerChecksumMismatch(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	note := createNote(user, "Title", "Body")
+
+	w := noteDeltaRequestJSON(user.AuthToken, note.ID, fmt.Sprintf(
+		`{"base_version":1,"ops":[{"insert":"New "}],"checksum":%q}`, bodyChecksum("Something else")))
+
+	if w.Code != 409 {
+		t.Errorf("Expected 409, got %d", w.Code)
+	}
+	expectedBody := "{\"checksum\":\"does not match\"}"
+	if b := w.Body.String(); b != expectedBody {
+		t.Errorf("Expected %q, got %q", expectedBody, b)
+	}
+	if findNoteByID(int64(note.ID)).Body != "Body" {
+		t.Errorf("Expected note to be unchanged")
+	}
+}
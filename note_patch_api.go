@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Patch formats accepted by PATCH /notes/{id}. Plain application/json is
+// treated as a merge patch.
+const (
+	mergePatchContentType = "application/merge-patch+json"
+	jsonPatchContentType  = "application/json-patch+json"
+)
+
+// maxNotePatchBytes limits the size of a patch document
+const maxNotePatchBytes = 1 << 20
+
+// notePatchOperation is one operation of a JSON Patch (RFC 6902) document
+type notePatchOperation struct {
+	Op    string           `json:"op"`
+	Path  string           `json:"path"`
+	From  string           `json:"from"`
+	Value *json.RawMessage `json:"value"`
+}
+
+// notePatchHandler updates only the fields a patch touches, with the same
+// owner and readwrite share authorization as a PUT
+func notePatchHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	access := apiAuthorizeNoteUpdate(w, r)
+	if access == nil {
+		return
+	}
+	note := access.Note
+
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType != mergePatchContentType && contentType != jsonPatchContentType && contentType != "application/json" {
+		w.Header().Set("Accept-Patch", mergePatchContentType+", "+jsonPatchContentType)
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxNotePatchBytes))
+	if err != nil {
+		apiErrorHandler(w, r, http.StatusRequestEntityTooLarge, []APIError{{Field: "patch", Message: "is too large"}})
+		return
+	}
+
+	fields := map[string]string{"title": note.Title, "body": note.Body}
+	var status int
+	var errors []APIError
+	if contentType == jsonPatchContentType {
+		status, errors = applyJSONPatch(fields, data)
+	} else {
+		status, errors = applyMergePatch(fields, data)
+	}
+	if len(errors) > 0 {
+		apiErrorHandler(w, r, status, errors)
+		return
+	}
+
+	title, hasTitle := fields["title"]
+	body, hasBody := fields["body"]
+	if !hasTitle {
+		errors = append(errors, APIError{Field: "title", Message: "is required"})
+	}
+	if !hasBody {
+		errors = append(errors, APIError{Field: "body", Message: "is required"})
+	}
+	if len(errors) == 0 {
+		errors = validateNote(title, body)
+	}
+	if len(errors) > 0 {
+		apiErrorHandler(w, r, http.StatusBadRequest, errors)
+		return
+	}
+
+	if title != note.Title || body != note.Body {
+		note.Update(title, body)
+	}
+	access.RecordShareActivity(r, shareActionPatch)
+
+	w.Header().Set("ETag", noteETag(note))
+	w.Write(access.JSON())
+}
+
+// applyMergePatch applies a JSON Merge Patch (RFC 7396) to the note fields.
+// A null member removes the field, which leaves the note invalid; members
+// that aren't note fields are ignored.
+func applyMergePatch(fields map[string]string, data []byte) (int, []APIError) {
+	var patch map[string]json.RawMessage
+	if err := json.Unmarshal(data, &patch); err != nil || patch == nil {
+		return http.StatusBadRequest, []APIError{{Field: "patch", Message: "is invalid"}}
+	}
+
+	var errors []APIError
+	for _, field := range []string{"title", "body"} {
+		value, ok := patch[field]
+		if !ok {
+			continue
+		}
+		if string(value) == "null" {
+			delete(fields, field)
+			continue
+		}
+
+		var s string
+		if err := json.Unmarshal(value, &s); err != nil {
+			errors = append(errors, APIError{Field: field, Message: "is invalid"})
+			continue
+		}
+		fields[field] = s
+	}
+	return http.StatusBadRequest, errors
+}
+
+// applyJSONPatch applies a JSON Patch (RFC 6902) to the note fields. The
+// only paths are /title and /body. Operations apply in order and a failed
+// test stops the whole patch with 409 Conflict.
+func applyJSONPatch(fields map[string]string, data []byte) (int, []APIError) {
+	var operations []notePatchOperation
+	if err := json.Unmarshal(data, &operations); err != nil {
+		return http.StatusBadRequest, []APIError{{Field: "patch", Message: "is invalid"}}
+	}
+
+	invalid := func(message string) (int, []APIError) {
+		return http.StatusBadRequest, []APIError{{Field: "patch", Message: message}}
+	}
+
+	for i, operation := range operations {
+		at := " at operation " + strconv.Itoa(i)
+
+		field, ok := notePatchField(operation.Path)
+		if !ok {
+			return invalid("has an invalid path" + at)
+		}
+
+		switch operation.Op {
+		case "add", "replace", "test":
+			var value string
+			if operation.Value == nil || json.Unmarshal(*operation.Value, &value) != nil {
+				return invalid("has an invalid value" + at)
+			}
+			current, exists := fields[field]
+			if operation.Op == "replace" && !exists {
+				return invalid("replaces a missing field" + at)
+			}
+			if operation.Op == "test" {
+				if !exists || current != value {
+					return http.StatusConflict, []APIError{{Field: "patch", Message: "failed test" + at}}
+				}
+				continue
+			}
+			fields[field] = value
+
+		case "remove":
+			if _, exists := fields[field]; !exists {
+				return invalid("removes a missing field" + at)
+			}
+			delete(fields, field)
+
+		case "move", "copy":
+			from, ok := notePatchField(operation.From)
+			if !ok {
+				return invalid("has an invalid from" + at)
+			}
+			value, exists := fields[from]
+			if !exists {
+				return invalid("moves a missing field" + at)
+			}
+			if operation.Op == "move" {
+				delete(fields, from)
+			}
+			fields[field] = value
+
+		default:
+			return invalid("has an invalid op" + at)
+		}
+	}
+	return http.StatusOK, nil
+}
+
+// notePatchField maps a JSON Pointer to a note field
+func notePatchField(path string) (string, bool) {
+	field := strings.TrimPrefix(path, "/")
+	if field == path || (field != "title" && field != "body") {
+		return "", false
+	}
+	return field, true
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func notePatchRequest(token string, id string, contentType string, body string) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest("PATCH", "/notes/"+id, strings.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	if len(token) > 0 {
+		r.Header.Set("X-Auth-Token", token)
+	}
+	w := httptest.NewRecorder()
+	router().ServeHTTP(w, r)
+	return w
+}
+
+func TestNotePatchHandlerMergePatch(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	note := createNote(user, "Old title", "Long body")
+
+	w := notePatchRequest(user.AuthToken, fmt.Sprint(note.ID), mergePatchContentType, `{"title":"New title","id":99}`)
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	expectedBody := fmt.Sprintf("{\"id\":%d,\"title\":\"New title\",\"body\":\"Long body\",\"shares\":null}", note.ID)
+	if b := w.Body.String(); b != expectedBody {
+		t.Errorf("Expected %q, got %q", expectedBody, b)
+	}
+}
+
+func TestNotePatchHandlerMergePatchNull(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	note := createNote(user, "Title", "Body")
+
+	w := notePatchRequest(user.AuthToken, fmt.Sprint(note.ID), mergePatchContentType, `{"body":null}`)
+
+	if w.Code != 400 {
+		t.Errorf("Expected 400, got %d", w.Code)
+	}
+	expectedBody := "{\"body\":\"is required\"}"
+	if b := w.Body.String(); b != expectedBody {
+		t.Errorf("Expected %q, got %q", expectedBody, b)
+	}
+}
+
+func TestNotePatchHandlerJSONPatch(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	note := createNote(user, "Title", "Body")
+
+	w := notePatchRequest(user.AuthToken, fmt.Sprint(note.ID), jsonPatchContentType, `[
+		{"op":"test","path":"/title","value":"Title"},
+		{"op":"copy","from":"/title","path":"/body"},
+		{"op":"replace","path":"/title","value":"Renamed"}]`)
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	note = findNoteByID(int64(note.ID))
+	if note.Title != "Renamed" || note.Body != "Title" {
+		t.Errorf("Expected patch to be applied, got %q %q", note.Title, note.Body)
+	}
+}
+
+func TestNotePatchHandlerJSONPatchFailedTest(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	note := createNote(user, "Title", "Body")
+
+	w := notePatchRequest(user.AuthToken, fmt.Sprint(note.ID), jsonPatchContentType, `[
+		{"op":"replace","path":"/title","value":"Renamed"},
+		{"op":"test","path":"/body","value":"Stale"}]`)
+
+	if w.Code != 409 {
+		t.Errorf("Expected 409, got %d", w.Code)
+	}
+	if findNoteByID(int64(note.ID)).Title != "Title" {
+		t.Errorf("Expected note to be unchanged")
+	}
+}
+
+func TestNotePatchHandlerReadwriteShare(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	share := factoryCreateShare("readwrite")
+	readShare := factoryCreateShare("read")
+
+	w := notePatchRequest("", share.AuthKey, mergePatchContentType, `{"body":"Shared edit"}`)
+	if w.Code != 200 || findNoteByID(int64(share.NoteID)).Body != "Shared edit" {
+		t.Errorf("Expected readwrite share to patch, got %d", w.Code)
+	}
+
+	w = notePatchRequest("", readShare.AuthKey, mergePatchContentType, `{"body":"Shared edit"}`)
+	if w.Code != 403 {
+		t.Errorf("Expected 403 for read share, got %d", w.Code)
+	}
+}
+
+func TestNotePatchHandlerFailInvalidUser(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	other := factoryCreateUser("other@site.com")
+	note := createNote(other, "Title", "Body")
+
+	w := notePatchRequest(user.AuthToken, fmt.Sprint(note.ID), mergePatchContentType, `{"title":"Mine"}`)
+
+	if w.Code != 404 {
+		t.Errorf("Expected 404, got %d", w.Code)
+	}
+}
+
+func TestNotePatchHandlerUnsupportedMediaType(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	note := createNote(user, "Title", "Body")
+
+	w := notePatchRequest(user.AuthToken, fmt.Sprint(note.ID), "application/x-www-form-urlencoded", "title=New")
+
+	if w.Code != 415 || w.Header().Get("Accept-Patch") == "" {
+		t.Errorf("Expected 415 with Accept-Patch, got %d", w.Code)
+	}
+}
@@ -1,6 +1,9 @@
 package main
 
-import "testing"
+import (
+	"net/http"
+	"testing"
+)
 
 func TestCreateNote(t *testing.T) {
 	db := testDbSetup()
@@ -21,7 +24,7 @@ func TestCreateNote(t *testing.T) {
 		t.Errorf("Expected note body to eq %q", body)
 	}
 	if note.ID != 1 {
-		t.Errorf("Expected note id to eq %q, got %q", 1, note.ID)
+		t.Errorf("Expected note id to eq %d, got %d", 1, note.ID)
 	}
 }
 
@@ -90,6 +93,36 @@ func TestNoteDestroy(t *testing.T) {
 	}
 }
 
+func TestNoteDestroyCascades(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	reader := factoryCreateUser("reader@site.com")
+	note := createNote(user, "title", "body")
+	share := createShare(note, "comment")
+	createShareSession(share)
+	createCollaborator(note, reader.Email, "read")
+	createComment(note, reader, nil, "", "Nice", nil)
+	r, _ := http.NewRequest("GET", "/s/"+share.AuthKey, nil)
+	recordShareActivity(r, share, shareActionView, http.StatusOK, note.Version)
+
+	note.Destroy()
+
+	for _, table := range noteTables {
+		var count int
+		db.QueryRow("SELECT COUNT(*) FROM "+table+" WHERE note_id=?", note.ID).Scan(&count)
+		if count != 0 {
+			t.Errorf("Expected %s to be removed, got %d rows", table, count)
+		}
+	}
+	var sessions int
+	db.QueryRow("SELECT COUNT(*) FROM share_sessions WHERE share_id=?", share.ID).Scan(&sessions)
+	if sessions != 0 {
+		t.Errorf("Expected share sessions to be removed, got %d", sessions)
+	}
+}
+
 func TestNoteUpdate(t *testing.T) {
 	db := testDbSetup()
 	defer db.Close()
@@ -124,9 +157,9 @@ func TestNoteShares(t *testing.T) {
 		t.Errorf("Expected 2 shares, found %d", len(shares))
 	}
 	if shares[0].ID != shareA.ID {
-		t.Errorf("Expected share[0] ID to eq %q, got %q", shareA.ID, shares[0].ID)
+		t.Errorf("Expected share[0] ID to eq %d, got %d", shareA.ID, shares[0].ID)
 	}
 	if shares[1].ID != shareB.ID {
-		t.Errorf("Expected share[1] ID to eq %q, got %q", shareB.ID, shares[1].ID)
+		t.Errorf("Expected share[1] ID to eq %d, got %d", shareB.ID, shares[1].ID)
 	}
 }
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// oidcLoginTTL is how long a user has to complete sign in at the provider
+const oidcLoginTTL = 10 * time.Minute
+
+// OIDCConfig configures single sign-on through an OpenID Connect provider
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+}
+
+var oidcConfig OIDCConfig
+
+var oidcProviderMutex sync.Mutex
+var oidcProviderCache *oidc.Provider
+
+func init() {
+	oidcSetup(OIDCConfig{
+		Issuer:       os.Getenv("GRAYNOTE_OIDC_ISSUER"),
+		ClientID:     os.Getenv("GRAYNOTE_OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("GRAYNOTE_OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("GRAYNOTE_OIDC_REDIRECT_URL"),
+	})
+}
+
+// oidcSetup switches to a new provider configuration, dropping cached discovery
+func oidcSetup(config OIDCConfig) {
+	oidcProviderMutex.Lock()
+	defer oidcProviderMutex.Unlock()
+
+	oidcConfig = config
+	oidcProviderCache = nil
+}
+
+// Enabled returns if single sign-on is configured
+func (c OIDCConfig) Enabled() bool {
+	return len(c.Issuer) > 0 && len(c.ClientID) > 0
+}
+
+// passwordLoginEnabled returns false when accounts must sign in through the provider
+func passwordLoginEnabled() bool {
+	return os.Getenv("GRAYNOTE_PASSWORD_LOGIN_DISABLED") != "true"
+}
+
+// oidcProvider runs discovery against the issuer once and caches the result.
+// Signing keys are fetched from the provider's JWKS endpoint as needed.
+func oidcProvider() (*oidc.Provider, error) {
+	oidcProviderMutex.Lock()
+	defer oidcProviderMutex.Unlock()
+
+	if oidcProviderCache != nil {
+		return oidcProviderCache, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	provider, err := oidc.NewProvider(ctx, oidcConfig.Issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	oidcProviderCache = provider
+	return provider, nil
+}
+
+func oidcOAuth2Config(provider *oidc.Provider) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     oidcConfig.ClientID,
+		ClientSecret: oidcConfig.ClientSecret,
+		RedirectURL:  oidcConfig.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       []string{oidc.ScopeOpenID, "email", "profile"},
+	}
+}
+
+// OIDCLogin holds the state of an authorization request in flight
+type OIDCLogin struct {
+	ID           int
+	StateHash    string
+	Nonce        string
+	CodeVerifier string
+	ExpiresAt    time.Time
+	UsedAt       *time.Time
+}
+
+// createOIDCLogin stores a new login attempt and returns its plain state
+func createOIDCLogin() (string, *OIDCLogin) {
+	state := randomToken()
+	login := &OIDCLogin{
+		StateHash:    hashToken(state),
+		Nonce:        randomToken(),
+		CodeVerifier: oauth2.GenerateVerifier(),
+		ExpiresAt:    time.Now().UTC().Add(oidcLoginTTL),
+	}
+
+	stmt, err := db.Prepare("INSERT oidc_logins SET state_hash=?, nonce=?, code_verifier=?, expires_at=?")
+	if err != nil {
+		checkErr(err, "prepare create oidc login")
+	} else {
+		defer stmt.Close()
+	}
+	res, err := stmt.Exec(login.StateHash, login.Nonce, login.CodeVerifier, login.ExpiresAt)
+	checkErr(err, "create oidc login")
+
+	loginID, _ := res.LastInsertId()
+	login.ID = int(loginID)
+	return state, login
+}
+
+// findOIDCLoginByState returns the login for state if unused and unexpired
+func findOIDCLoginByState(state string) *OIDCLogin {
+	var login *OIDCLogin
+
+	rows, err := db.Query(
+		"SELECT id, state_hash, nonce, code_verifier, expires_at, used_at FROM oidc_logins WHERE state_hash=? AND used_at IS NULL AND expires_at > ?",
+		hashToken(state),
+		time.Now().UTC())
+	if err != nil {
+		checkErr(err, "find oidc login by state")
+	} else {
+		defer rows.Close()
+	}
+
+	if rows.Next() {
+		login = oidcLoginFromDbRows(rows)
+	}
+	return login
+}
+
+// Use marks the login as spent. It returns false if another request used it first.
+func (l *OIDCLogin) Use() bool {
+	res, err := db.Exec("UPDATE oidc_logins SET used_at=? WHERE id=? AND used_at IS NULL", time.Now().UTC(), l.ID)
+	checkErr(err, "use oidc login")
+
+	affected, _ := res.RowsAffected()
+	return affected == 1
+}
+
+func oidcLoginFromDbRows(rows *sql.Rows) *OIDCLogin {
+	login := new(OIDCLogin)
+	rows.Scan(&login.ID, &login.StateHash, &login.Nonce, &login.CodeVerifier, &login.ExpiresAt, &login.UsedAt)
+	return login
+}
+
+// oidcClaims are the ID token claims used to find or create an account
+type oidcClaims struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Nonce         string `json:"nonce"`
+}
+
+// findUserByIdentity returns the user linked to an external subject
+func findUserByIdentity(issuer string, subject string) *User {
+	var userID int64
+	err := db.QueryRow("SELECT user_id FROM user_identities WHERE issuer=? AND subject=?", issuer, subject).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	checkErr(err, "find user by identity")
+
+	return findUserByID(userID)
+}
+
+// LinkIdentity records that an external subject signs in as this user
+func (u *User) LinkIdentity(issuer string, subject string) {
+	_, err := db.Exec(
+		"INSERT user_identities SET user_id=?, issuer=?, subject=?, created_at=?",
+		u.ID,
+		issuer,
+		subject,
+		time.Now().UTC())
+	checkErr(err, "link user identity")
+}
+
+// UserIdentity is an external subject linked to a user
+type UserIdentity struct {
+	Issuer    string
+	Subject   string
+	CreatedAt time.Time
+}
+
+// Identities returns the external subjects linked to this user
+func (u User) Identities() []*UserIdentity {
+	rows, err := db.Query("SELECT issuer, subject, created_at FROM user_identities WHERE user_id=?", u.ID)
+	if err != nil {
+		checkErr(err, "find user identities")
+	} else {
+		defer rows.Close()
+	}
+
+	var identities []*UserIdentity
+	for rows.Next() {
+		identity := new(UserIdentity)
+		rows.Scan(&identity.Issuer, &identity.Subject, &identity.CreatedAt)
+		identities = append(identities, identity)
+	}
+	return identities
+}
+
+// userForOIDCClaims finds the account for a verified ID token. Unknown
+// subjects are linked to an existing account with the same email, or get a
+// new account on their first login. An existing account whose email was never
+// confirmed is reset first, as whoever registered it may not own the address.
+func userForOIDCClaims(issuer string, claims oidcClaims) *User {
+	if user := findUserByIdentity(issuer, claims.Subject); user != nil {
+		return user
+	}
+
+	email := normalizeEmail(claims.Email)
+	if !claims.EmailVerified || !ValidateEmail(email) {
+		return nil
+	}
+
+	user := findUserByEmail(email)
+	if user == nil {
+		// Password login is impossible until the user resets it
+		user = createUser(&UserRegisterForm{Email: email, Password: randomToken()})
+	}
+	if !user.Verified() {
+		user.resetCredentials()
+		user.MarkEmailVerified()
+	}
+
+	user.LinkIdentity(issuer, claims.Subject)
+	return user
+}
+
+// resetCredentials replaces every way into the account: the password, auth
+// token and with it every session, API keys, 2FA and pending resets
+func (u *User) resetCredentials() {
+	u.UpdatePassword(randomToken())
+	u.RevokeTokens()
+	for _, key := range findAPIKeysByUser(u) {
+		key.Destroy()
+	}
+	u.DisableTwoFactor()
+	destroyPasswordResetsForUser(u)
+}
+
+// oidcIssuerKey normalizes the issuer URL recorded with linked identities
+func oidcIssuerKey() string {
+	return strings.TrimRight(oidcConfig.Issuer, "/")
+}
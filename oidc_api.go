@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// oidcStateCookieName holds the state of a login started by this browser
+const oidcStateCookieName = "graynote_oidc_state"
+
+// oidcLoginHandler starts an authorization code flow with PKCE at the provider
+func oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if !oidcConfig.Enabled() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	provider, err := oidcProvider()
+	if err != nil {
+		log.Println("oidc discovery failed", err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	state, login := createOIDCLogin()
+	http.SetCookie(w, oidcStateCookie(state, int(oidcLoginTTL.Seconds())))
+
+	authURL := oidcOAuth2Config(provider).AuthCodeURL(
+		state,
+		oauth2.S256ChallengeOption(login.CodeVerifier),
+		oauth2.SetAuthURLParam("nonce", login.Nonce))
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// oidcCallbackHandler exchanges the authorization code, validates the ID
+// token against the provider's keys and signs the linked user in
+func oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if !oidcConfig.Enabled() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if providerError := r.URL.Query().Get("error"); len(providerError) > 0 {
+		apiErrorHandler(w, r, http.StatusForbidden, []APIError{{Field: "provider", Message: providerError}})
+		return
+	}
+
+	// The state must come back to the browser that started the login, so
+	// nobody can hand a victim the callback for their own account
+	state := r.URL.Query().Get("state")
+	cookie, err := r.Cookie(oidcStateCookieName)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		apiErrorHandler(w, r, http.StatusBadRequest, []APIError{{Field: "state", Message: "is invalid"}})
+		return
+	}
+	http.SetCookie(w, oidcStateCookie("", -1))
+
+	login := findOIDCLoginByState(state)
+	if login == nil || !login.Use() {
+		apiErrorHandler(w, r, http.StatusBadRequest, []APIError{{Field: "state", Message: "is invalid"}})
+		return
+	}
+
+	provider, err := oidcProvider()
+	if err != nil {
+		log.Println("oidc discovery failed", err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	token, err := oidcOAuth2Config(provider).Exchange(
+		r.Context(),
+		r.URL.Query().Get("code"),
+		oauth2.VerifierOption(login.CodeVerifier))
+	if err != nil {
+		apiErrorHandler(w, r, http.StatusForbidden, []APIError{{Field: "code", Message: "is invalid"}})
+		return
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		apiErrorHandler(w, r, http.StatusForbidden, []APIError{{Field: "id_token", Message: "is required"}})
+		return
+	}
+
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: oidcConfig.ClientID}).Verify(r.Context(), rawIDToken)
+	if err != nil {
+		apiErrorHandler(w, r, http.StatusForbidden, []APIError{{Field: "id_token", Message: "is invalid"}})
+		return
+	}
+
+	var claims oidcClaims
+	if err = idToken.Claims(&claims); err != nil || claims.Nonce != login.Nonce {
+		apiErrorHandler(w, r, http.StatusForbidden, []APIError{{Field: "id_token", Message: "is invalid"}})
+		return
+	}
+
+	user := userForOIDCClaims(oidcIssuerKey(), claims)
+	if user == nil {
+		apiErrorHandler(w, r, http.StatusForbidden, []APIError{{Field: "email", Message: "is not verified"}})
+		return
+	}
+
+	// Browser clients get a session cookie alongside the token
+	apiStartSession(w, r, user)
+
+	// Success message
+	w.WriteHeader(http.StatusCreated)
+
+	// Authenticate
+	w.Write(successfulLoginJSON(user))
+}
+
+// oidcStateCookie ties a login to the browser that started it. It must be
+// sent on the redirect back from the provider, so it can't be SameSite=Strict.
+func oidcStateCookie(state string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    state,
+		Path:     "/users/oidc",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   sessionStore.Options.Secure,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// apiRequirePasswordLogin writes a 403 and returns false when password login is disabled
+func apiRequirePasswordLogin(w http.ResponseWriter, r *http.Request) bool {
+	if passwordLoginEnabled() {
+		return true
+	}
+
+	apiErrorHandler(w, r, http.StatusForbidden, []APIError{{Field: "password_login", Message: "is disabled"}})
+	return false
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// testIdentityProvider is a minimal stand-in OpenID provider. It issues an
+// ID token for Subject and Email to whoever presents the code "valid-code".
+type testIdentityProvider struct {
+	*httptest.Server
+	Key           *rsa.PrivateKey
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Nonce         string
+}
+
+func newTestIdentityProvider() *testIdentityProvider {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	idp := &testIdentityProvider{Key: key, Subject: "external-1", Email: "sso@site.com", EmailVerified: true}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                idp.URL,
+			"authorization_endpoint":                idp.URL + "/authorize",
+			"token_endpoint":                        idp.URL + "/token",
+			"jwks_uri":                              idp.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &idp.Key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"},
+		}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.PostForm.Get("code") != "valid-code" || len(r.PostForm.Get("code_verifier")) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("{\"error\":\"invalid_grant\"}"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"id_token":     idp.idToken(),
+		})
+	})
+	idp.Server = httptest.NewServer(mux)
+	return idp
+}
+
+func (idp *testIdentityProvider) idToken() string {
+	signer, _ := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.RS256, Key: idp.Key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", "test"))
+
+	claims := map[string]interface{}{
+		"iss":            idp.URL,
+		"sub":            idp.Subject,
+		"aud":            "graynote",
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          idp.Nonce,
+		"email":          idp.Email,
+		"email_verified": idp.EmailVerified,
+	}
+	token, _ := jwt.Signed(signer).Claims(claims).Serialize()
+	return token
+}
+
+// oidcTestLogin starts a login and returns the state and nonce sent to the provider
+func oidcTestLogin(t *testing.T) (string, string) {
+	r, _ := http.NewRequest("GET", "/users/oidc/login", nil)
+	w := httptest.NewRecorder()
+
+	router().ServeHTTP(w, r)
+
+	if w.Code != 302 {
+		t.Fatalf("Expected 302, got %d", w.Code)
+	}
+
+	location, _ := url.Parse(w.Header().Get("Location"))
+	query := location.Query()
+	if cookies := w.Result().Cookies(); len(cookies) != 1 || cookies[0].Value != query.Get("state") || !cookies[0].HttpOnly {
+		t.Errorf("Expected the state in an HttpOnly cookie, got %v", cookies)
+	}
+	if query.Get("code_challenge_method") != "S256" || len(query.Get("code_challenge")) == 0 {
+		t.Errorf("Expected a PKCE challenge, got %q", location)
+	}
+	return query.Get("state"), query.Get("nonce")
+}
+
+// oidcTestCallback returns to the callback from the browser that started the
+// login, which holds the state cookie
+func oidcTestCallback(state string, code string) *httptest.ResponseRecorder {
+	return oidcTestCallbackWithCookie(state, code, state)
+}
+
+func oidcTestCallbackWithCookie(state string, code string, cookie string) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest("GET", "/users/oidc/callback?state="+url.QueryEscape(state)+"&code="+code, nil)
+	if len(cookie) > 0 {
+		r.AddCookie(&http.Cookie{Name: oidcStateCookieName, Value: cookie})
+	}
+	w := httptest.NewRecorder()
+	router().ServeHTTP(w, r)
+	return w
+}
+
+func TestOIDCLoginCreatesUser(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	idp := newTestIdentityProvider()
+	defer idp.Close()
+	oidcSetup(OIDCConfig{Issuer: idp.URL, ClientID: "graynote", RedirectURL: "http://localhost/users/oidc/callback"})
+	defer oidcSetup(OIDCConfig{})
+
+	state, nonce := oidcTestLogin(t)
+	idp.Nonce = nonce
+
+	w := oidcTestCallback(state, "valid-code")
+	if w.Code != 201 {
+		t.Fatalf("Expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+
+	user := findUserByIdentity(idp.URL, "external-1")
+	if user == nil || user.Email != "sso@site.com" || !user.Verified() {
+		t.Fatalf("Expected a verified user linked to the subject")
+	}
+	if b := w.Body.String(); !strings.Contains(b, user.AuthToken) {
+		t.Errorf("Expected token, got %q", b)
+	}
+
+	// The state can't be replayed
+	w = oidcTestCallback(state, "valid-code")
+	if w.Code != 400 {
+		t.Errorf("Expected 400, got %d", w.Code)
+	}
+}
+
+func TestOIDCLoginFailOtherBrowser(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	idp := newTestIdentityProvider()
+	defer idp.Close()
+	oidcSetup(OIDCConfig{Issuer: idp.URL, ClientID: "graynote", RedirectURL: "http://localhost/users/oidc/callback"})
+	defer oidcSetup(OIDCConfig{})
+
+	state, nonce := oidcTestLogin(t)
+	idp.Nonce = nonce
+	otherState, _ := oidcTestLogin(t)
+
+	// A victim sent the attacker's callback has no state cookie, or their own
+	for _, cookie := range []string{"", otherState} {
+		if w := oidcTestCallbackWithCookie(state, "valid-code", cookie); w.Code != 400 {
+			t.Errorf("Expected 400 with cookie %q, got %d", cookie, w.Code)
+		}
+	}
+
+	// The login is still usable by the browser that started it
+	if w := oidcTestCallback(state, "valid-code"); w.Code != 201 {
+		t.Errorf("Expected 201, got %d", w.Code)
+	}
+}
+
+func TestOIDCLoginLinksExistingUser(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	existing := factoryCreateUser("sso@site.com")
+
+	idp := newTestIdentityProvider()
+	defer idp.Close()
+	oidcSetup(OIDCConfig{Issuer: idp.URL, ClientID: "graynote"})
+	defer oidcSetup(OIDCConfig{})
+
+	state, nonce := oidcTestLogin(t)
+	idp.Nonce = nonce
+
+	if w := oidcTestCallback(state, "valid-code"); w.Code != 201 {
+		t.Fatalf("Expected 201, got %d", w.Code)
+	}
+	if user := findUserByIdentity(idp.URL, "external-1"); user == nil || user.ID != existing.ID {
+		t.Errorf("Expected subject to be linked to the existing user")
+	}
+}
+
+func TestOIDCLoginResetsUnverifiedUser(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	// Someone registered the address before its owner and never confirmed it
+	squatter := createUser(&UserRegisterForm{Email: "sso@site.com", Password: "password"})
+	_, plain := createAPIKey(squatter, "key", []string{scopeNotesRead}, nil, nil)
+
+	idp := newTestIdentityProvider()
+	defer idp.Close()
+	oidcSetup(OIDCConfig{Issuer: idp.URL, ClientID: "graynote"})
+	defer oidcSetup(OIDCConfig{})
+
+	state, nonce := oidcTestLogin(t)
+	idp.Nonce = nonce
+
+	if w := oidcTestCallback(state, "valid-code"); w.Code != 201 {
+		t.Fatalf("Expected 201, got %d", w.Code)
+	}
+
+	user := findUserByIdentity(idp.URL, "external-1")
+	if user == nil || user.ID != squatter.ID || !user.Verified() {
+		t.Fatalf("Expected subject to be linked to the confirmed account")
+	}
+	if user.validPasswordForUser("password") || user.AuthToken == squatter.AuthToken {
+		t.Errorf("Expected the squatter's password and token to be replaced")
+	}
+	if findAPIKeyByToken(plain) != nil {
+		t.Errorf("Expected the squatter's API key to be revoked")
+	}
+}
+
+func TestOIDCLoginFailBadNonce(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	idp := newTestIdentityProvider()
+	defer idp.Close()
+	oidcSetup(OIDCConfig{Issuer: idp.URL, ClientID: "graynote"})
+	defer oidcSetup(OIDCConfig{})
+
+	state, _ := oidcTestLogin(t)
+	idp.Nonce = "replayed"
+
+	if w := oidcTestCallback(state, "valid-code"); w.Code != 403 {
+		t.Errorf("Expected 403, got %d", w.Code)
+	}
+}
+
+func TestOIDCLoginFailUnverifiedEmail(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	idp := newTestIdentityProvider()
+	idp.EmailVerified = false
+	defer idp.Close()
+	oidcSetup(OIDCConfig{Issuer: idp.URL, ClientID: "graynote"})
+	defer oidcSetup(OIDCConfig{})
+
+	state, nonce := oidcTestLogin(t)
+	idp.Nonce = nonce
+
+	if w := oidcTestCallback(state, "valid-code"); w.Code != 403 {
+		t.Errorf("Expected 403, got %d", w.Code)
+	}
+	if findUserByEmail("sso@site.com") != nil {
+		t.Errorf("Expected no account to be created")
+	}
+}
+
+func TestPasswordLoginDisabled(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	os.Setenv("GRAYNOTE_PASSWORD_LOGIN_DISABLED", "true")
+	defer os.Unsetenv("GRAYNOTE_PASSWORD_LOGIN_DISABLED")
+
+	factoryCreateUser("user@site.com")
+
+	r, _ := http.NewRequest("POST", "/users/login", strings.NewReader("email=user@site.com&password=password"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+	w := httptest.NewRecorder()
+
+	router().ServeHTTP(w, r)
+
+	if w.Code != 403 {
+		t.Errorf("Expected 403, got %d", w.Code)
+	}
+	expectedBody := "{\"password_login\":\"is disabled\"}"
+	if b := w.Body.String(); b != expectedBody {
+		t.Errorf("Expected %q, got %q", expectedBody, b)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+// passwordResetTTL is how long a reset link stays valid
+const passwordResetTTL = time.Hour
+
+// PasswordReset is a single-use token allowing a User to set a new password.
+// Only a hash of the token is stored.
+type PasswordReset struct {
+	ID        int
+	UserID    int
+	TokenHash string
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+// createPasswordReset stores a new reset for user and returns the plain token
+func createPasswordReset(user *User) string {
+	token := randomToken()
+
+	stmt, err := db.Prepare("INSERT password_resets SET user_id=?, token_hash=?, expires_at=?")
+	if err != nil {
+		checkErr(err, "prepare create password reset")
+	} else {
+		defer stmt.Close()
+	}
+	_, err = stmt.Exec(user.ID, hashToken(token), time.Now().UTC().Add(passwordResetTTL))
+	checkErr(err, "create password reset")
+
+	return token
+}
+
+// findPasswordResetByToken returns the reset for token if unused and unexpired
+func findPasswordResetByToken(token string) *PasswordReset {
+	var reset *PasswordReset
+
+	rows, err := db.Query(
+		"SELECT id, user_id, token_hash, expires_at, used_at FROM password_resets WHERE token_hash=? AND used_at IS NULL AND expires_at > ?",
+		hashToken(token),
+		time.Now().UTC())
+	if err != nil {
+		checkErr(err, "find password reset by token")
+	} else {
+		defer rows.Close()
+	}
+
+	if rows.Next() {
+		reset = passwordResetFromDbRows(rows)
+	}
+	return reset
+}
+
+// Use marks the reset as spent. It returns false if another request used it first.
+func (p *PasswordReset) Use() bool {
+	res, err := db.Exec("UPDATE password_resets SET used_at=? WHERE id=? AND used_at IS NULL", time.Now().UTC(), p.ID)
+	checkErr(err, "use password reset")
+
+	affected, _ := res.RowsAffected()
+	return affected == 1
+}
+
+func destroyPasswordResetsForUser(user *User) {
+	_, err := db.Exec("DELETE FROM password_resets WHERE user_id=?", user.ID)
+	checkErr(err, "destroy password resets")
+}
+
+func passwordResetFromDbRows(rows *sql.Rows) *PasswordReset {
+	reset := new(PasswordReset)
+	rows.Scan(&reset.ID, &reset.UserID, &reset.TokenHash, &reset.ExpiresAt, &reset.UsedAt)
+	return reset
+}
@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestCreatePasswordReset(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	token := createPasswordReset(user)
+
+	reset := findPasswordResetByToken(token)
+	if reset == nil {
+		t.Fatalf("Expected reset to be found")
+	}
+	if reset.UserID != user.ID {
+		t.Errorf("Expected reset user %d, got %d", user.ID, reset.UserID)
+	}
+	if reset.TokenHash == token {
+		t.Errorf("Expected token to be stored hashed")
+	}
+}
+
+func TestPasswordResetUse(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	token := createPasswordReset(user)
+	reset := findPasswordResetByToken(token)
+
+	if !reset.Use() {
+		t.Errorf("Expected first use to succeed")
+	}
+	if reset.Use() {
+		t.Errorf("Expected second use to fail")
+	}
+	if findPasswordResetByToken(token) != nil {
+		t.Errorf("Expected used reset not to be found")
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimitEntry is the limiter state kept for a single key
+type RateLimitEntry struct {
+	Tokens       float64
+	Failures     int
+	UpdatedAt    time.Time
+	BlockedUntil time.Time
+}
+
+// RateLimitStore persists limiter state. The in-memory store is per process;
+// a shared implementation can be swapped in to limit across instances.
+type RateLimitStore interface {
+	Get(key string) (RateLimitEntry, bool)
+	Set(key string, entry RateLimitEntry, ttl time.Duration)
+	Delete(key string)
+}
+
+type memoryRateLimitItem struct {
+	entry     RateLimitEntry
+	expiresAt time.Time
+}
+
+// MemoryRateLimitStore keeps limiter state in a map, expiring idle keys
+type MemoryRateLimitStore struct {
+	mu      sync.Mutex
+	items   map[string]memoryRateLimitItem
+	lastGCd time.Time
+}
+
+// NewMemoryRateLimitStore returns an empty in-memory store
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{items: map[string]memoryRateLimitItem{}}
+}
+
+// Get returns the entry for key, if present and not expired
+func (s *MemoryRateLimitStore) Get(key string) (RateLimitEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, ok := s.items[key]
+	if !ok || time.Now().After(item.expiresAt) {
+		return RateLimitEntry{}, false
+	}
+	return item.entry, true
+}
+
+// Set stores the entry for key until ttl elapses
+func (s *MemoryRateLimitStore) Set(key string, entry RateLimitEntry, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.items[key] = memoryRateLimitItem{entry: entry, expiresAt: now.Add(ttl)}
+
+	// Sweep expired keys at most once a minute
+	if now.Sub(s.lastGCd) > time.Minute {
+		for k, item := range s.items {
+			if now.After(item.expiresAt) {
+				delete(s.items, k)
+			}
+		}
+		s.lastGCd = now
+	}
+}
+
+// Delete removes the entry for key
+func (s *MemoryRateLimitStore) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.items, key)
+}
+
+// TokenBucketLimiter allows Capacity requests in a burst, refilled evenly over Period
+type TokenBucketLimiter struct {
+	Store    RateLimitStore
+	Capacity int
+	Period   time.Duration
+
+	mu sync.Mutex
+}
+
+// Take spends a token for key. It returns whether the request is allowed,
+// the tokens remaining, and the time until the bucket is full again.
+func (l *TokenBucketLimiter) Take(key string) (bool, int, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	refillRate := float64(l.Capacity) / l.Period.Seconds()
+
+	entry, ok := l.Store.Get(key)
+	if !ok {
+		entry = RateLimitEntry{Tokens: float64(l.Capacity), UpdatedAt: now}
+	}
+
+	entry.Tokens = math.Min(float64(l.Capacity), entry.Tokens+now.Sub(entry.UpdatedAt).Seconds()*refillRate)
+	entry.UpdatedAt = now
+
+	allowed := entry.Tokens >= 1
+	if allowed {
+		entry.Tokens--
+	}
+	l.Store.Set(key, entry, l.Period)
+
+	reset := time.Duration((float64(l.Capacity) - entry.Tokens) / refillRate * float64(time.Second))
+	return allowed, int(entry.Tokens), reset
+}
+
+// BackoffLimiter slows down repeated failures for a key: after FreeAttempts
+// failures each further attempt must wait twice as long as the last, and
+// LockoutAttempts failures block the key for LockoutDuration.
+type BackoffLimiter struct {
+	Store           RateLimitStore
+	FreeAttempts    int
+	BaseDelay       time.Duration
+	MaxDelay        time.Duration
+	LockoutAttempts int
+	LockoutDuration time.Duration
+
+	mu sync.Mutex
+}
+
+// Wait returns how long key must wait before its next attempt
+func (l *BackoffLimiter) Wait(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry, ok := l.Store.Get(key)
+	if !ok {
+		return 0
+	}
+	if wait := time.Until(entry.BlockedUntil); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// Fail records a failed attempt for key
+func (l *BackoffLimiter) Fail(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	entry, _ := l.Store.Get(key)
+	entry.Failures++
+	entry.UpdatedAt = now
+
+	if entry.Failures >= l.LockoutAttempts {
+		entry.BlockedUntil = now.Add(l.LockoutDuration)
+	} else if entry.Failures > l.FreeAttempts {
+		delay := l.BaseDelay << uint(entry.Failures-l.FreeAttempts-1)
+		if delay > l.MaxDelay || delay <= 0 {
+			delay = l.MaxDelay
+		}
+		entry.BlockedUntil = now.Add(delay)
+	}
+
+	l.Store.Set(key, entry, l.LockoutDuration)
+}
+
+// Succeed clears the failures recorded for key
+func (l *BackoffLimiter) Succeed(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.Store.Delete(key)
+}
+
+var loginIPLimiter *BackoffLimiter
+var loginAccountLimiter *BackoffLimiter
+var apiRateLimiter *TokenBucketLimiter
+var sharePasswordLimiter *BackoffLimiter
+var sharePasswordIPLimiter *BackoffLimiter
+var passwordForgotIPLimiter *BackoffLimiter
+var passwordForgotEmailLimiter *BackoffLimiter
+
+func init() {
+	rateLimitSetup()
+}
+
+// rateLimitSetup builds the limiters with fresh in-memory state
+func rateLimitSetup() {
+	// Many users may share an IP, so it gets more room than a single account
+	loginIPLimiter = &BackoffLimiter{
+		Store:           NewMemoryRateLimitStore(),
+		FreeAttempts:    20,
+		BaseDelay:       time.Second,
+		MaxDelay:        5 * time.Minute,
+		LockoutAttempts: 100,
+		LockoutDuration: time.Hour,
+	}
+
+	loginAccountLimiter = &BackoffLimiter{
+		Store:           NewMemoryRateLimitStore(),
+		FreeAttempts:    3,
+		BaseDelay:       time.Second,
+		MaxDelay:        5 * time.Minute,
+		LockoutAttempts: 10,
+		LockoutDuration: 15 * time.Minute,
+	}
+
+	// Share passwords are guessed per share, so the share as a whole is
+	// locked out as well as each address trying it
+	sharePasswordLimiter = &BackoffLimiter{
+		Store:           NewMemoryRateLimitStore(),
+		FreeAttempts:    20,
+		BaseDelay:       time.Second,
+		MaxDelay:        5 * time.Minute,
+		LockoutAttempts: 100,
+		LockoutDuration: time.Hour,
+	}
+
+	sharePasswordIPLimiter = &BackoffLimiter{
+		Store:           NewMemoryRateLimitStore(),
+		FreeAttempts:    3,
+		BaseDelay:       time.Second,
+		MaxDelay:        5 * time.Minute,
+		LockoutAttempts: 10,
+		LockoutDuration: 15 * time.Minute,
+	}
+
+	// Every reset request counts, as each one may send mail. Addresses are
+	// throttled whether or not they belong to an account.
+	passwordForgotIPLimiter = &BackoffLimiter{
+		Store:           NewMemoryRateLimitStore(),
+		FreeAttempts:    10,
+		BaseDelay:       time.Second,
+		MaxDelay:        5 * time.Minute,
+		LockoutAttempts: 50,
+		LockoutDuration: time.Hour,
+	}
+
+	passwordForgotEmailLimiter = &BackoffLimiter{
+		Store:           NewMemoryRateLimitStore(),
+		FreeAttempts:    3,
+		BaseDelay:       time.Minute,
+		MaxDelay:        15 * time.Minute,
+		LockoutAttempts: 10,
+		LockoutDuration: time.Hour,
+	}
+
+	capacity := 120
+	if c, err := strconv.Atoi(os.Getenv("GRAYNOTE_RATE_LIMIT")); err == nil && c > 0 {
+		capacity = c
+	}
+	apiRateLimiter = &TokenBucketLimiter{
+		Store:    NewMemoryRateLimitStore(),
+		Capacity: capacity,
+		Period:   time.Minute,
+	}
+}
+
+// rateLimitMiddleware applies the token bucket to requests carrying
+// credentials. Buckets belong to the authenticated user, so every token and
+// API key of an account shares one; credentials that don't resolve to a user
+// share a bucket per client address, so made-up tokens can't dodge the limit.
+func rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.Header.Get("X-Auth-Token")) == 0 && len(sessionAuthToken(r)) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		bucket := "ip:" + clientIP(r)
+		if user, _ := requestUser(r); user != nil {
+			bucket = "user:" + strconv.Itoa(user.ID)
+		}
+
+		allowed, remaining, reset := apiRateLimiter.Take(bucket)
+		resetSeconds := int(math.Ceil(reset.Seconds()))
+
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(apiRateLimiter.Capacity))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(resetSeconds))
+
+		if !allowed {
+			retryAfter := apiRateLimiter.Period.Seconds() / float64(apiRateLimiter.Capacity)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter))))
+			apiErrorHandler(w, r, http.StatusTooManyRequests, []APIError{{Field: "rate_limit", Message: "exceeded"}})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketLimiter(t *testing.T) {
+	limiter := &TokenBucketLimiter{Store: NewMemoryRateLimitStore(), Capacity: 2, Period: time.Minute}
+
+	if allowed, remaining, _ := limiter.Take("key"); !allowed || remaining != 1 {
+		t.Errorf("Expected first request allowed with 1 remaining, got %v %d", allowed, remaining)
+	}
+	if allowed, remaining, _ := limiter.Take("key"); !allowed || remaining != 0 {
+		t.Errorf("Expected second request allowed with 0 remaining, got %v %d", allowed, remaining)
+	}
+	if allowed, _, _ := limiter.Take("key"); allowed {
+		t.Errorf("Expected third request to be limited")
+	}
+	if allowed, _, _ := limiter.Take("other"); !allowed {
+		t.Errorf("Expected other key to be allowed")
+	}
+}
+
+func TestBackoffLimiter(t *testing.T) {
+	limiter := &BackoffLimiter{
+		Store:           NewMemoryRateLimitStore(),
+		FreeAttempts:    1,
+		BaseDelay:       time.Second,
+		MaxDelay:        time.Minute,
+		LockoutAttempts: 4,
+		LockoutDuration: time.Hour,
+	}
+
+	limiter.Fail("key")
+	if wait := limiter.Wait("key"); wait != 0 {
+		t.Errorf("Expected no wait after a free attempt, got %s", wait)
+	}
+
+	limiter.Fail("key")
+	if wait := limiter.Wait("key"); wait <= 0 || wait > time.Second {
+		t.Errorf("Expected a one second wait, got %s", wait)
+	}
+
+	limiter.Fail("key")
+	if wait := limiter.Wait("key"); wait <= time.Second || wait > 2*time.Second {
+		t.Errorf("Expected a two second wait, got %s", wait)
+	}
+
+	limiter.Fail("key")
+	if wait := limiter.Wait("key"); wait <= time.Minute {
+		t.Errorf("Expected a lockout, got %s", wait)
+	}
+
+	limiter.Succeed("key")
+	if wait := limiter.Wait("key"); wait != 0 {
+		t.Errorf("Expected success to clear the wait, got %s", wait)
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	apiRateLimiter.Capacity = 1
+	user := factoryCreateUser("user@site.com")
+
+	r, _ := http.NewRequest("GET", "/notes", nil)
+	r.Header.Add("X-Auth-Token", user.AuthToken)
+	w := httptest.NewRecorder()
+
+	router().ServeHTTP(w, r)
+
+	if w.Code != 200 {
+		t.Errorf("Expected 200, got %d", w.Code)
+	}
+	if l := w.Header().Get("RateLimit-Limit"); l != "1" {
+		t.Errorf("Expected RateLimit-Limit 1, got %q", l)
+	}
+	if rem := w.Header().Get("RateLimit-Remaining"); rem != "0" {
+		t.Errorf("Expected RateLimit-Remaining 0, got %q", rem)
+	}
+
+	w = httptest.NewRecorder()
+	router().ServeHTTP(w, r)
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429, got %d", w.Code)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/notes", nil)
+	r.RemoteAddr = "10.0.0.2:4000"
+	r.Header.Add("X-Forwarded-For", "6.6.6.6, 203.0.113.7")
+	r.Header.Add("X-Forwarded-For", "10.0.0.1")
+
+	cases := map[string]string{
+		"":      "10.0.0.2",
+		"true":  "10.0.0.1",
+		"2":     "203.0.113.7",
+		"5":     "10.0.0.2",
+		"false": "10.0.0.2",
+	}
+	for trust, expected := range cases {
+		os.Setenv("GRAYNOTE_TRUST_PROXY", trust)
+		if ip := clientIP(r); ip != expected {
+			t.Errorf("Expected %q trusting %q, got %q", expected, trust, ip)
+		}
+	}
+	os.Unsetenv("GRAYNOTE_TRUST_PROXY")
+}
+
+func TestRateLimitMiddlewareInvalidTokens(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	apiRateLimiter.Capacity = 2
+	user := factoryCreateUser("user@site.com")
+
+	request := func(token string) int {
+		r, _ := http.NewRequest("GET", "/notes", nil)
+		r.RemoteAddr = "203.0.113.7:4000"
+		r.Header.Add("X-Auth-Token", token)
+		w := httptest.NewRecorder()
+		router().ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// A fresh made-up token each time still spends the address's tokens
+	var codes []int
+	for i := 0; i < 3; i++ {
+		codes = append(codes, request(randomToken()))
+	}
+	if codes[0] != 403 || codes[2] != 429 {
+		t.Errorf("Expected unknown tokens to be limited by address, got %v", codes)
+	}
+
+	// The user's own bucket is separate
+	if code := request(user.AuthToken); code != 200 {
+		t.Errorf("Expected 200 for the user, got %d", code)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+
+	"github.com/gorilla/sessions"
+)
+
+const (
+	sessionName       = "graynote_session"
+	csrfCookieName    = "graynote_csrf"
+	csrfHeaderName    = "X-CSRF-Token"
+	sessionAuthKey    = "auth_token"
+	sessionCsrfKey    = "csrf_token"
+	sessionMaxAgeDays = 30
+)
+
+var sessionStore *sessions.CookieStore
+
+func init() {
+	sessionSetup(os.Getenv("GRAYNOTE_SESSION_KEY"))
+}
+
+// sessionSetup configures cookie sessions signed with key. Cookies are only
+// sent over HTTPS unless GRAYNOTE_INSECURE_COOKIES is set for local development.
+func sessionSetup(key string) {
+	sessionStore = sessions.NewCookieStore([]byte(key))
+	sessionStore.Options = &sessions.Options{
+		Path:     "/",
+		MaxAge:   86400 * sessionMaxAgeDays,
+		HttpOnly: true,
+		Secure:   os.Getenv("GRAYNOTE_INSECURE_COOKIES") != "true",
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// apiStartSession signs user in with a session cookie and issues the CSRF
+// token browser clients echo back in the X-CSRF-Token header
+func apiStartSession(w http.ResponseWriter, r *http.Request, user *User) {
+	// Signing in again during the deletion grace period keeps the account
+	if user.DeletionRequestedAt != nil {
+		user.CancelDeletion()
+	}
+
+	session, _ := sessionStore.Get(r, sessionName)
+	csrfToken := randomToken()
+	session.Values[sessionAuthKey] = user.AuthToken
+	session.Values[sessionCsrfKey] = csrfToken
+
+	err := session.Save(r, w)
+	checkErr(err, "save session")
+
+	http.SetCookie(w, csrfCookie(csrfToken, sessionStore.Options.MaxAge))
+}
+
+// apiEndSession clears the session and CSRF cookies
+func apiEndSession(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, sessionName)
+	session.Values = map[interface{}]interface{}{}
+	session.Options.MaxAge = -1
+
+	err := session.Save(r, w)
+	checkErr(err, "clear session")
+
+	http.SetCookie(w, csrfCookie("", -1))
+}
+
+// csrfCookie is readable by scripts so clients can copy it into a header
+func csrfCookie(value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   sessionStore.Options.Secure,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// sessionAuthToken returns the auth token held in the session cookie, if any
+func sessionAuthToken(r *http.Request) string {
+	session, err := sessionStore.Get(r, sessionName)
+	if err != nil {
+		return ""
+	}
+
+	token, _ := session.Values[sessionAuthKey].(string)
+	return token
+}
+
+// validCsrfToken checks the X-CSRF-Token header matches both the CSRF cookie
+// and the value recorded in the signed session
+func validCsrfToken(r *http.Request) bool {
+	session, err := sessionStore.Get(r, sessionName)
+	if err != nil {
+		return false
+	}
+
+	expected, _ := session.Values[sessionCsrfKey].(string)
+	header := r.Header.Get(csrfHeaderName)
+	cookie, err := r.Cookie(csrfCookieName)
+	if err != nil || len(expected) == 0 {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(header), []byte(expected)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(expected)) == 1
+}
+
+func safeMethod(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
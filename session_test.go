@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// sessionLogin logs in with a password and returns the cookies set
+func sessionLogin(t *testing.T) []*http.Cookie {
+	r, _ := http.NewRequest("POST", "/users/login", strings.NewReader("email=user@site.com&password=password"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+	w := httptest.NewRecorder()
+
+	router().ServeHTTP(w, r)
+
+	if w.Code != 201 {
+		t.Fatalf("Expected 201, got %d", w.Code)
+	}
+	return w.Result().Cookies()
+}
+
+func findCookie(cookies []*http.Cookie, name string) *http.Cookie {
+	for _, cookie := range cookies {
+		if cookie.Name == name {
+			return cookie
+		}
+	}
+	return nil
+}
+
+func TestSessionLoginSetsCookies(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	factoryCreateUser("user@site.com")
+	cookies := sessionLogin(t)
+
+	session := findCookie(cookies, sessionName)
+	if session == nil {
+		t.Fatalf("Expected session cookie")
+	}
+	if !session.HttpOnly || !session.Secure || session.SameSite != http.SameSiteLaxMode {
+		t.Errorf("Expected session cookie to be HttpOnly, Secure and SameSite")
+	}
+
+	csrf := findCookie(cookies, csrfCookieName)
+	if csrf == nil || len(csrf.Value) == 0 || csrf.HttpOnly {
+		t.Errorf("Expected a script readable CSRF cookie")
+	}
+}
+
+func TestSessionAuthenticatesReads(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	createNote(user, "title", "body")
+	cookies := sessionLogin(t)
+
+	r, _ := http.NewRequest("GET", "/notes", nil)
+	r.AddCookie(findCookie(cookies, sessionName))
+	w := httptest.NewRecorder()
+
+	router().ServeHTTP(w, r)
+
+	if w.Code != 200 {
+		t.Errorf("Expected 200, got %d", w.Code)
+	}
+}
+
+func TestSessionRequiresCsrfForWrites(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	factoryCreateUser("user@site.com")
+	cookies := sessionLogin(t)
+	csrf := findCookie(cookies, csrfCookieName)
+
+	// Without the header
+	r, _ := http.NewRequest("POST", "/notes", strings.NewReader("title=title&body=body"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+	r.AddCookie(findCookie(cookies, sessionName))
+	r.AddCookie(csrf)
+	w := httptest.NewRecorder()
+
+	router().ServeHTTP(w, r)
+
+	if w.Code != 403 {
+		t.Errorf("Expected 403, got %d", w.Code)
+	}
+
+	// With the header
+	r, _ = http.NewRequest("POST", "/notes", strings.NewReader("title=title&body=body"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+	r.Header.Set(csrfHeaderName, csrf.Value)
+	r.AddCookie(findCookie(cookies, sessionName))
+	r.AddCookie(csrf)
+	w = httptest.NewRecorder()
+
+	router().ServeHTTP(w, r)
+
+	if w.Code != 201 {
+		t.Errorf("Expected 201, got %d", w.Code)
+	}
+}
+
+func TestSessionRevokedWithTokens(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	cookies := sessionLogin(t)
+	user.RevokeTokens()
+
+	r, _ := http.NewRequest("GET", "/notes", nil)
+	r.AddCookie(findCookie(cookies, sessionName))
+	w := httptest.NewRecorder()
+
+	router().ServeHTTP(w, r)
+
+	if w.Code != 403 {
+		t.Errorf("Expected 403, got %d", w.Code)
+	}
+}
+
+func TestUserLogoutHandlerClearsCookies(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	factoryCreateUser("user@site.com")
+	cookies := sessionLogin(t)
+
+	r, _ := http.NewRequest("POST", "/users/logout", nil)
+	r.AddCookie(findCookie(cookies, sessionName))
+	w := httptest.NewRecorder()
+
+	router().ServeHTTP(w, r)
+
+	if w.Code != 200 {
+		t.Errorf("Expected 200, got %d", w.Code)
+	}
+
+	cleared := w.Result().Cookies()
+	for _, name := range []string{sessionName, csrfCookieName} {
+		if cookie := findCookie(cleared, name); cookie == nil || cookie.MaxAge >= 0 {
+			t.Errorf("Expected %s cookie to be cleared", name)
+		}
+	}
+}
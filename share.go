@@ -2,38 +2,79 @@ package main
 
 import (
 	"crypto/md5"
+	"crypto/pbkdf2"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
+	"encoding/base64"
 	"encoding/hex"
 	"fmt"
 	"math/rand"
+	"strconv"
+	"strings"
 	"time"
 )
 
-// Share authenticates sharing of a note
+// Share authenticates sharing of a note. PasswordHash is empty unless the
+// share is password protected.
 type Share struct {
-	ID          int
-	NoteID      int
-	AuthKey     string
-	Permissions string
+	ID           int
+	NoteID       int
+	AuthKey      string
+	Permissions  string
+	ExpiresAt    *time.Time
+	MaxViews     int
+	Views        int
+	PasswordHash string
+	Label        string
+}
+
+// shareColumns lists shares columns in the order shareFromDbRows scans them
+const shareColumns = "id, auth_key, note_id, permissions, expires_at, max_views, views, password_hash, label"
+
+// shareActive is the condition for a share that can still be used. Shares
+// are suspended while their owner's account is pending deletion.
+const shareActive = "(expires_at IS NULL OR expires_at > ?) AND (max_views = 0 OR views < max_views) AND suspended = 0"
+
+// permissionLevels orders what shares, collaborators and owners may do.
+// Each level includes the ones below it.
+var permissionLevels = map[string]int{
+	"read":              1,
+	"comment":           2,
+	"readwrite":         3,
+	noteOwnerPermission: 4,
 }
 
 // ValidateSharePermission returns if permission string is valid
 func ValidateSharePermission(permissions string) bool {
-	return permissions == "readwrite" || permissions == "read"
+	return permissions == "readwrite" || permissions == "comment" || permissions == "read"
+}
+
+// permissionAllows returns if permissions include required
+func permissionAllows(permissions string, required string) bool {
+	level, ok := permissionLevels[permissions]
+	return ok && level >= permissionLevels[required]
 }
 
 func createShare(note *Note, permissions string) *Share {
+	return createLimitedShare(note, permissions, nil, 0)
+}
+
+// createLimitedShare creates a share that stops working after expiresAt, if
+// set, or once it has been viewed maxViews times, if above zero
+func createLimitedShare(note *Note, permissions string, expiresAt *time.Time, maxViews int) *Share {
 	if !ValidateSharePermission(permissions) {
 		return nil
 	}
 
-	stmt, err := db.Prepare("INSERT shares SET note_id=?, auth_key=?, permissions=?")
+	stmt, err := db.Prepare("INSERT shares SET note_id=?, auth_key=?, permissions=?, expires_at=?, max_views=?")
 	if err != nil {
 		checkErr(err, "prepare create share")
 	} else {
 		defer stmt.Close()
 	}
-	res, err := stmt.Exec(note.ID, randomShareKey(), permissions)
+	res, err := stmt.Exec(note.ID, randomShareKey(), permissions, expiresAt, maxViews)
 	checkErr(err, "create share")
 
 	shareID, _ := res.LastInsertId()
@@ -42,7 +83,7 @@ func createShare(note *Note, permissions string) *Share {
 
 func findShareByID(id int64) *Share {
 	var share *Share
-	rows, err := db.Query("SELECT * FROM shares WHERE id=?", id)
+	rows, err := db.Query("SELECT "+shareColumns+" FROM shares WHERE id=?", id)
 	if err != nil {
 		checkErr(err, "find share by id")
 	} else {
@@ -56,9 +97,11 @@ func findShareByID(id int64) *Share {
 	return share
 }
 
+// findShareByAuthKey returns the share for authKey unless it has expired or
+// used up its views
 func findShareByAuthKey(authKey string) *Share {
 	var share *Share
-	rows, err := db.Query("SELECT * FROM shares WHERE auth_key=?", authKey)
+	rows, err := db.Query("SELECT "+shareColumns+" FROM shares WHERE auth_key=? AND "+shareActive, authKey, time.Now().UTC())
 	if err != nil {
 		checkErr(err, "find share by auth key")
 	} else {
@@ -72,6 +115,125 @@ func findShareByAuthKey(authKey string) *Share {
 	return share
 }
 
+// findAnyShareByAuthKey returns the share for authKey even if it can no
+// longer be used, so its owner can still manage it
+func findAnyShareByAuthKey(authKey string) *Share {
+	var share *Share
+	rows, err := db.Query("SELECT "+shareColumns+" FROM shares WHERE auth_key=?", authKey)
+	if err != nil {
+		checkErr(err, "find any share by auth key")
+	} else {
+		defer rows.Close()
+	}
+
+	if rows.Next() {
+		share = shareFromDbRows(rows)
+	}
+
+	return share
+}
+
+// RecordView counts a view of the share. It returns false, without counting,
+// if the share expired or used up its views since it was found.
+func (s *Share) RecordView() bool {
+	res, err := db.Exec("UPDATE shares SET views=views+1 WHERE id=? AND "+shareActive, s.ID, time.Now().UTC())
+	checkErr(err, "record share view")
+
+	if affected, _ := res.RowsAffected(); affected != 1 {
+		return false
+	}
+	s.Views++
+	return true
+}
+
+// SetPassword protects the share with password, or removes the protection
+// if password is empty. Existing share sessions end either way.
+func (s *Share) SetPassword(password string) {
+	s.PasswordHash = ""
+	if len(password) > 0 {
+		s.PasswordHash = sharePasswordHash(password)
+	}
+
+	_, err := db.Exec("UPDATE shares SET password_hash=? WHERE id=?", s.PasswordHash, s.ID)
+	checkErr(err, "set share password")
+
+	_, err = db.Exec("DELETE FROM share_sessions WHERE share_id=?", s.ID)
+	checkErr(err, "end share sessions")
+}
+
+// Protected returns if the share needs a password
+func (s Share) Protected() bool {
+	return len(s.PasswordHash) > 0
+}
+
+// ValidPassword returns if password unlocks the share. Shares protected
+// before passwords were salted still hold a bare MD5 hash.
+func (s Share) ValidPassword(password string) bool {
+	if !s.Protected() {
+		return false
+	}
+
+	parts := strings.Split(s.PasswordHash, "$")
+	if len(parts) != 4 || parts[0] != sharePasswordScheme {
+		return subtle.ConstantTimeCompare([]byte(passwordToHash(password)), []byte(s.PasswordHash)) == 1
+	}
+
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+
+	key, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(expected))
+	return err == nil && subtle.ConstantTimeCompare(key, expected) == 1
+}
+
+// sharePasswordScheme names the KDF share passwords are hashed with
+const sharePasswordScheme = "pbkdf2-sha256"
+
+// sharePasswordIterations is the PBKDF2 work factor for new share passwords
+const sharePasswordIterations = 600000
+
+// sharePasswordHash hashes password with PBKDF2 and a random salt, as
+// "pbkdf2-sha256$<iterations>$<salt>$<key>"
+func sharePasswordHash(password string) string {
+	salt := make([]byte, 16)
+	_, err := cryptorand.Read(salt)
+	checkErr(err, "share password salt")
+
+	key, err := pbkdf2.Key(sha256.New, password, salt, sharePasswordIterations, sha256.Size)
+	checkErr(err, "share password hash")
+
+	return strings.Join([]string{
+		sharePasswordScheme,
+		strconv.Itoa(sharePasswordIterations),
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	}, "$")
+}
+
+// Update changes the permissions, label and limits of a share, keeping its key
+func (s *Share) Update(permissions string, label string, expiresAt *time.Time, maxViews int) {
+	s.Permissions, s.Label, s.ExpiresAt, s.MaxViews = permissions, label, expiresAt, maxViews
+
+	_, err := db.Exec(
+		"UPDATE shares SET permissions=?, label=?, expires_at=?, max_views=? WHERE id=?",
+		permissions, label, expiresAt, maxViews, s.ID)
+	checkErr(err, "update share")
+}
+
+// Expired returns if the share has passed its expiry or used up its views
+func (s Share) Expired() bool {
+	return (s.ExpiresAt != nil && !s.ExpiresAt.After(time.Now())) || (s.MaxViews > 0 && s.Views >= s.MaxViews)
+}
+
 // Destroy a share from database
 func (s Share) Destroy() {
 	stmt, err := db.Prepare("DELETE FROM shares WHERE id=?")
@@ -83,11 +245,14 @@ func (s Share) Destroy() {
 
 	_, err = stmt.Exec(s.ID)
 	checkErr(err, "delete share")
+
+	_, err = db.Exec("DELETE FROM share_sessions WHERE share_id=?", s.ID)
+	checkErr(err, "delete share sessions")
 }
 
 func shareFromDbRows(rows *sql.Rows) *Share {
 	share := new(Share)
-	rows.Scan(&share.ID, &share.AuthKey, &share.NoteID, &share.Permissions)
+	rows.Scan(&share.ID, &share.AuthKey, &share.NoteID, &share.Permissions, &share.ExpiresAt, &share.MaxViews, &share.Views, &share.PasswordHash, &share.Label)
 	return share
 }
 
@@ -101,7 +266,7 @@ func randomShareKey() string {
 }
 
 func findSharesByNote(note Note) []*Share {
-	rows, err := db.Query("SELECT * FROM shares WHERE note_id=?", note.ID)
+	rows, err := db.Query("SELECT "+shareColumns+" FROM shares WHERE note_id=?", note.ID)
 	if err != nil {
 		checkErr(err, "find share by note id")
 	} else {
@@ -116,3 +281,34 @@ func findSharesByNote(note Note) []*Share {
 
 	return shares
 }
+
+// findSharesByUser returns every share of the user's notes, expired or not
+func findSharesByUser(user *User) []*Share {
+	rows, err := db.Query(
+		"SELECT "+shareColumns+" FROM shares WHERE note_id IN (SELECT id FROM notes WHERE user_id=?) ORDER BY id",
+		user.ID)
+	if err != nil {
+		checkErr(err, "find shares by user")
+	} else {
+		defer rows.Close()
+	}
+
+	var shares []*Share
+	for rows.Next() {
+		shares = append(shares, shareFromDbRows(rows))
+	}
+
+	return shares
+}
+
+// destroySharesByNote revokes every share of note and returns how many there were
+func destroySharesByNote(note *Note) int64 {
+	_, err := db.Exec("DELETE FROM share_sessions WHERE share_id IN (SELECT id FROM shares WHERE note_id=?)", note.ID)
+	checkErr(err, "delete note share sessions")
+
+	res, err := db.Exec("DELETE FROM shares WHERE note_id=?", note.ID)
+	checkErr(err, "delete note shares")
+
+	revoked, _ := res.RowsAffected()
+	return revoked
+}
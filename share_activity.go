@@ -0,0 +1,256 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Share activity actions
+const (
+	shareActionView    = "view"
+	shareActionUpdate  = "update"
+	shareActionPatch   = "patch"
+	shareActionDelta   = "delta"
+	shareActionUnlock  = "unlock"
+	shareActionComment = "comment"
+	shareActionDenied  = "denied"
+)
+
+// Default retention of share activity. IP hashes are dropped well before the
+// rest of the entry.
+const (
+	defaultShareActivityRetention   = 90 * 24 * time.Hour
+	defaultShareActivityIPRetention = 7 * 24 * time.Hour
+)
+
+// shareKeyPrefixLength is how much of the share key is kept with each entry,
+// enough to recognise a share after it has been revoked
+const shareKeyPrefixLength = 8
+
+// ShareActivity records one use of a share key. Version is the note version
+// the request saw or produced. IPHash is empty once the IP retention passes.
+type ShareActivity struct {
+	ID        int
+	ShareID   int
+	NoteID    int
+	KeyPrefix string
+	Action    string
+	Status    int
+	Client    string
+	IPHash    string
+	Version   int
+	CreatedAt time.Time
+}
+
+const shareActivityColumns = "id, share_id, note_id, key_prefix, action, status, client, ip_hash, version, created_at"
+
+// shareActivityRetention reads GRAYNOTE_SHARE_ACTIVITY_RETENTION
+func shareActivityRetention() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("GRAYNOTE_SHARE_ACTIVITY_RETENTION")); err == nil && d > 0 {
+		return d
+	}
+	return defaultShareActivityRetention
+}
+
+// shareActivityIPRetention reads GRAYNOTE_SHARE_ACTIVITY_IP_RETENTION
+func shareActivityIPRetention() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("GRAYNOTE_SHARE_ACTIVITY_IP_RETENTION")); err == nil && d > 0 {
+		return d
+	}
+	return defaultShareActivityIPRetention
+}
+
+// recordShareActivity logs a request made with share. version is the note
+// version involved, or zero if the request was refused before reading it.
+func recordShareActivity(r *http.Request, share *Share, action string, status int, version int) {
+	keyPrefix := share.AuthKey
+	if len(keyPrefix) > shareKeyPrefixLength {
+		keyPrefix = keyPrefix[:shareKeyPrefixLength]
+	}
+
+	_, err := db.Exec(
+		"INSERT share_activity SET share_id=?, note_id=?, key_prefix=?, action=?, status=?, client=?, ip_hash=?, version=?, created_at=?",
+		share.ID,
+		share.NoteID,
+		keyPrefix,
+		action,
+		status,
+		coarseClient(r.UserAgent()),
+		hashIP(clientIP(r)),
+		version,
+		time.Now().UTC())
+	checkErr(err, "record share activity")
+}
+
+func findShareActivityByShare(share *Share, limit int) []*ShareActivity {
+	rows, err := db.Query(
+		"SELECT "+shareActivityColumns+" FROM share_activity WHERE share_id=? ORDER BY id DESC LIMIT ?",
+		share.ID,
+		limit)
+	if err != nil {
+		checkErr(err, "find share activity")
+	} else {
+		defer rows.Close()
+	}
+
+	var activity []*ShareActivity
+	for rows.Next() {
+		activity = append(activity, shareActivityFromDbRows(rows))
+	}
+	return activity
+}
+
+func shareActivityFromDbRows(rows *sql.Rows) *ShareActivity {
+	var ipHash sql.NullString
+	activity := new(ShareActivity)
+	rows.Scan(
+		&activity.ID,
+		&activity.ShareID,
+		&activity.NoteID,
+		&activity.KeyPrefix,
+		&activity.Action,
+		&activity.Status,
+		&activity.Client,
+		&ipHash,
+		&activity.Version,
+		&activity.CreatedAt)
+	activity.IPHash = ipHash.String
+	return activity
+}
+
+// ShareActivitySummary totals the activity of one share of a note. Denied
+// counts refused requests, including wrong passwords.
+type ShareActivitySummary struct {
+	ShareID      int
+	KeyPrefix    string
+	Views        int
+	Updates      int
+	Denied       int
+	LastVersion  int
+	LastAccessAt time.Time
+}
+
+// summarizeShareActivity totals activity per share of note, including shares
+// that have since been revoked
+func summarizeShareActivity(note *Note) []*ShareActivitySummary {
+	rows, err := db.Query(
+		"SELECT share_id, MAX(key_prefix), "+
+			"SUM(CASE WHEN action = ? THEN 1 ELSE 0 END), "+
+			"SUM(CASE WHEN action IN (?, ?, ?) THEN 1 ELSE 0 END), "+
+			"SUM(CASE WHEN status >= 400 THEN 1 ELSE 0 END), "+
+			"MAX(version), MAX(created_at) "+
+			"FROM share_activity WHERE note_id=? GROUP BY share_id ORDER BY share_id",
+		shareActionView,
+		shareActionUpdate, shareActionPatch, shareActionDelta,
+		note.ID)
+	if err != nil {
+		checkErr(err, "summarize share activity")
+	} else {
+		defer rows.Close()
+	}
+
+	var summaries []*ShareActivitySummary
+	for rows.Next() {
+		summary := new(ShareActivitySummary)
+		rows.Scan(
+			&summary.ShareID,
+			&summary.KeyPrefix,
+			&summary.Views,
+			&summary.Updates,
+			&summary.Denied,
+			&summary.LastVersion,
+			&summary.LastAccessAt)
+		summaries = append(summaries, summary)
+	}
+	return summaries
+}
+
+// hashIP keys the hash with GRAYNOTE_IP_HASH_KEY, or the session key, so
+// the small IPv4 space can't be brute forced from the log alone
+func hashIP(ip string) string {
+	key := os.Getenv("GRAYNOTE_IP_HASH_KEY")
+	if len(key) == 0 {
+		key = os.Getenv("GRAYNOTE_SESSION_KEY")
+	}
+
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(ip))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// clientFamilies maps User-Agent fragments to the coarse client recorded,
+// checked in order as browsers name their relatives
+var clientFamilies = []struct {
+	fragment string
+	name     string
+}{
+	{"Edg/", "Edge"},
+	{"OPR/", "Opera"},
+	{"Firefox/", "Firefox"},
+	{"Chrome/", "Chrome"},
+	{"Safari/", "Safari"},
+	{"curl/", "curl"},
+	{"Go-http-client", "Go"},
+	{"python", "Python"},
+}
+
+var clientPlatforms = []struct {
+	fragment string
+	name     string
+}{
+	{"Android", "Android"},
+	{"iPhone", "iOS"},
+	{"iPad", "iOS"},
+	{"Windows", "Windows"},
+	{"Mac OS X", "macOS"},
+	{"Linux", "Linux"},
+}
+
+// coarseClient reduces a User-Agent to a browser family and platform, such
+// as "Firefox on Linux", without versions that could fingerprint a visitor
+func coarseClient(userAgent string) string {
+	client := "Other"
+	for _, family := range clientFamilies {
+		if strings.Contains(userAgent, family.fragment) {
+			client = family.name
+			break
+		}
+	}
+	for _, platform := range clientPlatforms {
+		if strings.Contains(userAgent, platform.fragment) {
+			return client + " on " + platform.name
+		}
+	}
+	return client
+}
+
+// purgeShareActivity drops IP hashes past their retention and entries past
+// theirs, returning how many entries were removed
+func purgeShareActivity() int64 {
+	now := time.Now().UTC()
+
+	_, err := db.Exec("UPDATE share_activity SET ip_hash=NULL WHERE ip_hash IS NOT NULL AND created_at < ?", now.Add(-shareActivityIPRetention()))
+	checkErr(err, "expire share activity ip hashes")
+
+	res, err := db.Exec("DELETE FROM share_activity WHERE created_at < ?", now.Add(-shareActivityRetention()))
+	checkErr(err, "purge share activity")
+
+	purged, _ := res.RowsAffected()
+	return purged
+}
+
+// sweepShareActivity applies the retention policy every interval
+func sweepShareActivity(interval time.Duration) {
+	for range time.Tick(interval) {
+		if purged := purgeShareActivity(); purged > 0 {
+			log.Printf("purged %d share activity entries", purged)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Default and largest number of entries shareActivityHandler returns
+const (
+	defaultShareActivityLimit = 100
+	maxShareActivityLimit     = 500
+)
+
+type shareActivitySuccessResponse struct {
+	Action    string    `json:"action"`
+	Status    int       `json:"status"`
+	Client    string    `json:"client"`
+	IPHash    string    `json:"ip_hash,omitempty"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type shareActivitySummaryResponse struct {
+	KeyPrefix    string    `json:"key_prefix"`
+	Revoked      bool      `json:"revoked"`
+	Views        int       `json:"views"`
+	Updates      int       `json:"updates"`
+	Denied       int       `json:"denied"`
+	LastVersion  int       `json:"last_version"`
+	LastAccessAt time.Time `json:"last_access_at"`
+}
+
+// shareActivityHandler lists the most recent uses of a share key, newest
+// first. limit caps the number of entries.
+func shareActivityHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Authenticate
+	user := apiAuthenticateUser(r)
+	if user == nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	share := apiOwnedShare(w, r, user)
+	if share == nil {
+		return
+	}
+
+	limit := defaultShareActivityLimit
+	if raw := r.URL.Query().Get("limit"); len(raw) > 0 {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 1 {
+			apiErrorHandler(w, r, http.StatusBadRequest, []APIError{{Field: "limit", Message: "is invalid"}})
+			return
+		}
+		if parsed < maxShareActivityLimit {
+			limit = parsed
+		} else {
+			limit = maxShareActivityLimit
+		}
+	}
+
+	response := []shareActivitySuccessResponse{}
+	for _, activity := range findShareActivityByShare(share, limit) {
+		response = append(response, shareActivitySuccessResponse{
+			Action:    activity.Action,
+			Status:    activity.Status,
+			Client:    activity.Client,
+			IPHash:    activity.IPHash,
+			Version:   activity.Version,
+			CreatedAt: activity.CreatedAt})
+	}
+	responseJSON, _ := json.Marshal(response)
+	w.Write(responseJSON)
+}
+
+// noteShareActivityHandler totals share key use per share of a note,
+// including shares that have since been revoked
+func noteShareActivityHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Authenticate
+	user := apiAuthenticateUser(r)
+	if user == nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	note := apiOwnedNote(w, r, user)
+	if note == nil {
+		return
+	}
+
+	response := []shareActivitySummaryResponse{}
+	for _, summary := range summarizeShareActivity(note) {
+		response = append(response, shareActivitySummaryResponse{
+			KeyPrefix:    summary.KeyPrefix,
+			Revoked:      findShareByID(int64(summary.ShareID)) == nil,
+			Views:        summary.Views,
+			Updates:      summary.Updates,
+			Denied:       summary.Denied,
+			LastVersion:  summary.LastVersion,
+			LastAccessAt: summary.LastAccessAt})
+	}
+	responseJSON, _ := json.Marshal(response)
+	w.Write(responseJSON)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func shareKeyRequest(method string, path string, body string) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0")
+	w := httptest.NewRecorder()
+	router().ServeHTTP(w, r)
+	return w
+}
+
+func TestShareActivityHandler(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	note := createNote(user, "title", "body")
+	share := createShare(note, "readwrite")
+
+	path := fmt.Sprintf("/notes/%s", share.AuthKey)
+	shareKeyRequest("GET", path, "")
+	shareKeyRequest("PUT", path, "title=title&body=changed")
+
+	w := shareManageRequest("GET", fmt.Sprintf("/shares/%s/activity", share.AuthKey), user.AuthToken, "", "")
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+
+	var activity []shareActivitySuccessResponse
+	json.Unmarshal(w.Body.Bytes(), &activity)
+	if len(activity) != 2 {
+		t.Fatalf("Expected 2 entries, got %s", w.Body.String())
+	}
+	if a := activity[0]; a.Action != "update" || a.Status != 200 || a.Version != note.Version+1 {
+		t.Errorf("Unexpected update entry %+v", a)
+	}
+	if a := activity[1]; a.Action != "view" || a.Version != note.Version || a.Client != "Firefox on Linux" || len(a.IPHash) == 0 {
+		t.Errorf("Unexpected view entry %+v", a)
+	}
+
+	w = shareManageRequest("GET", fmt.Sprintf("/shares/%s/activity?limit=1", share.AuthKey), user.AuthToken, "", "")
+	json.Unmarshal(w.Body.Bytes(), &activity)
+	if len(activity) != 1 {
+		t.Errorf("Expected limit to apply, got %s", w.Body.String())
+	}
+
+	other := factoryCreateUser("other@site.com")
+	w = shareManageRequest("GET", fmt.Sprintf("/shares/%s/activity", share.AuthKey), other.AuthToken, "", "")
+	if w.Code != 404 {
+		t.Errorf("Expected 404 for another user, got %d", w.Code)
+	}
+}
+
+func TestNoteShareActivityHandler(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	note := createNote(user, "title", "body")
+	readShare := createShare(note, "read")
+	writeShare := createShare(note, "readwrite")
+
+	shareKeyRequest("GET", fmt.Sprintf("/notes/%s", readShare.AuthKey), "")
+	shareKeyRequest("PUT", fmt.Sprintf("/notes/%s", readShare.AuthKey), "title=title&body=changed")
+	shareKeyRequest("PUT", fmt.Sprintf("/notes/%s", writeShare.AuthKey), "title=title&body=changed")
+	readShare.Destroy()
+
+	w := shareManageRequest("GET", fmt.Sprintf("/notes/%d/share-activity", note.ID), user.AuthToken, "", "")
+
+	var summaries []shareActivitySummaryResponse
+	json.Unmarshal(w.Body.Bytes(), &summaries)
+	if len(summaries) != 2 {
+		t.Fatalf("Expected 2 summaries, got %s", w.Body.String())
+	}
+	if s := summaries[0]; !s.Revoked || s.KeyPrefix != readShare.AuthKey[:shareKeyPrefixLength] || s.Views != 1 || s.Denied != 1 || s.Updates != 0 {
+		t.Errorf("Unexpected read share summary %+v", s)
+	}
+	if s := summaries[1]; s.Revoked || s.Updates != 1 || s.LastVersion != note.Version+1 {
+		t.Errorf("Unexpected readwrite share summary %+v", s)
+	}
+}
+
+func TestPurgeShareActivity(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	note := createNote(user, "title", "body")
+	share := createShare(note, "read")
+	shareKeyRequest("GET", fmt.Sprintf("/notes/%s", share.AuthKey), "")
+
+	db.Exec("UPDATE share_activity SET created_at=?", time.Now().UTC().Add(-defaultShareActivityIPRetention-time.Hour))
+	purgeShareActivity()
+
+	activity := findShareActivityByShare(share, 10)
+	if len(activity) != 1 || len(activity[0].IPHash) != 0 {
+		t.Fatalf("Expected the IP hash to be dropped, got %+v", activity)
+	}
+
+	db.Exec("UPDATE share_activity SET created_at=?", time.Now().UTC().Add(-defaultShareActivityRetention-time.Hour))
+	if purged := purgeShareActivity(); purged != 1 {
+		t.Errorf("Expected 1 entry purged, got %d", purged)
+	}
+}
+
+func TestCoarseClient(t *testing.T) {
+	clients := map[string]string{
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36":               "Chrome on Windows",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Safari/604.1": "Safari on iOS",
+		"Mozilla/5.0 (Windows NT 10.0) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36 Edg/120.0":                 "Edge on Windows",
+		"curl/8.4.0": "curl",
+		"":           "Other",
+	}
+	for userAgent, expected := range clients {
+		if client := coarseClient(userAgent); client != expected {
+			t.Errorf("Expected %q for %q, got %q", expected, userAgent, client)
+		}
+	}
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"encoding/json"
+	"mime"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/schema"
@@ -11,17 +14,31 @@ import (
 type shareRequestParameters struct {
 	NoteID      int    `schema:"note_id"`
 	Permissions string `schema:"permissions"`
+	ExpiresAt   string `schema:"expires_at"`
+	MaxViews    string `schema:"max_views"`
+	Password    string `schema:"password"`
+	Label       string `schema:"label"`
 }
 
 type shareSuccessResponse struct {
-	AuthKey     string `json:"auth_key"`
-	NoteID      int    `json:"note_id"`
-	Permissions string `json:"permissions"`
+	AuthKey     string     `json:"auth_key"`
+	NoteID      int        `json:"note_id"`
+	Permissions string     `json:"permissions"`
+	Label       string     `json:"label,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	MaxViews    int        `json:"max_views,omitempty"`
+	Views       int        `json:"views,omitempty"`
+	Expired     bool       `json:"expired,omitempty"`
+	Protected   bool       `json:"password_protected,omitempty"`
+}
+
+type shareSessionSuccessResponse struct {
+	ShareToken string    `json:"share_token"`
+	ExpiresAt  time.Time `json:"expires_at"`
 }
 
 func shareCreateHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	apiApplyCorsHeaders(w, r)
 
 	// Authenticate
 	user := apiAuthenticateUser(r)
@@ -30,6 +47,14 @@ func shareCreateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !apiRequireScope(w, r, user, scopeSharesManage) {
+		return
+	}
+
+	if !apiRequireVerified(w, r, user, actionCreateShares) {
+		return
+	}
+
 	err := r.ParseForm()
 	checkErr(err, "parsing form")
 
@@ -45,6 +70,10 @@ func shareCreateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !apiRequireNote(w, r, user, note.ID) {
+		return
+	}
+
 	var errors []APIError
 
 	// Valdiate Permissions
@@ -54,22 +83,184 @@ func shareCreateHandler(w http.ResponseWriter, r *http.Request) {
 		errors = append(errors, APIError{Field: "permissions", Message: "is invalid"})
 	}
 
+	// Validate Expiry
+	var expiresAt *time.Time
+	if len(shareParameters.ExpiresAt) > 0 {
+		t, err := time.Parse(time.RFC3339, shareParameters.ExpiresAt)
+		if err != nil || !t.After(time.Now()) {
+			errors = append(errors, APIError{Field: "expires_at", Message: "is invalid"})
+		} else {
+			t = t.UTC().Truncate(time.Second)
+			expiresAt = &t
+		}
+	}
+
+	// Validate Max Views
+	var maxViews int
+	if len(shareParameters.MaxViews) > 0 {
+		maxViews, err = strconv.Atoi(shareParameters.MaxViews)
+		if err != nil || maxViews < 1 {
+			errors = append(errors, APIError{Field: "max_views", Message: "is invalid"})
+		}
+	}
+
+	// Validate Label
+	if len(shareParameters.Label) > 255 {
+		errors = append(errors, APIError{Field: "label", Message: "is too long"})
+	}
+
 	if len(errors) > 0 {
 		apiErrorHandler(w, r, http.StatusBadRequest, errors)
 		return
 	}
 
 	// Create Share
-	share := createShare(note, shareParameters.Permissions)
+	share := createLimitedShare(note, shareParameters.Permissions, expiresAt, maxViews)
+	if len(shareParameters.Password) > 0 {
+		share.SetPassword(shareParameters.Password)
+	}
+	if len(shareParameters.Label) > 0 {
+		share.Update(share.Permissions, shareParameters.Label, share.ExpiresAt, share.MaxViews)
+	}
 
 	// Success message
 	w.WriteHeader(http.StatusCreated)
 	w.Write(shareJSON(share))
 }
 
+// shareIndexHandler lists the shares of all the user's notes, including
+// expired ones. note_id narrows the list to one note.
+func shareIndexHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Authenticate
+	user := apiAuthenticateUser(r)
+	if user == nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if !apiRequireScope(w, r, user, scopeSharesManage) {
+		return
+	}
+
+	noteID, _ := strconv.Atoi(r.URL.Query().Get("note_id"))
+
+	response := []shareSuccessResponse{}
+	for _, share := range findSharesByUser(user) {
+		if !user.AllowsNote(share.NoteID) || (noteID > 0 && share.NoteID != noteID) {
+			continue
+		}
+		response = append(response, shareResponse(share))
+	}
+	responseJSON, _ := json.Marshal(response)
+	w.Write(responseJSON)
+}
+
+func shareShowHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Authenticate
+	user := apiAuthenticateUser(r)
+	if user == nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	share := apiOwnedShare(w, r, user)
+	if share == nil {
+		return
+	}
+
+	w.Write(shareJSON(share))
+}
+
+// shareUpdateHandler changes the permissions, label or expiry of a share
+// without changing its key. The body is a JSON Merge Patch; null clears the
+// label, expires_at or max_views.
+func shareUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Authenticate
+	user := apiAuthenticateUser(r)
+	if user == nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	share := apiOwnedShare(w, r, user)
+	if share == nil {
+		return
+	}
+
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType != mergePatchContentType && contentType != "application/json" {
+		w.Header().Set("Accept-Patch", mergePatchContentType)
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var patch map[string]json.RawMessage
+	r.Body = http.MaxBytesReader(w, r.Body, maxNotePatchBytes)
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil || patch == nil {
+		apiErrorHandler(w, r, http.StatusBadRequest, []APIError{{Field: "patch", Message: "is invalid"}})
+		return
+	}
+
+	permissions, label, expiresAt, maxViews := share.Permissions, share.Label, share.ExpiresAt, share.MaxViews
+	var errors []APIError
+
+	// Validate Permissions
+	if value, ok := patch["permissions"]; ok {
+		if json.Unmarshal(value, &permissions) != nil || !ValidateSharePermission(permissions) {
+			errors = append(errors, APIError{Field: "permissions", Message: "is invalid"})
+		}
+	}
+
+	// Validate Label
+	if value, ok := patch["label"]; ok {
+		label = ""
+		if string(value) != "null" && json.Unmarshal(value, &label) != nil {
+			errors = append(errors, APIError{Field: "label", Message: "is invalid"})
+		} else if len(label) > 255 {
+			errors = append(errors, APIError{Field: "label", Message: "is too long"})
+		}
+	}
+
+	// Validate Expiry
+	if value, ok := patch["expires_at"]; ok {
+		expiresAt = nil
+		if string(value) != "null" {
+			var t time.Time
+			if json.Unmarshal(value, &t) != nil || !t.After(time.Now()) {
+				errors = append(errors, APIError{Field: "expires_at", Message: "is invalid"})
+			} else {
+				t = t.UTC().Truncate(time.Second)
+				expiresAt = &t
+			}
+		}
+	}
+
+	// Validate Max Views
+	if value, ok := patch["max_views"]; ok {
+		maxViews = 0
+		if string(value) != "null" && (json.Unmarshal(value, &maxViews) != nil || maxViews < 1) {
+			errors = append(errors, APIError{Field: "max_views", Message: "is invalid"})
+		}
+	}
+
+	if len(errors) > 0 {
+		apiErrorHandler(w, r, http.StatusBadRequest, errors)
+		return
+	}
+
+	share.Update(permissions, label, expiresAt, maxViews)
+
+	w.Write(shareJSON(share))
+}
+
 func shareDeleteHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	apiApplyCorsHeaders(w, r)
 
 	// Authenticate
 	user := apiAuthenticateUser(r)
@@ -78,14 +269,54 @@ func shareDeleteHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Fetch Share by AuthKey
-	shareAuthKey := mux.Vars(r)["id"]
-	share := findShareByAuthKey(shareAuthKey)
+	share := apiOwnedShare(w, r, user)
+	if share == nil {
+		return
+	}
+
+	// Delete the Share
+	share.Destroy()
+
+	w.Write([]byte("{}"))
+}
+
+// noteSharesDeleteHandler revokes every share of a note at once
+func noteSharesDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Authenticate
+	user := apiAuthenticateUser(r)
+	if user == nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	note := apiOwnedNote(w, r, user)
+	if note == nil {
+		return
+	}
+
+	revoked := destroySharesByNote(note)
+
+	responseJSON, _ := json.Marshal(map[string]int64{"revoked": revoked})
+	w.Write(responseJSON)
+}
+
+// apiOwnedShare finds the share named in the URL, expired or not, for the
+// owner of its note, checking the shares:manage scope. Otherwise it writes
+// the error and returns nil.
+func apiOwnedShare(w http.ResponseWriter, r *http.Request, user *User) *Share {
+	if !apiRequireScope(w, r, user, scopeSharesManage) {
+		return nil
+	}
+
+	// Fetch Share by AuthKey, expired or not
+	share := findAnyShareByAuthKey(mux.Vars(r)["id"])
 
 	// Validate Share Exists
 	if share == nil {
 		w.WriteHeader(http.StatusNotFound)
-		return
+		return nil
 	}
 
 	// Find Note for Share
@@ -93,18 +324,57 @@ func shareDeleteHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Validate Note belongs to User
 	if note == nil || note.UserID != user.ID {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+
+	if !apiRequireNote(w, r, user, note.ID) {
+		return nil
+	}
+	return share
+}
+
+// shareSessionCreateHandler exchanges the password of a protected share for
+// a short-lived token, sent as X-Share-Token when using the share key
+func shareSessionCreateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	share := findShareByAuthKey(mux.Vars(r)["id"])
+	if share == nil || !share.Protected() {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
-	// Delete the Share
-	share.Destroy()
+	err := r.ParseForm()
+	if err != nil {
+		apiErrorHandler(w, r, http.StatusBadRequest, []APIError{{Field: "password", Message: "is invalid"}})
+		return
+	}
 
-	w.Write([]byte("{}"))
+	if !apiCheckSharePassword(w, r, share, r.PostForm.Get("password")) {
+		return
+	}
+
+	session, token := createShareSession(share)
+	responseJSON, _ := json.Marshal(shareSessionSuccessResponse{ShareToken: token, ExpiresAt: session.ExpiresAt})
+	w.WriteHeader(http.StatusCreated)
+	w.Write(responseJSON)
 }
 
 func shareJSON(share *Share) []byte {
-	response := shareSuccessResponse{AuthKey: share.AuthKey, NoteID: share.NoteID, Permissions: share.Permissions}
-	responseJSON, _ := json.Marshal(response)
+	responseJSON, _ := json.Marshal(shareResponse(share))
 	return responseJSON
 }
+
+func shareResponse(share *Share) shareSuccessResponse {
+	return shareSuccessResponse{
+		AuthKey:     share.AuthKey,
+		NoteID:      share.NoteID,
+		Permissions: share.Permissions,
+		Label:       share.Label,
+		ExpiresAt:   share.ExpiresAt,
+		MaxViews:    share.MaxViews,
+		Views:       share.Views,
+		Expired:     share.Expired(),
+		Protected:   share.Protected()}
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"regexp"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestShareCreateHandlerSuccess(t *testing.T) {
@@ -26,7 +28,7 @@ func TestShareCreateHandlerSuccess(t *testing.T) {
 	router().ServeHTTP(w, r)
 
 	if w.Code != 201 {
-		t.Errorf("Expected 201 response, got %q", w.Code)
+		t.Errorf("Expected 201 response, got %d", w.Code)
 	}
 
 	b := w.Body.String()
@@ -58,7 +60,7 @@ func TestShareCreateHandlerFailInvalidUser(t *testing.T) {
 	router().ServeHTTP(w, r)
 
 	if w.Code != 404 {
-		t.Errorf("Expected 404 response, got %q", w.Code)
+		t.Errorf("Expected 404 response, got %d", w.Code)
 	}
 }
 
@@ -79,7 +81,7 @@ func TestShareCreateHandlerFailInvalidPermissions(t *testing.T) {
 	router().ServeHTTP(w, r)
 
 	if w.Code != 400 {
-		t.Errorf("Expected 400 response, got %q", w.Code)
+		t.Errorf("Expected 400 response, got %d", w.Code)
 	}
 
 	expectedBody := "{\"permissions\":\"is invalid\"}"
@@ -104,7 +106,7 @@ func TestShareCreateHandlerFailMissingPermissions(t *testing.T) {
 	router().ServeHTTP(w, r)
 
 	if w.Code != 400 {
-		t.Errorf("Expected 400 response, got %q", w.Code)
+		t.Errorf("Expected 400 response, got %d", w.Code)
 	}
 
 	expectedBody := "{\"permissions\":\"is required\"}"
@@ -129,7 +131,7 @@ func TestShareDeleteHandlerSuccess(t *testing.T) {
 	router().ServeHTTP(w, r)
 
 	if w.Code != 200 {
-		t.Errorf("Expected 200 response, got %q", w.Code)
+		t.Errorf("Expected 200 response, got %d", w.Code)
 	}
 }
 
@@ -151,6 +153,275 @@ func TestShareDeleteHandlerInvalidUser(t *testing.T) {
 	router().ServeHTTP(w, r)
 
 	if w.Code != 404 {
-		t.Errorf("Expected 404 response, got %q", w.Code)
+		t.Errorf("Expected 404 response, got %d", w.Code)
+	}
+}
+
+func TestShareCreateHandlerLimits(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	note := createNote(user, "title", "body")
+
+	postBody := strings.NewReader(fmt.Sprintf("note_id=%d&permissions=read&expires_at=2999-01-01T00:00:00Z&max_views=1", note.ID))
+	r, _ := http.NewRequest("POST", "/shares", postBody)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+	r.Header.Add("X-Auth-Token", user.AuthToken)
+	w := httptest.NewRecorder()
+
+	router().ServeHTTP(w, r)
+
+	if w.Code != 201 {
+		t.Fatalf("Expected 201 response, got %d: %s", w.Code, w.Body.String())
+	}
+	if b := w.Body.String(); !strings.Contains(b, "\"expires_at\":\"2999-01-01T00:00:00Z\",\"max_views\":1") {
+		t.Errorf("Expected limits in %q", b)
+	}
+
+	share := findSharesByNote(*note)[0]
+
+	// The single view is used, then the link stops working
+	for _, expected := range []int{200, 404} {
+		r, _ = http.NewRequest("GET", "/s/"+share.AuthKey, nil)
+		w = httptest.NewRecorder()
+		router().ServeHTTP(w, r)
+		if w.Code != expected {
+			t.Errorf("Expected %d, got %d", expected, w.Code)
+		}
+	}
+
+	// The owner still sees the share, marked as expired
+	r, _ = http.NewRequest("GET", fmt.Sprintf("/notes/%d", note.ID), nil)
+	r.Header.Add("X-Auth-Token", user.AuthToken)
+	w = httptest.NewRecorder()
+	router().ServeHTTP(w, r)
+	if b := w.Body.String(); !strings.Contains(b, "\"views\":1,\"expired\":true") {
+		t.Errorf("Expected share to be reported as expired in %q", b)
+	}
+}
+
+func TestShareCreateHandlerFailInvalidLimits(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	note := createNote(user, "title", "body")
+
+	postBody := strings.NewReader(fmt.Sprintf("note_id=%d&permissions=read&expires_at=2001-01-01T00:00:00Z&max_views=0", note.ID))
+	r, _ := http.NewRequest("POST", "/shares", postBody)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+	r.Header.Add("X-Auth-Token", user.AuthToken)
+	w := httptest.NewRecorder()
+
+	router().ServeHTTP(w, r)
+
+	if w.Code != 400 {
+		t.Errorf("Expected 400 response, got %d", w.Code)
+	}
+	expectedBody := "{\"expires_at\":\"is invalid\",\"max_views\":\"is invalid\"}"
+	if b := w.Body.String(); b != expectedBody {
+		t.Errorf("Expected %q, got %q", expectedBody, b)
+	}
+}
+
+func TestSharePasswordSession(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	note := createNote(user, "title", "body")
+	share := createShare(note, "readwrite")
+	share.SetPassword("hunter22")
+
+	showShare := func(token string) int {
+		r, _ := http.NewRequest("GET", "/notes/"+share.AuthKey, nil)
+		r.Header.Set("X-Share-Token", token)
+		w := httptest.NewRecorder()
+		router().ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := showShare(""); code != 401 {
+		t.Errorf("Expected 401 without a share token, got %d", code)
+	}
+
+	r, _ := http.NewRequest("POST", "/shares/"+share.AuthKey+"/session", strings.NewReader("password=hunter22"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	router().ServeHTTP(w, r)
+
+	if w.Code != 201 {
+		t.Fatalf("Expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var session shareSessionSuccessResponse
+	json.Unmarshal(w.Body.Bytes(), &session)
+
+	if code := showShare(session.ShareToken); code != 200 {
+		t.Errorf("Expected 200 with a share token, got %d", code)
+	}
+
+	// Changing the password ends existing sessions
+	share.SetPassword("correct horse")
+	if code := showShare(session.ShareToken); code != 401 {
+		t.Errorf("Expected 401 after the password changed, got %d", code)
+	}
+}
+
+func TestSharePasswordSessionRateLimited(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	note := createNote(user, "title", "body")
+	share := createShare(note, "read")
+	share.SetPassword("hunter22")
+
+	var codes []int
+	for i := 0; i < 5; i++ {
+		r, _ := http.NewRequest("POST", "/shares/"+share.AuthKey+"/session", strings.NewReader("password=guess"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		router().ServeHTTP(w, r)
+		codes = append(codes, w.Code)
+	}
+
+	if codes[0] != 403 || codes[4] != 429 {
+		t.Errorf("Expected failures to be rate limited, got %v", codes)
+	}
+}
+
+func TestSharePasswordSessionMalformedForm(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	share := factoryCreateShare("read")
+	share.SetPassword("hunter22")
+
+	r, _ := http.NewRequest("POST", "/shares/"+share.AuthKey+"/session", strings.NewReader("password=%zz"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	router().ServeHTTP(w, r)
+
+	if w.Code != 400 {
+		t.Errorf("Expected 400, got %d", w.Code)
+	}
+
+	w = sharePageRequest("POST", "/s/"+share.AuthKey+"/unlock", "password=%zz", nil)
+	if w.Code != 400 || len(w.Result().Cookies()) > 0 {
+		t.Errorf("Expected 400 from the share page, got %d", w.Code)
+	}
+}
+
+func shareManageRequest(method string, path string, token string, contentType string, body string) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	r.Header.Add("X-Auth-Token", token)
+	w := httptest.NewRecorder()
+	router().ServeHTTP(w, r)
+	return w
+}
+
+func TestShareIndexHandler(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	other := factoryCreateUser("other@site.com")
+	first := createNote(user, "first", "body")
+	second := createNote(user, "second", "body")
+	createShare(first, "read")
+	createShare(second, "readwrite")
+	createShare(createNote(other, "theirs", "body"), "read")
+
+	w := shareManageRequest("GET", "/shares", user.AuthToken, "", "")
+	var shares []shareSuccessResponse
+	json.Unmarshal(w.Body.Bytes(), &shares)
+	if w.Code != 200 || len(shares) != 2 {
+		t.Errorf("Expected the user's 2 shares, got %s", w.Body.String())
+	}
+
+	w = shareManageRequest("GET", fmt.Sprintf("/shares?note_id=%d", second.ID), user.AuthToken, "", "")
+	json.Unmarshal(w.Body.Bytes(), &shares)
+	if len(shares) != 1 || shares[0].NoteID != second.ID {
+		t.Errorf("Expected shares of one note, got %s", w.Body.String())
+	}
+}
+
+func TestShareShowHandlerFailInvalidUser(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	share := factoryCreateShare("read")
+	other := factoryCreateUser("other@site.com")
+
+	w := shareManageRequest("GET", "/shares/"+share.AuthKey, other.AuthToken, "", "")
+	if w.Code != 404 {
+		t.Errorf("Expected 404, got %d", w.Code)
+	}
+}
+
+func TestShareUpdateHandler(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	note := createNote(user, "title", "body")
+	expiresAt := time.Now().Add(time.Hour)
+	share := createLimitedShare(note, "readwrite", &expiresAt, 5)
+
+	w := shareManageRequest("PATCH", "/shares/"+share.AuthKey, user.AuthToken, "application/merge-patch+json",
+		`{"permissions":"read","label":"Team","expires_at":null}`)
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	expectedBody := fmt.Sprintf("{\"auth_key\":%q,\"note_id\":%d,\"permissions\":\"read\",\"label\":\"Team\",\"max_views\":5}", share.AuthKey, note.ID)
+	if b := w.Body.String(); b != expectedBody {
+		t.Errorf("Expected %q, got %q", expectedBody, b)
+	}
+
+	updated := findShareByAuthKey(share.AuthKey)
+	if updated == nil || updated.Permissions != "read" || updated.ExpiresAt != nil || updated.MaxViews != 5 {
+		t.Errorf("Expected the share to keep its key with new settings, got %+v", updated)
+	}
+}
+
+func TestShareUpdateHandlerFailValidation(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	share := factoryCreateShare("read")
+	user := findUserByEmail("user@site.com")
+
+	w := shareManageRequest("PATCH", "/shares/"+share.AuthKey, user.AuthToken, "application/json",
+		`{"permissions":"owner","max_views":0}`)
+
+	if w.Code != 400 {
+		t.Errorf("Expected 400, got %d", w.Code)
+	}
+	expectedBody := "{\"max_views\":\"is invalid\",\"permissions\":\"is invalid\"}"
+	if b := w.Body.String(); b != expectedBody {
+		t.Errorf("Expected %q, got %q", expectedBody, b)
+	}
+}
+
+func TestNoteSharesDeleteHandler(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	note := createNote(user, "title", "body")
+	kept := createShare(createNote(user, "other", "body"), "read")
+	createShare(note, "read")
+	createShare(note, "readwrite")
+
+	w := shareManageRequest("DELETE", fmt.Sprintf("/notes/%d/shares", note.ID), user.AuthToken, "", "")
+
+	if b := w.Body.String(); w.Code != 200 || b != "{\"revoked\":2}" {
+		t.Errorf("Expected 2 shares to be revoked, got %d %q", w.Code, b)
+	}
+	if len(findSharesByNote(*note)) != 0 || findShareByAuthKey(kept.AuthKey) == nil {
+		t.Errorf("Expected only the note's shares to be revoked")
 	}
 }
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// legacyShareKeySunset reads GRAYNOTE_LEGACY_SHARE_KEYS_SUNSET, the RFC 3339
+// time after which share keys are no longer accepted in place of a note ID
+// on /notes. Until it is set they are accepted with a deprecation warning.
+func legacyShareKeySunset() *time.Time {
+	sunset, err := time.Parse(time.RFC3339, os.Getenv("GRAYNOTE_LEGACY_SHARE_KEYS_SUNSET"))
+	if err != nil {
+		return nil
+	}
+	return &sunset
+}
+
+// requestShareKey returns the share key a request is made with: the {key} of
+// a /s/ URL or, until the sunset, a key used in place of a note ID on /notes.
+// Legacy requests are answered with Deprecation and Sunset headers pointing
+// at the /s/ URL. Numeric IDs are always note IDs.
+func requestShareKey(w http.ResponseWriter, r *http.Request) string {
+	vars := mux.Vars(r)
+	if key, ok := vars["key"]; ok {
+		return key
+	}
+
+	id := vars["id"]
+	if _, err := strconv.ParseInt(id, 10, 64); err == nil {
+		return ""
+	}
+
+	sunset := legacyShareKeySunset()
+	if sunset != nil && !time.Now().Before(*sunset) {
+		return ""
+	}
+
+	legacyShareRouteTotal.Inc()
+	w.Header().Set("Deprecation", "true")
+	w.Header().Set("Link", "</s/"+id+">; rel=\"successor-version\"")
+	if sunset != nil {
+		w.Header().Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+	}
+	return id
+}
+
+// shareNoteShow serves the note behind a share key to anyone holding it
+func shareNoteShow(w http.ResponseWriter, r *http.Request, key string) {
+	// The share page is served from the same URL
+	w.Header().Set("Vary", "Accept")
+
+	share := findShareByAuthKey(key)
+	if share == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	shareAccessTotal.WithLabelValues(share.Permissions).Inc()
+
+	note := findNoteByID(int64(share.NoteID))
+	if note == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if !apiRequireShareSession(w, r, share) {
+		return
+	}
+
+	// Views are counted as they're served so max_views can't be overrun
+	if !share.RecordView() {
+		recordShareActivity(r, share, shareActionDenied, http.StatusNotFound, 0)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	recordShareActivity(r, share, shareActionView, http.StatusOK, note.Version)
+
+	// Share keys are for the owner's eyes only
+	w.Header().Set("ETag", noteETag(note))
+	w.Write(collaboratorNoteJSON(note, share.Permissions))
+}
+
+// apiAuthorizeShareUpdate finds the note behind a readwrite share key.
+// Otherwise it writes the error and returns nil.
+func apiAuthorizeShareUpdate(w http.ResponseWriter, r *http.Request, key string) *noteAccess {
+	share := findShareByAuthKey(key)
+	if share == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	shareAccessTotal.WithLabelValues(share.Permissions).Inc()
+
+	if !permissionAllows(share.Permissions, "readwrite") {
+		recordShareActivity(r, share, shareActionDenied, http.StatusForbidden, 0)
+		w.WriteHeader(http.StatusForbidden)
+		return nil
+	}
+
+	if !apiRequireShareSession(w, r, share) {
+		return nil
+	}
+
+	note := findNoteByID(int64(share.NoteID))
+	if note == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	return &noteAccess{Note: note, Share: share, Permissions: share.Permissions}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestShareKeyRoutes(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	note := createNote(user, "title", "body")
+	share := createShare(note, "readwrite")
+	path := "/s/" + share.AuthKey
+
+	w := shareKeyRequest("GET", path, "")
+	if w.Code != 200 || len(w.Header().Get("Deprecation")) > 0 {
+		t.Errorf("Expected 200 without deprecation, got %d %v", w.Code, w.Header())
+	}
+
+	w = shareKeyRequest("PUT", path, "title=title&body=put")
+	if w.Code != 200 || findNoteByID(int64(note.ID)).Body != "put" {
+		t.Errorf("Expected PUT to update, got %d", w.Code)
+	}
+
+	r, _ := http.NewRequest("PATCH", path, strings.NewReader(`{"body":"patched"}`))
+	r.Header.Set("Content-Type", mergePatchContentType)
+	w = httptest.NewRecorder()
+	router().ServeHTTP(w, r)
+	if w.Code != 200 || findNoteByID(int64(note.ID)).Body != "patched" {
+		t.Errorf("Expected PATCH to update, got %d", w.Code)
+	}
+
+	w = shareKeyRequest("GET", "/s/unknown", "")
+	if w.Code != 404 {
+		t.Errorf("Expected 404 for an unknown key, got %d", w.Code)
+	}
+}
+
+func TestShareKeyHidesShares(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	note := createNote(user, "title", "body")
+	share := createShare(note, "comment")
+	writeShare := createShare(note, "readwrite")
+
+	w := shareKeyRequest("GET", "/s/"+share.AuthKey, "")
+	var response map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if _, ok := response["shares"]; ok || response["permissions"] != "comment" {
+		t.Errorf("Expected no shares in %q", w.Body.String())
+	}
+
+	w = shareKeyRequest("PUT", "/s/"+writeShare.AuthKey, "title=title&body=changed")
+	if b := w.Body.String(); w.Code != 200 || strings.Contains(b, share.AuthKey) || strings.Contains(b, "\"shares\"") {
+		t.Errorf("Expected no share keys after an update, got %d %q", w.Code, b)
+	}
+}
+
+func TestShareKeyRouteNumericKey(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	other := factoryCreateUser("other@site.com")
+	note := createNote(user, "shared", "body")
+	otherNote := createNote(other, "private", "body")
+	share := createShare(note, "read")
+
+	// A key that is all digits reads as a note ID on /notes
+	key := fmt.Sprint(otherNote.ID)
+	db.Exec("UPDATE shares SET auth_key=? WHERE id=?", key, share.ID)
+
+	w := shareKeyRequest("GET", "/notes/"+key, "")
+	if w.Code != 403 {
+		t.Errorf("Expected note IDs to need a login, got %d", w.Code)
+	}
+
+	w = shareKeyRequest("GET", "/s/"+key, "")
+	if b := w.Body.String(); w.Code != 200 || !strings.HasPrefix(b, fmt.Sprintf(`{"id":%d,`, note.ID)) {
+		t.Errorf("Expected the shared note, got %d %q", w.Code, b)
+	}
+}
+
+func TestShareKeyLegacyRoute(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	share := factoryCreateShare("read")
+
+	w := shareKeyRequest("GET", "/notes/"+share.AuthKey, "")
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+	if d := w.Header().Get("Deprecation"); d != "true" {
+		t.Errorf("Expected Deprecation header, got %q", d)
+	}
+	if l := w.Header().Get("Link"); l != "</s/"+share.AuthKey+">; rel=\"successor-version\"" {
+		t.Errorf("Expected Link to the /s route, got %q", l)
+	}
+
+	os.Setenv("GRAYNOTE_LEGACY_SHARE_KEYS_SUNSET", "2999-01-01T00:00:00Z")
+	w = shareKeyRequest("GET", "/notes/"+share.AuthKey, "")
+	if s := w.Header().Get("Sunset"); w.Code != 200 || s != "Tue, 01 Jan 2999 00:00:00 GMT" {
+		t.Errorf("Expected Sunset header before the sunset, got %d %q", w.Code, s)
+	}
+
+	os.Setenv("GRAYNOTE_LEGACY_SHARE_KEYS_SUNSET", "2001-01-01T00:00:00Z")
+	defer os.Unsetenv("GRAYNOTE_LEGACY_SHARE_KEYS_SUNSET")
+	w = shareKeyRequest("GET", "/notes/"+share.AuthKey, "")
+	if w.Code != 403 {
+		t.Errorf("Expected share keys to stop working on /notes after the sunset, got %d", w.Code)
+	}
+}
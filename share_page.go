@@ -0,0 +1,261 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// sharePageData fills sharePageTemplate. Note is nil on pages that only show
+// Message or the password form.
+type sharePageData struct {
+	Nonce         string
+	Key           string
+	Note          *Note
+	Body          template.HTML
+	Message       string
+	NeedsPassword bool
+	CanEdit       bool
+	Editing       bool
+	EditTitle     string
+	EditBody      string
+	EditVersion   int
+}
+
+var sharePageTemplate = template.Must(template.New("share").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta http-equiv="Content-Security-Policy" content="default-src 'none'; style-src 'nonce-{{.Nonce}}'; form-action 'self'; base-uri 'none'">
+<meta name="robots" content="noindex, nofollow">
+<meta name="referrer" content="no-referrer">
+<title>{{if .Note}}{{.Note.Title}}{{else}}Shared note{{end}} · Graynote</title>
+<style nonce="{{.Nonce}}">
+body { max-width: 42rem; margin: 2rem auto; padding: 0 1rem; font: 1rem/1.6 system-ui, sans-serif; color: #222; }
+pre { background: #f4f4f4; padding: 0.75rem; overflow-x: auto; }
+blockquote { border-left: 3px solid #ccc; margin-left: 0; padding-left: 1rem; color: #555; }
+input[type=text], textarea { width: 100%; box-sizing: border-box; font: inherit; }
+textarea { min-height: 20rem; }
+.message { padding: 0.5rem 0.75rem; background: #fff4d6; }
+</style>
+</head>
+<body>
+{{if .Message}}<p class="message">{{.Message}}</p>
+{{end}}{{if .NeedsPassword}}<form method="post" action="/s/{{.Key}}/unlock">
+<p><label>Password <input type="password" name="password" required autofocus></label></p>
+<p><button type="submit">Open note</button></p>
+</form>
+{{else if .Editing}}<form method="post" action="/s/{{.Key}}">
+<input type="hidden" name="version" value="{{.EditVersion}}">
+<p><label>Title<br><input type="text" name="title" value="{{.EditTitle}}" required></label></p>
+<p><label>Body<br><textarea name="body" required>{{.EditBody}}</textarea></label></p>
+<p><button type="submit">Save</button> <a href="/s/{{.Key}}">Cancel</a></p>
+</form>
+{{else if .Note}}<article>
+<h1>{{.Note.Title}}</h1>
+{{.Body}}</article>
+{{if .CanEdit}}<p><a href="/s/{{.Key}}?edit">Edit</a></p>
+{{end}}{{end}}</body>
+</html>
+`))
+
+// acceptsHTML matches requests from browsers, which list HTML first in
+// Accept. API clients keep getting JSON from the same URL.
+func acceptsHTML(r *http.Request, rm *mux.RouteMatch) bool {
+	first := strings.TrimSpace(strings.Split(r.Header.Get("Accept"), ",")[0])
+	return strings.HasPrefix(first, "text/html") || strings.HasPrefix(first, "application/xhtml+xml")
+}
+
+// sharePageHandler renders the note behind a share key as a web page. The
+// body is rendered from Markdown. Readwrite shares offer an edit form when
+// the page is opened with ?edit.
+func sharePageHandler(w http.ResponseWriter, r *http.Request) {
+	page := newSharePage(w, r)
+
+	share := findShareByAuthKey(page.Key)
+	if share == nil {
+		renderSharePage(w, http.StatusNotFound, page.withMessage("This link is invalid or has expired."))
+		return
+	}
+	shareAccessTotal.WithLabelValues(share.Permissions).Inc()
+
+	note := findNoteByID(int64(share.NoteID))
+	if note == nil {
+		renderSharePage(w, http.StatusNotFound, page.withMessage("This link is invalid or has expired."))
+		return
+	}
+
+	if !hasShareSession(r, share) {
+		page.NeedsPassword = true
+		renderSharePage(w, http.StatusUnauthorized, page.withMessage("This note is password protected."))
+		return
+	}
+
+	// Views are counted as they're served so max_views can't be overrun
+	if !share.RecordView() {
+		recordShareActivity(r, share, shareActionDenied, http.StatusNotFound, 0)
+		renderSharePage(w, http.StatusNotFound, page.withMessage("This link is invalid or has expired."))
+		return
+	}
+	recordShareActivity(r, share, shareActionView, http.StatusOK, note.Version)
+
+	page.CanEdit = permissionAllows(share.Permissions, "readwrite")
+	if _, edit := r.URL.Query()["edit"]; edit && page.CanEdit {
+		page.editing(note.Title, note.Body, note.Version)
+	}
+	page.show(note)
+	renderSharePage(w, http.StatusOK, page)
+}
+
+// sharePageUpdateHandler saves the share page's edit form. A form opened on
+// an older version of the note is shown again rather than overwriting.
+func sharePageUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	page := newSharePage(w, r)
+
+	share := findShareByAuthKey(page.Key)
+	if share == nil {
+		renderSharePage(w, http.StatusNotFound, page.withMessage("This link is invalid or has expired."))
+		return
+	}
+	shareAccessTotal.WithLabelValues(share.Permissions).Inc()
+
+	if !permissionAllows(share.Permissions, "readwrite") {
+		recordShareActivity(r, share, shareActionDenied, http.StatusForbidden, 0)
+		renderSharePage(w, http.StatusForbidden, page.withMessage("This link can't be used to edit the note."))
+		return
+	}
+
+	note := findNoteByID(int64(share.NoteID))
+	if note == nil {
+		renderSharePage(w, http.StatusNotFound, page.withMessage("This link is invalid or has expired."))
+		return
+	}
+
+	if !hasShareSession(r, share) {
+		page.NeedsPassword = true
+		renderSharePage(w, http.StatusUnauthorized, page.withMessage("This note is password protected."))
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxNotePatchBytes)
+	err := r.ParseForm()
+	if err != nil {
+		renderSharePage(w, http.StatusBadRequest, page.withMessage("The note couldn't be saved."))
+		return
+	}
+	title, body := r.PostForm.Get("title"), r.PostForm.Get("body")
+	version, _ := strconv.Atoi(r.PostForm.Get("version"))
+
+	page.CanEdit = true
+	page.editing(title, body, note.Version)
+	page.show(note)
+
+	if errors := validateNote(title, body); len(errors) > 0 {
+		renderSharePage(w, http.StatusBadRequest, page.withMessage("Both a title and a body are needed."))
+		return
+	}
+
+	if version != note.Version {
+		recordShareActivity(r, share, shareActionUpdate, http.StatusConflict, note.Version)
+		renderSharePage(w, http.StatusConflict, page.withMessage("The note changed since you opened it. Your text is below; saving again replaces the latest version."))
+		return
+	}
+
+	note.Update(title, body)
+	recordShareActivity(r, share, shareActionUpdate, http.StatusOK, note.Version)
+
+	http.Redirect(w, r, "/s/"+page.Key, http.StatusSeeOther)
+}
+
+// sharePageUnlockHandler checks the password of a protected share and keeps
+// the session token in a cookie limited to the share's own path
+func sharePageUnlockHandler(w http.ResponseWriter, r *http.Request) {
+	page := newSharePage(w, r)
+
+	share := findShareByAuthKey(page.Key)
+	if share == nil {
+		renderSharePage(w, http.StatusNotFound, page.withMessage("This link is invalid or has expired."))
+		return
+	}
+
+	if !share.Protected() {
+		http.Redirect(w, r, "/s/"+page.Key, http.StatusSeeOther)
+		return
+	}
+
+	page.NeedsPassword = true
+	err := r.ParseForm()
+	if err != nil {
+		renderSharePage(w, http.StatusBadRequest, page.withMessage("That password isn't right."))
+		return
+	}
+
+	switch status, wait := checkSharePassword(r, share, r.PostForm.Get("password")); status {
+	case http.StatusTooManyRequests:
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		renderSharePage(w, status, page.withMessage("Too many attempts. Try again later."))
+		return
+	case http.StatusForbidden:
+		renderSharePage(w, status, page.withMessage("That password isn't right."))
+		return
+	}
+
+	session, token := createShareSession(share)
+	http.SetCookie(w, &http.Cookie{
+		Name:     shareTokenCookie,
+		Value:    token,
+		Path:     "/s/" + page.Key,
+		Expires:  session.ExpiresAt,
+		MaxAge:   int(time.Until(session.ExpiresAt).Seconds()),
+		HttpOnly: true,
+		Secure:   sessionStore.Options.Secure,
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.Redirect(w, r, "/s/"+page.Key, http.StatusSeeOther)
+}
+
+// newSharePage starts a share page, setting the headers every share page is
+// sent with. Share keys are in the URL, so pages are kept out of search
+// indexes, caches and Referer headers, and can't be framed.
+func newSharePage(w http.ResponseWriter, r *http.Request) *sharePageData {
+	page := &sharePageData{Nonce: randomToken(), Key: mux.Vars(r)["key"]}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy",
+		"default-src 'none'; style-src 'nonce-"+page.Nonce+"'; form-action 'self'; base-uri 'none'; frame-ancestors 'none'")
+	w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Vary", "Accept")
+	return page
+}
+
+func (p *sharePageData) withMessage(message string) *sharePageData {
+	p.Message = message
+	return p
+}
+
+func (p *sharePageData) editing(title string, body string, version int) {
+	p.Editing = true
+	p.EditTitle, p.EditBody, p.EditVersion = title, body, version
+}
+
+func (p *sharePageData) show(note *Note) {
+	p.Note = note
+	p.Body = renderMarkdown(note.Body)
+}
+
+func renderSharePage(w http.ResponseWriter, status int, page *sharePageData) {
+	w.WriteHeader(status)
+	if err := sharePageTemplate.Execute(w, page); err != nil {
+		log.Println("render share page failed", err)
+	}
+}
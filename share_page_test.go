@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const browserAccept = "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"
+
+func sharePageRequest(method string, path string, body string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Accept", browserAccept)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	router().ServeHTTP(w, r)
+	return w
+}
+
+func TestSharePageHandler(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	note := createNote(user, "<Plans>", "Some **bold** <script>alert(1)</script>")
+	share := createShare(note, "read")
+
+	w := sharePageRequest("GET", "/s/"+share.AuthKey, "", nil)
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+	b := w.Body.String()
+	if !strings.Contains(b, "<h1>&lt;Plans&gt;</h1>") || !strings.Contains(b, "<strong>bold</strong> &lt;script&gt;") {
+		t.Errorf("Expected escaped, rendered note in %q", b)
+	}
+	if strings.Contains(b, "?edit") {
+		t.Errorf("Expected no edit link for a read share")
+	}
+
+	if csp := w.Header().Get("Content-Security-Policy"); !strings.HasPrefix(csp, "default-src 'none'; style-src 'nonce-") || !strings.Contains(csp, "frame-ancestors 'none'") {
+		t.Errorf("Unexpected Content-Security-Policy %q", csp)
+	}
+	if robots := w.Header().Get("X-Robots-Tag"); robots != "noindex, nofollow" || !strings.Contains(b, `<meta name="robots" content="noindex, nofollow">`) {
+		t.Errorf("Expected noindex, got %q", robots)
+	}
+	if referrer := w.Header().Get("Referrer-Policy"); referrer != "no-referrer" {
+		t.Errorf("Expected no-referrer, got %q", referrer)
+	}
+
+	// API clients get JSON from the same URL
+	w = shareKeyRequest("GET", "/s/"+share.AuthKey, "")
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected JSON, got %q", ct)
+	}
+
+	w = sharePageRequest("GET", "/s/unknown", "", nil)
+	if w.Code != 404 || !strings.Contains(w.Body.String(), "invalid or has expired") {
+		t.Errorf("Expected a 404 page, got %d", w.Code)
+	}
+}
+
+func TestSharePageEdit(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	note := createNote(user, "Plans", "Draft")
+	share := createShare(note, "readwrite")
+	path := "/s/" + share.AuthKey
+
+	w := sharePageRequest("GET", path+"?edit", "", nil)
+	if b := w.Body.String(); !strings.Contains(b, `<textarea name="body" required>Draft</textarea>`) || !strings.Contains(b, `name="version" value="1"`) {
+		t.Fatalf("Expected the edit form, got %q", b)
+	}
+
+	w = sharePageRequest("POST", path, "version=1&title=Plans&body=Final", nil)
+	if w.Code != 303 || findNoteByID(int64(note.ID)).Body != "Final" {
+		t.Errorf("Expected the note to be saved, got %d", w.Code)
+	}
+
+	// The form was opened on version 1, which is no longer current
+	w = sharePageRequest("POST", path, "version=1&title=Plans&body=Stale", nil)
+	if w.Code != 409 || findNoteByID(int64(note.ID)).Body != "Final" || !strings.Contains(w.Body.String(), ">Stale</textarea>") {
+		t.Errorf("Expected a conflict keeping the submitted text, got %d", w.Code)
+	}
+
+	readShare := createShare(note, "read")
+	w = sharePageRequest("POST", "/s/"+readShare.AuthKey, "version=2&title=Plans&body=Mine", nil)
+	if w.Code != 403 {
+		t.Errorf("Expected read share not to edit, got %d", w.Code)
+	}
+}
+
+func TestSharePagePassword(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	note := createNote(user, "Plans", "Secret")
+	share := createShare(note, "read")
+	share.SetPassword("hunter22")
+	path := "/s/" + share.AuthKey
+
+	w := sharePageRequest("GET", path, "", nil)
+	if b := w.Body.String(); w.Code != 401 || !strings.Contains(b, `type="password"`) || strings.Contains(b, "Secret") {
+		t.Fatalf("Expected the password form, got %d %q", w.Code, b)
+	}
+
+	w = sharePageRequest("POST", path+"/unlock", "password=guess", nil)
+	if w.Code != 403 || len(w.Result().Cookies()) > 0 {
+		t.Errorf("Expected a wrong password to be refused, got %d", w.Code)
+	}
+
+	w = sharePageRequest("POST", path+"/unlock", "password=hunter22", nil)
+	cookies := w.Result().Cookies()
+	if w.Code != 303 || len(cookies) != 1 || cookies[0].Path != path || !cookies[0].HttpOnly || cookies[0].SameSite != http.SameSiteStrictMode {
+		t.Fatalf("Expected a share session cookie, got %d %v", w.Code, cookies)
+	}
+
+	w = sharePageRequest("GET", path, "", cookies[0])
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "<p>Secret</p>") {
+		t.Errorf("Expected the note with the session cookie, got %d", w.Code)
+	}
+}
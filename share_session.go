@@ -0,0 +1,172 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// shareTokenHeader carries a share session token on requests made with a
+// password-protected share key
+const shareTokenHeader = "X-Share-Token"
+
+// defaultShareSessionTTL is how long a share session token lasts
+const defaultShareSessionTTL = time.Hour
+
+// ShareSession lets an anonymous viewer who knew the password of a share use
+// it until ExpiresAt without sending the password again
+type ShareSession struct {
+	ID        int
+	ShareID   int
+	TokenHash string
+	ExpiresAt time.Time
+	CreatedAt time.Time
+}
+
+// shareSessionTTL reads the token lifetime from GRAYNOTE_SHARE_SESSION_TTL
+func shareSessionTTL() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("GRAYNOTE_SHARE_SESSION_TTL")); err == nil && d > 0 {
+		return d
+	}
+	return defaultShareSessionTTL
+}
+
+// createShareSession stores a new session for share and returns it with the
+// plain token, which is only known to the caller
+func createShareSession(share *Share) (*ShareSession, string) {
+	token := randomToken()
+	now := time.Now().UTC()
+	session := &ShareSession{ShareID: share.ID, TokenHash: hashToken(token), ExpiresAt: now.Add(shareSessionTTL()), CreatedAt: now}
+
+	stmt, err := db.Prepare("INSERT share_sessions SET share_id=?, token_hash=?, expires_at=?, created_at=?")
+	if err != nil {
+		checkErr(err, "prepare create share session")
+	} else {
+		defer stmt.Close()
+	}
+	res, err := stmt.Exec(session.ShareID, session.TokenHash, session.ExpiresAt, session.CreatedAt)
+	checkErr(err, "create share session")
+
+	id, _ := res.LastInsertId()
+	session.ID = int(id)
+	return session, token
+}
+
+// validShareSession returns if token is an unexpired session for share
+func validShareSession(share *Share, token string) bool {
+	if len(token) == 0 {
+		return false
+	}
+
+	var count int
+	err := db.QueryRow(
+		"SELECT COUNT(*) FROM share_sessions WHERE share_id=? AND token_hash=? AND expires_at > ?",
+		share.ID,
+		hashToken(token),
+		time.Now().UTC()).Scan(&count)
+	checkErr(err, "find share session")
+	return count > 0
+}
+
+// shareTokenCookie carries a share session token for the share page, on
+// the share's own path
+const shareTokenCookie = "graynote_share_token"
+
+// requestShareToken returns the share session token sent in the header or,
+// from the share page, in the cookie
+func requestShareToken(r *http.Request) string {
+	if token := r.Header.Get(shareTokenHeader); len(token) > 0 {
+		return token
+	}
+	if cookie, err := r.Cookie(shareTokenCookie); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// hasShareSession returns if a request using share may see the note, which
+// for a password-protected share needs a session token. Refusals are logged.
+func hasShareSession(r *http.Request, share *Share) bool {
+	if !share.Protected() || validShareSession(share, requestShareToken(r)) {
+		return true
+	}
+
+	recordShareActivity(r, share, shareActionDenied, http.StatusUnauthorized, 0)
+	return false
+}
+
+// apiRequireShareSession checks that a request using a password-protected
+// share carries a session token for it, writing a 401 if it doesn't
+func apiRequireShareSession(w http.ResponseWriter, r *http.Request, share *Share) bool {
+	if hasShareSession(r, share) {
+		return true
+	}
+
+	apiErrorHandler(w, r, http.StatusUnauthorized, []APIError{{Field: "error", Message: "share_password_required"}})
+	return false
+}
+
+// checkSharePassword checks password against share, slowing down repeated
+// failures both for the share and for the caller's address on that share.
+// It returns http.StatusCreated on success, http.StatusForbidden for a wrong
+// password, or http.StatusTooManyRequests with how long to wait.
+func checkSharePassword(r *http.Request, share *Share, password string) (int, time.Duration) {
+	shareKey := "share:" + share.AuthKey
+	ipKey := shareKey + ":ip:" + clientIP(r)
+
+	wait := sharePasswordLimiter.Wait(shareKey)
+	if ipWait := sharePasswordIPLimiter.Wait(ipKey); ipWait > wait {
+		wait = ipWait
+	}
+	if wait > 0 {
+		recordShareActivity(r, share, shareActionUnlock, http.StatusTooManyRequests, 0)
+		return http.StatusTooManyRequests, wait
+	}
+
+	if !share.ValidPassword(password) {
+		sharePasswordLimiter.Fail(shareKey)
+		sharePasswordIPLimiter.Fail(ipKey)
+		recordShareActivity(r, share, shareActionUnlock, http.StatusForbidden, 0)
+		return http.StatusForbidden, 0
+	}
+
+	sharePasswordIPLimiter.Succeed(ipKey)
+	recordShareActivity(r, share, shareActionUnlock, http.StatusCreated, 0)
+	return http.StatusCreated, 0
+}
+
+// apiCheckSharePassword checks password with checkSharePassword, writing the
+// error if it is refused
+func apiCheckSharePassword(w http.ResponseWriter, r *http.Request, share *Share, password string) bool {
+	switch status, wait := checkSharePassword(r, share, password); status {
+	case http.StatusTooManyRequests:
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		apiErrorHandler(w, r, http.StatusTooManyRequests, []APIError{{Field: "password", Message: "too many attempts"}})
+		return false
+	case http.StatusForbidden:
+		apiErrorHandler(w, r, http.StatusForbidden, []APIError{{Field: "password", Message: "is invalid"}})
+		return false
+	}
+	return true
+}
+
+// purgeExpiredShareSessions removes sessions past their expiry
+func purgeExpiredShareSessions() int64 {
+	res, err := db.Exec("DELETE FROM share_sessions WHERE expires_at <= ?", time.Now().UTC())
+	checkErr(err, "purge share sessions")
+
+	purged, _ := res.RowsAffected()
+	return purged
+}
+
+// sweepShareSessions purges expired sessions every interval
+func sweepShareSessions(interval time.Duration) {
+	for range time.Tick(interval) {
+		if purged := purgeExpiredShareSessions(); purged > 0 {
+			log.Printf("purged %d share sessions", purged)
+		}
+	}
+}
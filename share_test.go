@@ -1,6 +1,10 @@
 package main
 
-import "testing"
+import (
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestCreateShare(t *testing.T) {
 	db := testDbSetup()
@@ -12,7 +16,7 @@ func TestCreateShare(t *testing.T) {
 
 	share := createShare(note, permissions)
 	if share.NoteID != note.ID {
-		t.Errorf("Expected NoteID to be %q, got %q", note.ID, share.NoteID)
+		t.Errorf("Expected NoteID to be %d, got %d", note.ID, share.NoteID)
 	}
 	if share.Permissions != permissions {
 		t.Errorf("Expected permissions to eq %q, got %q", permissions, share.Permissions)
@@ -53,7 +57,7 @@ func TestFindShareById(t *testing.T) {
 
 	foundShare := findShareByID(int64(share.ID))
 	if foundShare.ID != share.ID {
-		t.Errorf("Expected share id %q, got %q", share.ID, foundShare.ID)
+		t.Errorf("Expected share id %d, got %d", share.ID, foundShare.ID)
 	}
 }
 
@@ -65,7 +69,7 @@ func TestFindShareByAuthKey(t *testing.T) {
 
 	foundShare := findShareByAuthKey(share.AuthKey)
 	if foundShare.ID != share.ID {
-		t.Errorf("Expected share id %q, got %q", share.ID, foundShare.ID)
+		t.Errorf("Expected share id %d, got %d", share.ID, foundShare.ID)
 	}
 }
 
@@ -92,3 +96,65 @@ func TestValidateSharePermissions(t *testing.T) {
 		t.Errorf("Expected garbage to be invalid")
 	}
 }
+
+func TestFindShareByAuthKeyExpired(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	note := createNote(user, "title", "body")
+	expiresAt := time.Now().UTC().Add(time.Hour)
+	share := createLimitedShare(note, "read", &expiresAt, 0)
+
+	_, err := db.Exec("UPDATE shares SET expires_at = DATE_SUB(expires_at, INTERVAL 2 HOUR) WHERE id=?", share.ID)
+	checkErr(err, "expire share")
+
+	if findShareByAuthKey(share.AuthKey) != nil {
+		t.Errorf("Expected expired share not to be found")
+	}
+	if found := findAnyShareByAuthKey(share.AuthKey); found == nil || !found.Expired() {
+		t.Errorf("Expected expired share to be found for its owner")
+	}
+}
+
+func TestShareRecordView(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	note := createNote(user, "title", "body")
+	share := createLimitedShare(note, "read", nil, 2)
+
+	if !share.RecordView() || !share.RecordView() {
+		t.Fatalf("Expected 2 views to be allowed")
+	}
+	if share.RecordView() {
+		t.Errorf("Expected the third view to be refused")
+	}
+	if findShareByAuthKey(share.AuthKey) != nil {
+		t.Errorf("Expected exhausted share not to be found")
+	}
+}
+
+func TestShareSetPassword(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	share := factoryCreateShare("read")
+	other := createShare(findNoteByID(int64(share.NoteID)), "read")
+	share.SetPassword("hunter22")
+	other.SetPassword("hunter22")
+
+	if !strings.HasPrefix(share.PasswordHash, "pbkdf2-sha256$") || share.PasswordHash == other.PasswordHash {
+		t.Errorf("Expected a salted hash, got %q and %q", share.PasswordHash, other.PasswordHash)
+	}
+	if !share.ValidPassword("hunter22") || share.ValidPassword("hunter2") {
+		t.Errorf("Expected only the right password to be valid")
+	}
+
+	// Hashes stored before salting still unlock
+	share.PasswordHash = passwordToHash("legacy")
+	if !share.ValidPassword("legacy") || share.ValidPassword("hunter22") {
+		t.Errorf("Expected a legacy hash to be checked")
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	totpPeriod       = 30
+	totpDigits       = 6
+	totpIssuer       = "Graynote"
+	recoveryCodeSize = 10
+
+	// twoFactorChallengeTTL is how long a user has to enter their code after a password login
+	twoFactorChallengeTTL = 5 * time.Minute
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// generateTOTPSecret returns a random 160 bit secret, base32 encoded
+func generateTOTPSecret() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return totpEncoding.EncodeToString(b)
+}
+
+// totpURI builds the otpauth:// URI authenticator apps scan to enroll
+func totpURI(secret string, email string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprintf("%d", totpDigits))
+	params.Set("period", fmt.Sprintf("%d", totpPeriod))
+
+	label := url.PathEscape(totpIssuer + ":" + email)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// totpCode computes the RFC 4226 HOTP value of secret for a time step
+func totpCode(secret string, step int64) string {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return ""
+	}
+
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// validateTOTP checks code against the steps either side of t to allow for
+// clock drift. It returns the matching step, which must only be used once.
+func validateTOTP(secret string, code string, t time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := t.Unix() / totpPeriod
+	for step := current - 1; step <= current+1; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// BeginTwoFactorEnrollment stores a new, not yet enabled, secret for the user
+func (u *User) BeginTwoFactorEnrollment() string {
+	u.TOTPSecret = generateTOTPSecret()
+	u.TOTPEnabled = false
+
+	_, err := db.Exec("UPDATE users SET totp_secret=?, totp_enabled=?, totp_last_step=0 WHERE id=?", u.TOTPSecret, false, u.ID)
+	checkErr(err, "begin two factor enrollment")
+	return u.TOTPSecret
+}
+
+// EnableTwoFactor turns on 2FA once the user has proven their authenticator works
+func (u *User) EnableTwoFactor() {
+	u.TOTPEnabled = true
+
+	_, err := db.Exec("UPDATE users SET totp_enabled=? WHERE id=?", true, u.ID)
+	checkErr(err, "enable two factor")
+}
+
+// DisableTwoFactor removes the user's secret and recovery codes
+func (u *User) DisableTwoFactor() {
+	u.TOTPSecret = ""
+	u.TOTPEnabled = false
+
+	_, err := db.Exec("UPDATE users SET totp_secret='', totp_enabled=?, totp_last_step=0 WHERE id=?", false, u.ID)
+	checkErr(err, "disable two factor")
+
+	_, err = db.Exec("DELETE FROM recovery_codes WHERE user_id=?", u.ID)
+	checkErr(err, "delete recovery codes")
+}
+
+// VerifyTOTP checks a code from the user's authenticator. Each code is
+// accepted only once, even within its validity window.
+func (u *User) VerifyTOTP(code string) bool {
+	if len(u.TOTPSecret) == 0 {
+		return false
+	}
+
+	step, ok := validateTOTP(u.TOTPSecret, code, time.Now())
+	if !ok {
+		return false
+	}
+
+	res, err := db.Exec("UPDATE users SET totp_last_step=? WHERE id=? AND totp_last_step < ?", step, u.ID, step)
+	checkErr(err, "record totp step")
+
+	affected, _ := res.RowsAffected()
+	if affected != 1 {
+		return false
+	}
+	u.TOTPLastStep = step
+	return true
+}
+
+// RegenerateRecoveryCodes replaces the user's recovery codes, returning the new plain codes
+func (u *User) RegenerateRecoveryCodes() []string {
+	_, err := db.Exec("DELETE FROM recovery_codes WHERE user_id=?", u.ID)
+	checkErr(err, "delete recovery codes")
+
+	stmt, err := db.Prepare("INSERT recovery_codes SET user_id=?, code_hash=?")
+	if err != nil {
+		checkErr(err, "prepare create recovery code")
+	} else {
+		defer stmt.Close()
+	}
+
+	var codes []string
+	for i := 0; i < recoveryCodeSize; i++ {
+		b := make([]byte, 5)
+		rand.Read(b)
+		code := fmt.Sprintf("%x-%x", b[:2], b[2:])
+
+		_, err = stmt.Exec(u.ID, hashToken(code))
+		checkErr(err, "create recovery code")
+		codes = append(codes, code)
+	}
+	return codes
+}
+
+// UseRecoveryCode spends one of the user's recovery codes
+func (u *User) UseRecoveryCode(code string) bool {
+	res, err := db.Exec(
+		"UPDATE recovery_codes SET used_at=? WHERE user_id=? AND code_hash=? AND used_at IS NULL",
+		time.Now().UTC(),
+		u.ID,
+		hashToken(strings.ToLower(strings.TrimSpace(code))))
+	checkErr(err, "use recovery code")
+
+	affected, _ := res.RowsAffected()
+	return affected == 1
+}
+
+// VerifySecondFactor accepts either an authenticator code or a recovery code
+func (u *User) VerifySecondFactor(code string, recoveryCode string) bool {
+	if len(code) > 0 {
+		return u.VerifyTOTP(code)
+	}
+	if len(recoveryCode) > 0 {
+		return u.UseRecoveryCode(recoveryCode)
+	}
+	return false
+}
+
+// TwoFactorChallenge links a password login to the second step that completes it
+type TwoFactorChallenge struct {
+	ID        int
+	UserID    int
+	TokenHash string
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+// createTwoFactorChallenge stores a challenge for user and returns the plain token
+func createTwoFactorChallenge(user *User) string {
+	token := randomToken()
+
+	stmt, err := db.Prepare("INSERT two_factor_challenges SET user_id=?, token_hash=?, expires_at=?")
+	if err != nil {
+		checkErr(err, "prepare create two factor challenge")
+	} else {
+		defer stmt.Close()
+	}
+	_, err = stmt.Exec(user.ID, hashToken(token), time.Now().UTC().Add(twoFactorChallengeTTL))
+	checkErr(err, "create two factor challenge")
+
+	return token
+}
+
+// findTwoFactorChallengeByToken returns the challenge for token if unused and unexpired
+func findTwoFactorChallengeByToken(token string) *TwoFactorChallenge {
+	var challenge *TwoFactorChallenge
+
+	rows, err := db.Query(
+		"SELECT id, user_id, token_hash, expires_at, used_at FROM two_factor_challenges WHERE token_hash=? AND used_at IS NULL AND expires_at > ?",
+		hashToken(token),
+		time.Now().UTC())
+	if err != nil {
+		checkErr(err, "find two factor challenge by token")
+	} else {
+		defer rows.Close()
+	}
+
+	if rows.Next() {
+		challenge = twoFactorChallengeFromDbRows(rows)
+	}
+	return challenge
+}
+
+// Use marks the challenge as spent. It returns false if another request used it first.
+func (c *TwoFactorChallenge) Use() bool {
+	res, err := db.Exec("UPDATE two_factor_challenges SET used_at=? WHERE id=? AND used_at IS NULL", time.Now().UTC(), c.ID)
+	checkErr(err, "use two factor challenge")
+
+	affected, _ := res.RowsAffected()
+	return affected == 1
+}
+
+func twoFactorChallengeFromDbRows(rows *sql.Rows) *TwoFactorChallenge {
+	challenge := new(TwoFactorChallenge)
+	rows.Scan(&challenge.ID, &challenge.UserID, &challenge.TokenHash, &challenge.ExpiresAt, &challenge.UsedAt)
+	return challenge
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B SHA1 vectors, truncated to 6 digits
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+
+	for unix, expected := range vectors {
+		if code := totpCode(secret, unix/totpPeriod); code != expected {
+			t.Errorf("Expected code %q at %d, got %q", expected, unix, code)
+		}
+	}
+}
+
+func TestValidateTOTPWindow(t *testing.T) {
+	secret := generateTOTPSecret()
+	now := time.Now()
+	step := now.Unix() / totpPeriod
+
+	if _, ok := validateTOTP(secret, totpCode(secret, step-1), now); !ok {
+		t.Errorf("Expected previous step to be accepted")
+	}
+	if _, ok := validateTOTP(secret, totpCode(secret, step-3), now); ok {
+		t.Errorf("Expected old step to be rejected")
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri := totpURI("ABCDEF", "user@site.com")
+	if !strings.HasPrefix(uri, "otpauth://totp/Graynote:user@site.com?") || !strings.Contains(uri, "secret=ABCDEF") {
+		t.Errorf("Unexpected URI %q", uri)
+	}
+}
+
+func TestUserVerifyTOTPSingleUse(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	secret := user.BeginTwoFactorEnrollment()
+	code := totpCode(secret, time.Now().Unix()/totpPeriod)
+
+	if !user.VerifyTOTP(code) {
+		t.Errorf("Expected code to be accepted")
+	}
+	if user.VerifyTOTP(code) {
+		t.Errorf("Expected reused code to be rejected")
+	}
+}
+
+func TestUserRecoveryCodes(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	codes := user.RegenerateRecoveryCodes()
+
+	if len(codes) != recoveryCodeSize {
+		t.Fatalf("Expected %d codes, got %d", recoveryCodeSize, len(codes))
+	}
+	if !user.UseRecoveryCode(codes[0]) {
+		t.Errorf("Expected code to be accepted")
+	}
+	if user.UseRecoveryCode(codes[0]) {
+		t.Errorf("Expected used code to be rejected")
+	}
+
+	user.RegenerateRecoveryCodes()
+	if user.UseRecoveryCode(codes[1]) {
+		t.Errorf("Expected replaced code to be rejected")
+	}
+}
@@ -3,17 +3,48 @@ package main
 import (
 	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
 	"fmt"
+	"net/mail"
+	"strings"
+	"time"
 )
 
 // User account type
 type User struct {
-	ID           int
-	Email        string
-	PasswordHash string
-	AuthToken    string
+	ID              int
+	Email           string
+	PasswordHash    string
+	AuthToken       string
+	EmailVerifiedAt *time.Time
+	TOTPSecret      string
+	TOTPEnabled     bool
+	TOTPLastStep    int64
+	// DeletionRequestedAt is set while the account waits to be purged
+	DeletionRequestedAt *time.Time
+	// APIKey is set when the request authenticated with a scoped API key
+	APIKey *APIKey
+}
+
+// userColumns lists users columns in the order userFromDbRow scans them
+const userColumns = "id, email, password_hash, auth_token, email_verified_at, totp_secret, totp_enabled, totp_last_step, deletion_requested_at"
+
+// normalizeEmail folds case and whitespace so one address maps to one account
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// ValidateEmail returns if email is a bare, syntactically valid address
+func ValidateEmail(email string) bool {
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email {
+		return false
+	}
+
+	at := strings.LastIndex(email, "@")
+	return at > 0 && strings.Contains(email[at+1:], ".")
 }
 
 // TODO: IMPROVE PASSWORD HASH
@@ -26,15 +57,14 @@ func passwordToHash(password string) string {
 func createUser(userParams *UserRegisterForm) *User {
 	passwordHash := passwordToHash(userParams.Password)
 	stmt, _ := db.Prepare("INSERT users SET email=?, password_hash=?, auth_token=?")
-	res, err := stmt.Exec(userParams.Email, passwordHash, randomToken())
+	res, err := stmt.Exec(normalizeEmail(userParams.Email), passwordHash, randomToken())
 	checkErr(err, "createUser exec")
 	userID, _ := res.LastInsertId()
-	user := findUserByID(userID)
-	return user
+	return findUserByID(userID)
 }
 
 func findUserByID(userID int64) *User {
-	rows, err := db.Query("SELECT * FROM users WHERE id=?", userID)
+	rows, err := db.Query("SELECT "+userColumns+" FROM users WHERE id=?", userID)
 	if err != nil {
 		checkErr(err, "findUserByID")
 	} else {
@@ -50,7 +80,7 @@ func findUserByID(userID int64) *User {
 }
 
 func findUserByEmail(email string) *User {
-	rows, err := db.Query("SELECT * FROM users WHERE email=?", email)
+	rows, err := db.Query("SELECT "+userColumns+" FROM users WHERE email=?", normalizeEmail(email))
 	if err != nil {
 		checkErr(err, "findUserByEmail")
 	} else {
@@ -66,7 +96,7 @@ func findUserByEmail(email string) *User {
 }
 
 func findUserByAuthToken(token string) *User {
-	rows, err := db.Query("SELECT * FROM users WHERE auth_token=?", token)
+	rows, err := db.Query("SELECT "+userColumns+" FROM users WHERE auth_token=?", token)
 	if err != nil {
 		checkErr(err, "findUserByAuthToken")
 	} else {
@@ -83,7 +113,16 @@ func findUserByAuthToken(token string) *User {
 
 func userFromDbRow(rows *sql.Rows) *User {
 	user := new(User)
-	rows.Scan(&user.ID, &user.Email, &user.PasswordHash, &user.AuthToken)
+	rows.Scan(
+		&user.ID,
+		&user.Email,
+		&user.PasswordHash,
+		&user.AuthToken,
+		&user.EmailVerifiedAt,
+		&user.TOTPSecret,
+		&user.TOTPEnabled,
+		&user.TOTPLastStep,
+		&user.DeletionRequestedAt)
 	return user
 }
 
@@ -91,8 +130,48 @@ func (u User) validPasswordForUser(password string) bool {
 	return passwordToHash(password) == u.PasswordHash
 }
 
+// Verified returns if the user has confirmed their email address
+func (u User) Verified() bool {
+	return u.EmailVerifiedAt != nil
+}
+
+// MarkEmailVerified records that the user confirmed their email address
+func (u *User) MarkEmailVerified() {
+	now := time.Now().UTC()
+	u.EmailVerifiedAt = &now
+
+	_, err := db.Exec("UPDATE users SET email_verified_at=? WHERE id=?", now, u.ID)
+	checkErr(err, "mark user email verified")
+
+	// Notes shared with the address before it was confirmed
+	claimCollaboratorInvites(u)
+}
+
+// UpdatePassword stores a new password for the user
+func (u *User) UpdatePassword(password string) {
+	u.PasswordHash = passwordToHash(password)
+
+	_, err := db.Exec("UPDATE users SET password_hash=? WHERE id=?", u.PasswordHash, u.ID)
+	checkErr(err, "update user password")
+}
+
+// RevokeTokens replaces the user's auth token, signing out every client
+func (u *User) RevokeTokens() {
+	u.AuthToken = randomToken()
+
+	_, err := db.Exec("UPDATE users SET auth_token=? WHERE id=?", u.AuthToken, u.ID)
+	checkErr(err, "revoke user tokens")
+}
+
 func randomToken() string {
 	b := make([]byte, 16)
 	rand.Read(b)
 	return fmt.Sprintf("%x", b)
 }
+
+// hashToken hashes a random token for storage. Tokens carry enough entropy
+// that a fast unsalted hash is sufficient.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
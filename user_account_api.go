@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/schema"
+)
+
+type userAccountParameters struct {
+	CurrentPassword string `schema:"current_password"`
+	Password        string `schema:"password"`
+	Email           string `schema:"email"`
+}
+
+type userMeResponse struct {
+	ID                   int        `json:"id"`
+	Email                string     `json:"email"`
+	EmailVerified        bool       `json:"email_verified"`
+	TwoFactorEnabled     bool       `json:"two_factor_enabled"`
+	DeletionScheduledFor *time.Time `json:"deletion_scheduled_for,omitempty"`
+}
+
+type userDeleteResponse struct {
+	DeletionScheduledFor *time.Time `json:"deletion_scheduled_for"`
+}
+
+// decodeUserAccountParameters reads the account form, writing a 400 and
+// returning nil if it is malformed
+func decodeUserAccountParameters(w http.ResponseWriter, r *http.Request) *userAccountParameters {
+	if !apiParseForm(w, r) {
+		return nil
+	}
+
+	// ParseForm leaves DELETE bodies alone
+	form := r.PostForm
+	if r.Method == "DELETE" {
+		body, _ := io.ReadAll(io.LimitReader(r.Body, 1<<16))
+		var err error
+		if form, err = url.ParseQuery(string(body)); err != nil {
+			apiErrorHandler(w, r, http.StatusBadRequest, []APIError{{Field: "form", Message: "is invalid"}})
+			return nil
+		}
+	}
+
+	params := new(userAccountParameters)
+	decoder := schema.NewDecoder()
+	decoder.IgnoreUnknownKeys(true)
+	decoder.Decode(params, form)
+	return params
+}
+
+// userMeHandler shows who the credential belongs to. Any API key may ask.
+func userMeHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Authenticate
+	user := apiAuthenticateUser(r)
+	if user == nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	response := userMeResponse{
+		ID:                   user.ID,
+		Email:                user.Email,
+		EmailVerified:        user.Verified(),
+		TwoFactorEnabled:     user.TOTPEnabled,
+		DeletionScheduledFor: user.DeletionScheduledFor(),
+	}
+	responseJSON, _ := json.Marshal(response)
+	w.Write(responseJSON)
+}
+
+// userChangePasswordHandler sets a new password and signs out every other client
+func userChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if !apiRequirePasswordLogin(w, r) {
+		return
+	}
+
+	// Authenticate
+	user := apiAuthenticateUser(r)
+	if user == nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if !apiRequireScope(w, r, user, scopeAccount) {
+		return
+	}
+
+	params := decodeUserAccountParameters(w, r)
+	if params == nil {
+		return
+	}
+
+	var paramErrors []APIError
+
+	if len(params.CurrentPassword) == 0 {
+		paramErrors = append(paramErrors, APIError{Field: "current_password", Message: "is required"})
+	}
+
+	if len(params.Password) == 0 {
+		paramErrors = append(paramErrors, APIError{Field: "password", Message: "is required"})
+	}
+
+	if len(paramErrors) > 0 {
+		apiErrorHandler(w, r, http.StatusBadRequest, paramErrors)
+		return
+	}
+
+	if !apiCheckPassword(w, r, user, params.CurrentPassword, "current_password") {
+		return
+	}
+
+	user.UpdatePassword(params.Password)
+	user.RevokeTokens()
+	destroyPasswordResetsForUser(user)
+
+	// This client stays signed in with the new token
+	apiStartSession(w, r, user)
+	w.Write(successfulLoginJSON(user))
+}
+
+// requiresCurrentPassword returns if user must confirm account changes with
+// their password. Accounts that sign in through single sign-on may never
+// have known theirs.
+func requiresCurrentPassword(user *User) bool {
+	return passwordLoginEnabled() && len(user.Identities()) == 0
+}
+
+// userChangeEmailHandler mails a confirmation link to the new address. The
+// account keeps its current email until the link is followed.
+func userChangeEmailHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Authenticate
+	user := apiAuthenticateUser(r)
+	if user == nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if !apiRequireScope(w, r, user, scopeAccount) {
+		return
+	}
+
+	params := decodeUserAccountParameters(w, r)
+	if params == nil {
+		return
+	}
+
+	var paramErrors []APIError
+
+	email := normalizeEmail(params.Email)
+	if len(email) == 0 {
+		paramErrors = append(paramErrors, APIError{Field: "email", Message: "is required"})
+	} else if !ValidateEmail(email) {
+		paramErrors = append(paramErrors, APIError{Field: "email", Message: "is invalid"})
+	} else if email == user.Email {
+		paramErrors = append(paramErrors, APIError{Field: "email", Message: "is unchanged"})
+	} else if findUserByEmail(email) != nil {
+		paramErrors = append(paramErrors, APIError{Field: "email", Message: "already exists"})
+	}
+
+	confirmPassword := requiresCurrentPassword(user)
+	if confirmPassword && len(params.CurrentPassword) == 0 {
+		paramErrors = append(paramErrors, APIError{Field: "current_password", Message: "is required"})
+	}
+
+	if len(paramErrors) > 0 {
+		apiErrorHandler(w, r, http.StatusBadRequest, paramErrors)
+		return
+	}
+
+	if confirmPassword && !apiCheckPassword(w, r, user, params.CurrentPassword, "current_password") {
+		return
+	}
+
+	sendEmailChangeVerification(user, email)
+
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("{}"))
+}
+
+// userDeleteHandler schedules the account for deletion and signs it out
+// everywhere. Signing in again before the grace period ends cancels it.
+func userDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Authenticate
+	user := apiAuthenticateUser(r)
+	if user == nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if !apiRequireScope(w, r, user, scopeAccount) {
+		return
+	}
+
+	params := decodeUserAccountParameters(w, r)
+	if params == nil {
+		return
+	}
+
+	if requiresCurrentPassword(user) {
+		if len(params.CurrentPassword) == 0 {
+			apiErrorHandler(w, r, http.StatusBadRequest, []APIError{{Field: "current_password", Message: "is required"}})
+			return
+		}
+		if !apiCheckPassword(w, r, user, params.CurrentPassword, "current_password") {
+			return
+		}
+	}
+
+	user.RequestDeletion()
+	apiEndSession(w, r)
+
+	w.WriteHeader(http.StatusAccepted)
+	response := userDeleteResponse{DeletionScheduledFor: user.DeletionScheduledFor()}
+	responseJSON, _ := json.Marshal(response)
+	w.Write(responseJSON)
+}
+
+// apiCheckPassword confirms the user's password, sharing the login throttle
+// for the account. It writes the error response and returns false on failure.
+func apiCheckPassword(w http.ResponseWriter, r *http.Request, user *User, password string, field string) bool {
+	key := "login:account:" + user.Email
+
+	if wait := loginAccountLimiter.Wait(key); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		apiErrorHandler(w, r, http.StatusTooManyRequests, []APIError{{Field: field, Message: "too many attempts"}})
+		return false
+	}
+
+	if !user.validPasswordForUser(password) {
+		loginAccountLimiter.Fail(key)
+		apiErrorHandler(w, r, http.StatusForbidden, []APIError{{Field: field, Message: "is invalid"}})
+		return false
+	}
+
+	loginAccountLimiter.Succeed(key)
+	return true
+}
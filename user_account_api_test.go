@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func accountRequest(method string, path string, token string, body string) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+	r.Header.Set("X-Auth-Token", token)
+	w := httptest.NewRecorder()
+	router().ServeHTTP(w, r)
+	return w
+}
+
+func TestUserMeHandler(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+
+	w := accountRequest("GET", "/users/me", user.AuthToken, "")
+
+	if w.Code != 200 {
+		t.Errorf("Expected 200, got %d", w.Code)
+	}
+	expectedBody := "{\"id\":" + strconv.Itoa(user.ID) + ",\"email\":\"user@site.com\",\"email_verified\":true,\"two_factor_enabled\":false}"
+	if b := w.Body.String(); b != expectedBody {
+		t.Errorf("Expected %q, got %q", expectedBody, b)
+	}
+}
+
+func TestUserChangePasswordHandler(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+
+	w := accountRequest("PUT", "/users/me/password", user.AuthToken, "current_password=wrong&password=new-password")
+	if w.Code != 403 {
+		t.Errorf("Expected 403, got %d", w.Code)
+	}
+
+	w = accountRequest("PUT", "/users/me/password", user.AuthToken, "current_password=password&password=new-password")
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+
+	updated := findUserByID(int64(user.ID))
+	if !updated.validPasswordForUser("new-password") {
+		t.Errorf("Expected password to change")
+	}
+	if updated.AuthToken == user.AuthToken || !strings.Contains(w.Body.String(), updated.AuthToken) {
+		t.Errorf("Expected a new token to replace the old one")
+	}
+}
+
+func TestUserChangeEmailHandler(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	var mail bytes.Buffer
+	mailer = &LogMailer{W: &mail}
+
+	user := factoryCreateUser("user@site.com")
+	factoryCreateUser("taken@site.com")
+
+	w := accountRequest("PUT", "/users/me/email", user.AuthToken, "current_password=password&email=taken@site.com")
+	if w.Code != 400 {
+		t.Errorf("Expected 400, got %d", w.Code)
+	}
+
+	w = accountRequest("PUT", "/users/me/email", user.AuthToken, "current_password=password&email=New@Site.com")
+	if w.Code != 202 {
+		t.Fatalf("Expected 202, got %d", w.Code)
+	}
+	if findUserByID(int64(user.ID)).Email != "user@site.com" {
+		t.Errorf("Expected email to stay until confirmed")
+	}
+	if !strings.Contains(mail.String(), "To: user@site.com") {
+		t.Errorf("Expected the current address to be warned")
+	}
+
+	token := createEmailVerification(user, "new@site.com", true)
+	w = accountRequest("POST", "/users/verify", "", "token="+token)
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+
+	updated := findUserByID(int64(user.ID))
+	if updated.Email != "new@site.com" || !updated.Verified() {
+		t.Errorf("Expected email to change to the verified address, got %q", updated.Email)
+	}
+}
+
+func TestUserDeleteHandler(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	share := factoryCreateShare("read")
+	user := findUserByEmail("user@site.com")
+
+	w := accountRequest("DELETE", "/users/me", user.AuthToken, "current_password=password")
+
+	if w.Code != 202 {
+		t.Fatalf("Expected 202, got %d: %s", w.Code, w.Body.String())
+	}
+	if findShareByAuthKey(share.AuthKey) != nil {
+		t.Errorf("Expected shares to be suspended")
+	}
+	if w := accountRequest("GET", "/users/me", user.AuthToken, ""); w.Code != 403 {
+		t.Errorf("Expected old token to be revoked, got %d", w.Code)
+	}
+
+	// Still within the grace period
+	if purgeDeletedUsers(time.Hour) != 0 || findUserByID(int64(user.ID)) == nil {
+		t.Errorf("Expected account to be kept during the grace period")
+	}
+
+	createShareSession(share)
+	if purgeDeletedUsers(-time.Minute) != 1 {
+		t.Errorf("Expected account to be purged")
+	}
+	if findUserByID(int64(user.ID)) != nil || findNoteByID(int64(share.NoteID)) != nil || findAnyShareByAuthKey(share.AuthKey) != nil {
+		t.Errorf("Expected account, notes and shares to be removed")
+	}
+	var sessions int
+	db.QueryRow("SELECT COUNT(*) FROM share_sessions WHERE share_id=?", share.ID).Scan(&sessions)
+	if sessions != 0 {
+		t.Errorf("Expected share sessions to be removed, got %d", sessions)
+	}
+}
+
+func TestUserDeleteCancelledByLogin(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	os.Setenv("GRAYNOTE_DELETION_GRACE", "1h")
+	defer os.Unsetenv("GRAYNOTE_DELETION_GRACE")
+
+	share := factoryCreateShare("read")
+	user := findUserByEmail("user@site.com")
+	user.RequestDeletion()
+
+	w := accountRequest("POST", "/users/login", "", "email=user@site.com&password=password")
+	if w.Code != 201 {
+		t.Fatalf("Expected 201, got %d", w.Code)
+	}
+
+	if findUserByID(int64(user.ID)).DeletionRequestedAt != nil {
+		t.Errorf("Expected deletion to be cancelled")
+	}
+	if findShareByAuthKey(share.AuthKey) == nil {
+		t.Errorf("Expected shares to work again")
+	}
+	if purgeDeletedUsers(-time.Minute) != 0 {
+		t.Errorf("Expected nothing to purge")
+	}
+}
+
+func TestUserAccountMalformedForm(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+
+	for _, method := range []string{"PUT", "DELETE"} {
+		path := "/users/me"
+		if method == "PUT" {
+			path = "/users/me/email"
+		}
+		w := accountRequest(method, path, user.AuthToken, "current_password=%zz")
+		if w.Code != 400 || w.Body.String() != "{\"form\":\"is invalid\"}" {
+			t.Errorf("Expected 400 for the %s form, got %d %q", method, w.Code, w.Body.String())
+		}
+	}
+	if findUserByID(int64(user.ID)).DeletionRequestedAt != nil {
+		t.Errorf("Expected account to be kept")
+	}
+}
+
+func TestUserDeleteHandlerRejectsAPIKey(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	_, plain := createAPIKey(user, "key", []string{scopeNotesWrite}, nil, nil)
+
+	w := accountRequest("DELETE", "/users/me", plain, "current_password=password")
+
+	if w.Code != 403 {
+		t.Errorf("Expected 403, got %d", w.Code)
+	}
+	if findUserByID(int64(user.ID)).DeletionRequestedAt != nil {
+		t.Errorf("Expected account to be kept")
+	}
+}
+
+func TestUserAccountChangesWithoutPasswordForSSO(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	mailer = &LogMailer{W: new(bytes.Buffer)}
+
+	// Accounts created at their first single sign-on get a random password
+	user := createUser(&UserRegisterForm{Email: "sso@site.com", Password: randomToken()})
+	user.MarkEmailVerified()
+	user.LinkIdentity("https://idp.example.com", "external-1")
+
+	if w := accountRequest("PUT", "/users/me/email", user.AuthToken, "email=new@site.com"); w.Code != 202 {
+		t.Errorf("Expected the email change to be accepted, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := accountRequest("DELETE", "/users/me", user.AuthToken, ""); w.Code != 202 {
+		t.Errorf("Expected the deletion to be accepted, got %d: %s", w.Code, w.Body.String())
+	}
+}
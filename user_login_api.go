@@ -3,7 +3,9 @@ package main
 // UserRegisterForm type
 import (
 	"encoding/json"
+	"math"
 	"net/http"
+	"strconv"
 
 	"github.com/gorilla/schema"
 )
@@ -19,9 +21,12 @@ type userLoginSuccessResponse struct {
 }
 
 func userRegisterHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Content-Type", "application/json")
 
+	if !apiRequirePasswordLogin(w, r) {
+		return
+	}
+
 	err := r.ParseForm()
 	if err != nil {
 		// Handle Error
@@ -34,9 +39,13 @@ func userRegisterHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Error message if missing email and/or password
 	var paramErrors []APIError
+	userParams.Email = normalizeEmail(userParams.Email)
 	if len(userParams.Email) == 0 {
 		error := APIError{Field: "email", Message: "is required"}
 		paramErrors = append(paramErrors, error)
+	} else if !ValidateEmail(userParams.Email) {
+		error := APIError{Field: "email", Message: "is invalid"}
+		paramErrors = append(paramErrors, error)
 	}
 
 	if len(userParams.Password) == 0 {
@@ -57,8 +66,12 @@ func userRegisterHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Create user
+	// Create user and ask them to confirm their address
 	user = createUser(userParams)
+	sendEmailVerification(user, user.Email)
+
+	// Browser clients get a session cookie alongside the token
+	apiStartSession(w, r, user)
 
 	// Success message
 	w.WriteHeader(http.StatusCreated)
@@ -68,9 +81,12 @@ func userRegisterHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func userLoginHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Content-Type", "application/json")
 
+	if !apiRequirePasswordLogin(w, r) {
+		return
+	}
+
 	err := r.ParseForm()
 	if err != nil {
 		// Handle Error
@@ -98,24 +114,44 @@ func userLoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check for user
+	// Throttle repeated failures by client and by account
+	ipKey := "login:ip:" + clientIP(r)
+	accountKey := "login:account:" + normalizeEmail(userParams.Email)
+	wait := loginIPLimiter.Wait(ipKey)
+	if accountWait := loginAccountLimiter.Wait(accountKey); accountWait > wait {
+		wait = accountWait
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		error := APIError{Field: "credentials", Message: "too many attempts"}
+		apiErrorHandler(w, r, http.StatusTooManyRequests, []APIError{error})
+		return
+	}
+
+	// Check for user and password. Unknown emails and wrong passwords get the
+	// same error so the response doesn't reveal which accounts exist.
 	user := findUserByEmail(userParams.Email)
+	if user == nil || !user.validPasswordForUser(userParams.Password) {
+		loginIPLimiter.Fail(ipKey)
+		loginAccountLimiter.Fail(accountKey)
 
-	// Error if user is not found
-	if user == nil {
-		error := APIError{Field: "email", Message: "not found"}
+		error := APIError{Field: "credentials", Message: "are invalid"}
 		apiErrorHandler(w, r, http.StatusForbidden, []APIError{error})
 		return
 	}
 
-	// Validate password for user
-	// Error if password is invalid
-	if !user.validPasswordForUser(userParams.Password) {
-		error := APIError{Field: "password", Message: "is invalid"}
-		apiErrorHandler(w, r, http.StatusForbidden, []APIError{error})
+	loginAccountLimiter.Succeed(accountKey)
+
+	// Accounts with 2FA finish logging in at /users/login/2fa
+	if user.TOTPEnabled {
+		w.WriteHeader(http.StatusAccepted)
+		w.Write(twoFactorChallengeJSON(createTwoFactorChallenge(user)))
 		return
 	}
 
+	// Browser clients get a session cookie alongside the token
+	apiStartSession(w, r, user)
+
 	// Success message
 	w.WriteHeader(http.StatusCreated)
 
@@ -123,6 +159,14 @@ func userLoginHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(successfulLoginJSON(user))
 }
 
+// userLogoutHandler ends a cookie session. Token clients simply forget their token.
+func userLogoutHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	apiEndSession(w, r)
+	w.Write([]byte("{}"))
+}
+
 func successfulLoginJSON(user *User) []byte {
 	response := userLoginSuccessResponse{Token: user.AuthToken}
 	responseJSON, _ := json.Marshal(response)
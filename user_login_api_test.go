@@ -22,7 +22,7 @@ func TestUserRegisterHandlerSuccess(t *testing.T) {
 	router().ServeHTTP(w, r)
 
 	if w.Code != 201 {
-		t.Errorf("Expected code 201, got %q", w.Code)
+		t.Errorf("Expected code 201, got %d", w.Code)
 	}
 	if b := w.Body.String(); !strings.Contains(b, "token") {
 		t.Errorf("Expected token, got %q", b)
@@ -48,7 +48,7 @@ func TestUserRegisterHandlerFailMissingParams(t *testing.T) {
 	router().ServeHTTP(w, r)
 
 	if w.Code != 400 {
-		t.Errorf("Expected code 400, got %q", w.Code)
+		t.Errorf("Expected code 400, got %d", w.Code)
 	}
 	expectedError := "{\"email\":\"is required\",\"password\":\"is required\"}"
 	if b := w.Body.String(); b != expectedError {
@@ -74,7 +74,7 @@ func TestUserRegisterHandlerFailAlreadyExists(t *testing.T) {
 	router().ServeHTTP(w, r)
 
 	if w.Code != 400 {
-		t.Errorf("Expected code 400, got %q", w.Code)
+		t.Errorf("Expected code 400, got %d", w.Code)
 	}
 
 	expectedError := "{\"email\":\"already exists\"}"
@@ -101,7 +101,7 @@ func TestUserLoginHandlerSuccess(t *testing.T) {
 	router().ServeHTTP(w, r)
 
 	if w.Code != 201 {
-		t.Errorf("Expected code 201, got %q", w.Code)
+		t.Errorf("Expected code 201, got %d", w.Code)
 	}
 	if b := w.Body.String(); !strings.Contains(b, "token") {
 		t.Errorf("Expected token, got %q", b)
@@ -126,9 +126,9 @@ func TestUserLoginHandlerFailBadPassword(t *testing.T) {
 	router().ServeHTTP(w, r)
 
 	if w.Code != http.StatusForbidden {
-		t.Errorf("Expected code 403, got %q", w.Code)
+		t.Errorf("Expected code 403, got %d", w.Code)
 	}
-	expectedError := "{\"password\":\"is invalid\"}"
+	expectedError := "{\"credentials\":\"are invalid\"}"
 	if b := w.Body.String(); b != expectedError {
 		t.Errorf("Expected %q, got %q", expectedError, b)
 	}
@@ -152,10 +152,40 @@ func TestUserLoginHandlerFailNoEmail(t *testing.T) {
 	router().ServeHTTP(w, r)
 
 	if w.Code != http.StatusForbidden {
-		t.Errorf("Expected code 400, got %q", w.Code)
+		t.Errorf("Expected code 400, got %d", w.Code)
 	}
-	expectedError := "{\"email\":\"not found\"}"
+	expectedError := "{\"credentials\":\"are invalid\"}"
 	if b := w.Body.String(); b != expectedError {
 		t.Errorf("Expected %q, got %q", expectedError, b)
 	}
 }
+
+func TestUserLoginHandlerFailLockout(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	// Create the user
+	form := UserRegisterForm{Email: "user@site.com", Password: "thepassword"}
+	createUser(&form)
+
+	// Exhaust the free attempts
+	for i := 0; i < loginAccountLimiter.FreeAttempts+1; i++ {
+		r, _ := http.NewRequest("POST", "/users/login", strings.NewReader("email=user@site.com&password=wrongpassword"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+		router().ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	// Even the right password must wait
+	r, _ := http.NewRequest("POST", "/users/login", strings.NewReader("email=user@site.com&password=thepassword"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+	w := httptest.NewRecorder()
+
+	router().ServeHTTP(w, r)
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected code 429, got %d", w.Code)
+	}
+	if len(w.Header().Get("Retry-After")) == 0 {
+		t.Errorf("Expected Retry-After header")
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/schema"
+)
+
+type passwordForgotParameters struct {
+	Email string `schema:"email"`
+}
+
+type passwordResetParameters struct {
+	Token    string `schema:"token"`
+	Password string `schema:"password"`
+}
+
+func userPasswordForgotHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if !apiRequirePasswordLogin(w, r) {
+		return
+	}
+
+	if !apiParseForm(w, r) {
+		return
+	}
+
+	params := new(passwordForgotParameters)
+	decoder := schema.NewDecoder()
+	decoder.IgnoreUnknownKeys(true)
+	decoder.Decode(params, r.PostForm)
+
+	if len(params.Email) == 0 {
+		apiErrorHandler(w, r, http.StatusBadRequest, []APIError{{Field: "email", Message: "is required"}})
+		return
+	}
+
+	// Throttle by client and by address, whether or not the account exists
+	ipKey := "forgot:ip:" + clientIP(r)
+	emailKey := "forgot:email:" + normalizeEmail(params.Email)
+	wait := passwordForgotIPLimiter.Wait(ipKey)
+	if emailWait := passwordForgotEmailLimiter.Wait(emailKey); emailWait > wait {
+		wait = emailWait
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		apiErrorHandler(w, r, http.StatusTooManyRequests, []APIError{{Field: "email", Message: "too many attempts"}})
+		return
+	}
+	passwordForgotIPLimiter.Fail(ipKey)
+	passwordForgotEmailLimiter.Fail(emailKey)
+
+	// Respond the same, and as quickly, whether or not the account exists.
+	// The reset is created and mailed in the background.
+	if user := findUserByEmail(params.Email); user != nil {
+		passwordResetMail.Add(1)
+		go func() {
+			defer passwordResetMail.Done()
+			sendPasswordReset(user)
+		}()
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("{}"))
+}
+
+// passwordResetMail tracks reset mail still being sent
+var passwordResetMail sync.WaitGroup
+
+// sendPasswordReset mails user a link to choose a new password
+func sendPasswordReset(user *User) {
+	token := createPasswordReset(user)
+	link := appURL("/reset-password?token=" + url.QueryEscape(token))
+	body := fmt.Sprintf(
+		"Someone asked to reset the password for your Graynote account.\n\n"+
+			"Follow this link within an hour to choose a new password:\n%s\n\n"+
+			"If it wasn't you, you can ignore this email.", link)
+
+	if err := mailer.Send(user.Email, "Reset your Graynote password", body); err != nil {
+		log.Println("password reset mail failed", err)
+	}
+}
+
+func userPasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if !apiRequirePasswordLogin(w, r) {
+		return
+	}
+
+	if !apiParseForm(w, r) {
+		return
+	}
+
+	params := new(passwordResetParameters)
+	decoder := schema.NewDecoder()
+	decoder.IgnoreUnknownKeys(true)
+	decoder.Decode(params, r.PostForm)
+
+	var errors []APIError
+
+	if len(params.Token) == 0 {
+		errors = append(errors, APIError{Field: "token", Message: "is required"})
+	}
+
+	if len(params.Password) == 0 {
+		errors = append(errors, APIError{Field: "password", Message: "is required"})
+	}
+
+	if len(errors) > 0 {
+		apiErrorHandler(w, r, http.StatusBadRequest, errors)
+		return
+	}
+
+	// Validate and spend the token
+	reset := findPasswordResetByToken(params.Token)
+	if reset == nil || !reset.Use() {
+		apiErrorHandler(w, r, http.StatusBadRequest, []APIError{{Field: "token", Message: "is invalid"}})
+		return
+	}
+
+	user := findUserByID(int64(reset.UserID))
+	if user == nil {
+		apiErrorHandler(w, r, http.StatusBadRequest, []APIError{{Field: "token", Message: "is invalid"}})
+		return
+	}
+
+	// Set the password and sign out every existing client
+	user.UpdatePassword(params.Password)
+	user.RevokeTokens()
+	destroyPasswordResetsForUser(user)
+
+	// Reading the user's mail isn't enough to get past 2FA
+	if user.TOTPEnabled {
+		w.WriteHeader(http.StatusAccepted)
+		w.Write(twoFactorChallengeJSON(createTwoFactorChallenge(user)))
+		return
+	}
+
+	apiStartSession(w, r, user)
+	w.Write(successfulLoginJSON(user))
+}
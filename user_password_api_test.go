@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestUserPasswordForgotHandlerSuccess(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	outbox := new(bytes.Buffer)
+	mailer = &LogMailer{W: outbox}
+
+	factoryCreateUser("user@site.com")
+
+	r, _ := http.NewRequest("POST", "/users/password/forgot", strings.NewReader("email=user@site.com"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+	w := httptest.NewRecorder()
+
+	router().ServeHTTP(w, r)
+	passwordResetMail.Wait()
+
+	if w.Code != 202 {
+		t.Errorf("Expected 202, got %d", w.Code)
+	}
+	if m := outbox.String(); !strings.Contains(m, "To: user@site.com") || !strings.Contains(m, "token=") {
+		t.Errorf("Expected reset mail, got %q", m)
+	}
+}
+
+func TestUserPasswordForgotHandlerUnknownEmail(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	outbox := new(bytes.Buffer)
+	mailer = &LogMailer{W: outbox}
+
+	r, _ := http.NewRequest("POST", "/users/password/forgot", strings.NewReader("email=nobody@site.com"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+	w := httptest.NewRecorder()
+
+	router().ServeHTTP(w, r)
+
+	if w.Code != 202 {
+		t.Errorf("Expected 202, got %d", w.Code)
+	}
+	if outbox.Len() != 0 {
+		t.Errorf("Expected no mail, got %q", outbox.String())
+	}
+}
+
+func TestUserPasswordForgotHandlerMalformedForm(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	r, _ := http.NewRequest("POST", "/users/password/forgot", strings.NewReader("email=%zz"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+
+	router().ServeHTTP(w, r)
+
+	if w.Code != 400 {
+		t.Errorf("Expected 400, got %d", w.Code)
+	}
+}
+
+func TestUserPasswordForgotHandlerThrottled(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	outbox := new(bytes.Buffer)
+	mailer = &LogMailer{W: outbox}
+
+	factoryCreateUser("user@site.com")
+
+	forgot := func(email string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("POST", "/users/password/forgot", strings.NewReader("email="+email))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		router().ServeHTTP(w, r)
+		passwordResetMail.Wait()
+		return w
+	}
+
+	// Known and unknown addresses are throttled alike
+	for _, email := range []string{"user@site.com", "nobody@site.com"} {
+		var codes []int
+		for i := 0; i < 5; i++ {
+			codes = append(codes, forgot(email).Code)
+		}
+		if codes[0] != 202 || codes[4] != 429 {
+			t.Errorf("Expected %s to be throttled, got %v", email, codes)
+		}
+	}
+
+	if sent := strings.Count(outbox.String(), "To: user@site.com"); sent != 4 {
+		t.Errorf("Expected 4 reset mails, got %d", sent)
+	}
+}
+
+func TestUserPasswordResetHandlerSuccess(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	token := createPasswordReset(user)
+
+	r, _ := http.NewRequest("POST", "/users/password/reset", strings.NewReader("token="+token+"&password=newpassword"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+	w := httptest.NewRecorder()
+
+	router().ServeHTTP(w, r)
+
+	if w.Code != 200 {
+		t.Errorf("Expected 200, got %d", w.Code)
+	}
+
+	updated := findUserByID(int64(user.ID))
+	if !updated.validPasswordForUser("newpassword") {
+		t.Errorf("Expected password to be updated")
+	}
+	if updated.AuthToken == user.AuthToken {
+		t.Errorf("Expected auth token to be revoked")
+	}
+	if match, _ := regexp.MatchString(updated.AuthToken, w.Body.String()); !match {
+		t.Errorf("Expected response to contain the new token")
+	}
+
+	// The token is single use
+	r, _ = http.NewRequest("POST", "/users/password/reset", strings.NewReader("token="+token+"&password=another"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+	w = httptest.NewRecorder()
+
+	router().ServeHTTP(w, r)
+
+	if w.Code != 400 {
+		t.Errorf("Expected 400, got %d", w.Code)
+	}
+}
+
+func TestUserPasswordResetHandlerTwoFactor(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	user.BeginTwoFactorEnrollment()
+	user.EnableTwoFactor()
+	token := createPasswordReset(user)
+
+	r, _ := http.NewRequest("POST", "/users/password/reset", strings.NewReader("token="+token+"&password=newpassword"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+	w := httptest.NewRecorder()
+
+	router().ServeHTTP(w, r)
+
+	if w.Code != 202 {
+		t.Errorf("Expected 202, got %d", w.Code)
+	}
+	updated := findUserByID(int64(user.ID))
+	if b := w.Body.String(); !strings.Contains(b, "\"two_factor_required\":true") || strings.Contains(b, updated.AuthToken) {
+		t.Errorf("Expected a 2FA challenge without a token, got %q", b)
+	}
+	if len(w.Result().Cookies()) > 0 {
+		t.Errorf("Expected no session cookie")
+	}
+	if !updated.validPasswordForUser("newpassword") {
+		t.Errorf("Expected password to be updated")
+	}
+}
+
+func TestUserPasswordResetHandlerFailInvalidToken(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	r, _ := http.NewRequest("POST", "/users/password/reset", strings.NewReader("token=garbage&password=newpassword"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+	w := httptest.NewRecorder()
+
+	router().ServeHTTP(w, r)
+
+	if w.Code != 400 {
+		t.Errorf("Expected 400, got %d", w.Code)
+	}
+	expectedBody := "{\"token\":\"is invalid\"}"
+	if b := w.Body.String(); b != expectedBody {
+		t.Errorf("Expected %q, got %q", expectedBody, b)
+	}
+}
@@ -36,7 +36,7 @@ func TestFindUserByID(t *testing.T) {
 
 	foundUser := findUserByID(int64(user.ID))
 	if foundUser.ID != user.ID {
-		t.Errorf("Expected user %q, got  %q", user, foundUser)
+		t.Errorf("Expected user %d, got  %d", user.ID, foundUser.ID)
 	}
 }
 
@@ -49,7 +49,7 @@ func TestFindUserByEmail(t *testing.T) {
 
 	foundUser := findUserByEmail(email)
 	if foundUser.ID != user.ID {
-		t.Errorf("Expected user %q, got  %q", user, foundUser)
+		t.Errorf("Expected user %d, got  %d", user.ID, foundUser.ID)
 	}
 }
 
@@ -62,7 +62,7 @@ func TestFindUserByAuthToken(t *testing.T) {
 
 	foundUser := findUserByAuthToken(user.AuthToken)
 	if foundUser.ID != user.ID {
-		t.Errorf("Expected user %q, got  %q", user, foundUser)
+		t.Errorf("Expected user %d, got  %d", user.ID, foundUser.ID)
 	}
 }
 
@@ -77,3 +77,47 @@ func TestValidPasswordForUser(t *testing.T) {
 		t.Errorf("Expected password to be valid for user")
 	}
 }
+
+func TestCreateUserNormalizesEmail(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	userForm := UserRegisterForm{Email: " User@Site.COM ", Password: "mypassword"}
+	user := createUser(&userForm)
+
+	if user.Email != "user@site.com" {
+		t.Errorf("Expected email to be normalized, got %q", user.Email)
+	}
+	if found := findUserByEmail("USER@site.com"); found == nil || found.ID != user.ID {
+		t.Errorf("Expected lookup to ignore case")
+	}
+}
+
+func TestValidateEmail(t *testing.T) {
+	for _, email := range []string{"user@site.com", "first.last+tag@mail.site.co.uk"} {
+		if !ValidateEmail(email) {
+			t.Errorf("Expected %q to be valid", email)
+		}
+	}
+	for _, email := range []string{"", "user", "user@site", "User <user@site.com>", "user@@site.com"} {
+		if ValidateEmail(email) {
+			t.Errorf("Expected %q to be invalid", email)
+		}
+	}
+}
+
+func TestUserVerified(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	userForm := UserRegisterForm{Email: "user@site.com", Password: "mypassword"}
+	user := createUser(&userForm)
+	if user.Verified() {
+		t.Errorf("Expected new user not to be verified")
+	}
+
+	user.MarkEmailVerified()
+	if !findUserByID(int64(user.ID)).Verified() {
+		t.Errorf("Expected user to be verified")
+	}
+}
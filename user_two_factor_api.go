@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/schema"
+)
+
+type twoFactorParameters struct {
+	Code           string `schema:"code"`
+	RecoveryCode   string `schema:"recovery_code"`
+	Password       string `schema:"password"`
+	ChallengeToken string `schema:"challenge_token"`
+}
+
+type twoFactorEnrollResponse struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauth_uri"`
+}
+
+type recoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type twoFactorChallengeResponse struct {
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	ChallengeToken    string `json:"challenge_token"`
+}
+
+func decodeTwoFactorParameters(r *http.Request) *twoFactorParameters {
+	err := r.ParseForm()
+	checkErr(err, "parsing form")
+
+	params := new(twoFactorParameters)
+	decoder := schema.NewDecoder()
+	decoder.IgnoreUnknownKeys(true)
+	decoder.Decode(params, r.PostForm)
+	return params
+}
+
+// userTwoFactorEnrollHandler issues a new secret; 2FA stays off until confirmed
+func userTwoFactorEnrollHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Authenticate
+	user := apiAuthenticateUser(r)
+	if user == nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if !apiRequireScope(w, r, user, scopeAccount) {
+		return
+	}
+
+	if user.TOTPEnabled {
+		apiErrorHandler(w, r, http.StatusConflict, []APIError{{Field: "two_factor", Message: "is already enabled"}})
+		return
+	}
+
+	secret := user.BeginTwoFactorEnrollment()
+
+	response := twoFactorEnrollResponse{Secret: secret, OTPAuthURI: totpURI(secret, user.Email)}
+	responseJSON, _ := json.Marshal(response)
+	w.Write(responseJSON)
+}
+
+// userTwoFactorConfirmHandler enables 2FA once a code from the new secret checks out
+func userTwoFactorConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Authenticate
+	user := apiAuthenticateUser(r)
+	if user == nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if !apiRequireScope(w, r, user, scopeAccount) {
+		return
+	}
+
+	params := decodeTwoFactorParameters(r)
+
+	if user.TOTPEnabled {
+		apiErrorHandler(w, r, http.StatusConflict, []APIError{{Field: "two_factor", Message: "is already enabled"}})
+		return
+	}
+	if len(user.TOTPSecret) == 0 {
+		apiErrorHandler(w, r, http.StatusBadRequest, []APIError{{Field: "two_factor", Message: "is not enrolled"}})
+		return
+	}
+	if !apiCheckSecondFactor(w, r, user, params.Code, "") {
+		return
+	}
+
+	user.EnableTwoFactor()
+	w.Write(recoveryCodesJSON(user.RegenerateRecoveryCodes()))
+}
+
+// userTwoFactorDisableHandler turns 2FA off, requiring the password and a second factor
+func userTwoFactorDisableHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Authenticate
+	user := apiAuthenticateUser(r)
+	if user == nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if !apiRequireScope(w, r, user, scopeAccount) {
+		return
+	}
+
+	params := decodeTwoFactorParameters(r)
+
+	if !user.TOTPEnabled {
+		apiErrorHandler(w, r, http.StatusBadRequest, []APIError{{Field: "two_factor", Message: "is not enabled"}})
+		return
+	}
+	if !user.validPasswordForUser(params.Password) {
+		apiErrorHandler(w, r, http.StatusForbidden, []APIError{{Field: "password", Message: "is invalid"}})
+		return
+	}
+	if !apiCheckSecondFactor(w, r, user, params.Code, params.RecoveryCode) {
+		return
+	}
+
+	user.DisableTwoFactor()
+	w.Write([]byte("{}"))
+}
+
+// userRecoveryCodesHandler replaces the recovery codes, invalidating the old set
+func userRecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Authenticate
+	user := apiAuthenticateUser(r)
+	if user == nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if !apiRequireScope(w, r, user, scopeAccount) {
+		return
+	}
+
+	params := decodeTwoFactorParameters(r)
+
+	if !user.TOTPEnabled {
+		apiErrorHandler(w, r, http.StatusBadRequest, []APIError{{Field: "two_factor", Message: "is not enabled"}})
+		return
+	}
+	if !apiCheckSecondFactor(w, r, user, params.Code, "") {
+		return
+	}
+
+	w.Write(recoveryCodesJSON(user.RegenerateRecoveryCodes()))
+}
+
+// userLoginTwoFactorHandler completes a password login for accounts with 2FA
+func userLoginTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	params := decodeTwoFactorParameters(r)
+
+	var paramErrors []APIError
+
+	if len(params.ChallengeToken) == 0 {
+		paramErrors = append(paramErrors, APIError{Field: "challenge_token", Message: "is required"})
+	}
+
+	if len(params.Code) == 0 && len(params.RecoveryCode) == 0 {
+		paramErrors = append(paramErrors, APIError{Field: "code", Message: "is required"})
+	}
+
+	if len(paramErrors) > 0 {
+		apiErrorHandler(w, r, http.StatusBadRequest, paramErrors)
+		return
+	}
+
+	challenge := findTwoFactorChallengeByToken(params.ChallengeToken)
+	var user *User
+	if challenge != nil {
+		user = findUserByID(int64(challenge.UserID))
+	}
+	if user == nil {
+		apiErrorHandler(w, r, http.StatusForbidden, []APIError{{Field: "challenge_token", Message: "is invalid"}})
+		return
+	}
+
+	if !apiCheckSecondFactor(w, r, user, params.Code, params.RecoveryCode) {
+		return
+	}
+
+	if !challenge.Use() {
+		apiErrorHandler(w, r, http.StatusForbidden, []APIError{{Field: "challenge_token", Message: "is invalid"}})
+		return
+	}
+
+	// Browser clients get a session cookie alongside the token
+	apiStartSession(w, r, user)
+
+	// Success message
+	w.WriteHeader(http.StatusCreated)
+
+	// Authenticate
+	w.Write(successfulLoginJSON(user))
+}
+
+// apiCheckSecondFactor verifies a TOTP or recovery code, throttling guesses
+// per account. It writes the error response and returns false on failure.
+func apiCheckSecondFactor(w http.ResponseWriter, r *http.Request, user *User, code string, recoveryCode string) bool {
+	key := fmt.Sprintf("2fa:user:%d", user.ID)
+
+	if wait := loginAccountLimiter.Wait(key); wait > 0 {
+		apiErrorHandler(w, r, http.StatusTooManyRequests, []APIError{{Field: "code", Message: "too many attempts"}})
+		return false
+	}
+
+	if !user.VerifySecondFactor(code, recoveryCode) {
+		loginAccountLimiter.Fail(key)
+		apiErrorHandler(w, r, http.StatusForbidden, []APIError{{Field: "code", Message: "is invalid"}})
+		return false
+	}
+
+	loginAccountLimiter.Succeed(key)
+	return true
+}
+
+func recoveryCodesJSON(codes []string) []byte {
+	response := recoveryCodesResponse{RecoveryCodes: codes}
+	responseJSON, _ := json.Marshal(response)
+	return responseJSON
+}
+
+func twoFactorChallengeJSON(token string) []byte {
+	response := twoFactorChallengeResponse{TwoFactorRequired: true, ChallengeToken: token}
+	responseJSON, _ := json.Marshal(response)
+	return responseJSON
+}
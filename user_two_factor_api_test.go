@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func twoFactorRequest(path string, token string, params url.Values) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest("POST", path, strings.NewReader(params.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+	if len(token) > 0 {
+		r.Header.Add("X-Auth-Token", token)
+	}
+	w := httptest.NewRecorder()
+	router().ServeHTTP(w, r)
+	return w
+}
+
+func TestUserTwoFactorEnrollAndLogin(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+
+	// Enroll
+	w := twoFactorRequest("/users/2fa/enroll", user.AuthToken, url.Values{})
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+	enroll := twoFactorEnrollResponse{}
+	json.Unmarshal(w.Body.Bytes(), &enroll)
+	if len(enroll.Secret) == 0 || !strings.HasPrefix(enroll.OTPAuthURI, "otpauth://totp/") {
+		t.Fatalf("Unexpected enroll response %q", w.Body.String())
+	}
+
+	// Confirm
+	step := time.Now().Unix() / totpPeriod
+	w = twoFactorRequest("/users/2fa/confirm", user.AuthToken, url.Values{"code": {totpCode(enroll.Secret, step)}})
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+	codes := recoveryCodesResponse{}
+	json.Unmarshal(w.Body.Bytes(), &codes)
+	if len(codes.RecoveryCodes) != recoveryCodeSize {
+		t.Errorf("Expected recovery codes, got %q", w.Body.String())
+	}
+
+	// Password login now returns a challenge instead of a token
+	w = twoFactorRequest("/users/login", "", url.Values{"email": {"user@site.com"}, "password": {"password"}})
+	if w.Code != 202 {
+		t.Fatalf("Expected 202, got %d", w.Code)
+	}
+	challenge := twoFactorChallengeResponse{}
+	json.Unmarshal(w.Body.Bytes(), &challenge)
+	if !challenge.TwoFactorRequired || len(challenge.ChallengeToken) == 0 {
+		t.Fatalf("Unexpected challenge response %q", w.Body.String())
+	}
+
+	// A wrong code is rejected
+	w = twoFactorRequest("/users/login/2fa", "", url.Values{"challenge_token": {challenge.ChallengeToken}, "code": {"000000"}})
+	if w.Code != 403 {
+		t.Errorf("Expected 403, got %d", w.Code)
+	}
+
+	// A recovery code completes the login
+	w = twoFactorRequest("/users/login/2fa", "", url.Values{"challenge_token": {challenge.ChallengeToken}, "recovery_code": {codes.RecoveryCodes[0]}})
+	if w.Code != 201 {
+		t.Errorf("Expected 201, got %d", w.Code)
+	}
+	if b := w.Body.String(); !strings.Contains(b, user.AuthToken) {
+		t.Errorf("Expected token, got %q", b)
+	}
+
+	// The challenge is single use
+	w = twoFactorRequest("/users/login/2fa", "", url.Values{"challenge_token": {challenge.ChallengeToken}, "recovery_code": {codes.RecoveryCodes[1]}})
+	if w.Code != 403 {
+		t.Errorf("Expected 403, got %d", w.Code)
+	}
+}
+
+func TestUserTwoFactorDisable(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := factoryCreateUser("user@site.com")
+	user.BeginTwoFactorEnrollment()
+	user.EnableTwoFactor()
+	codes := user.RegenerateRecoveryCodes()
+
+	// Requires the password
+	w := twoFactorRequest("/users/2fa/disable", user.AuthToken, url.Values{"password": {"wrong"}, "recovery_code": {codes[0]}})
+	if w.Code != 403 {
+		t.Errorf("Expected 403, got %d", w.Code)
+	}
+
+	w = twoFactorRequest("/users/2fa/disable", user.AuthToken, url.Values{"password": {"password"}, "recovery_code": {codes[0]}})
+	if w.Code != 200 {
+		t.Errorf("Expected 200, got %d", w.Code)
+	}
+	if findUserByID(int64(user.ID)).TOTPEnabled {
+		t.Errorf("Expected two factor to be disabled")
+	}
+}
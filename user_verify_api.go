@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gorilla/schema"
+)
+
+type userVerifyParameters struct {
+	Token string `schema:"token"`
+}
+
+func userVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	err := r.ParseForm()
+	checkErr(err, "parsing form")
+
+	params := new(userVerifyParameters)
+	decoder := schema.NewDecoder()
+	decoder.IgnoreUnknownKeys(true)
+	err = decoder.Decode(params, r.PostForm)
+
+	if len(params.Token) == 0 {
+		apiErrorHandler(w, r, http.StatusBadRequest, []APIError{{Field: "token", Message: "is required"}})
+		return
+	}
+
+	// Validate and spend the token
+	verification := findEmailVerificationByToken(params.Token)
+	if verification == nil || !verification.Use() {
+		apiErrorHandler(w, r, http.StatusBadRequest, []APIError{{Field: "token", Message: "is invalid"}})
+		return
+	}
+
+	user := findUserByID(int64(verification.UserID))
+	if user == nil {
+		apiErrorHandler(w, r, http.StatusBadRequest, []APIError{{Field: "token", Message: "is invalid"}})
+		return
+	}
+
+	// Email changes move the account once the new address is confirmed
+	if verification.EmailChange {
+		if existing := findUserByEmail(verification.Email); existing != nil && existing.ID != user.ID {
+			apiErrorHandler(w, r, http.StatusConflict, []APIError{{Field: "email", Message: "already exists"}})
+			return
+		}
+
+		user.ChangeEmail(verification.Email)
+		w.Write([]byte("{}"))
+		return
+	}
+
+	// The address must still belong to the user
+	if user.Email != verification.Email {
+		apiErrorHandler(w, r, http.StatusBadRequest, []APIError{{Field: "token", Message: "is invalid"}})
+		return
+	}
+
+	user.MarkEmailVerified()
+
+	w.Write([]byte("{}"))
+}
+
+func userVerifyResendHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Authenticate
+	user := apiAuthenticateUser(r)
+	if user == nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if !apiRequireScope(w, r, user, scopeAccount) {
+		return
+	}
+
+	if !user.Verified() {
+		sendEmailVerification(user, user.Email)
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("{}"))
+}
+
+// apiRequireVerified writes a 403 and returns false if user may not take action yet
+func apiRequireVerified(w http.ResponseWriter, r *http.Request, user *User, action string) bool {
+	if unverifiedPolicy.Allows(user, action) {
+		return true
+	}
+
+	apiErrorHandler(w, r, http.StatusForbidden, []APIError{{Field: "email", Message: "is not verified"}})
+	return false
+}
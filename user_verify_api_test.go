@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestUserRegisterHandlerSendsVerification(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	outbox := new(bytes.Buffer)
+	mailer = &LogMailer{W: outbox}
+
+	r, _ := http.NewRequest("POST", "/users/register", strings.NewReader("email=User@Site.com&password=mypassword"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+	w := httptest.NewRecorder()
+
+	router().ServeHTTP(w, r)
+
+	if w.Code != 201 {
+		t.Errorf("Expected 201, got %d", w.Code)
+	}
+
+	token := regexp.MustCompile("token=([a-f0-9]+)").FindStringSubmatch(outbox.String())
+	if token == nil {
+		t.Fatalf("Expected verification mail, got %q", outbox.String())
+	}
+
+	r, _ = http.NewRequest("POST", "/users/verify", strings.NewReader("token="+url.QueryEscape(token[1])))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+	w = httptest.NewRecorder()
+
+	router().ServeHTTP(w, r)
+
+	if w.Code != 200 {
+		t.Errorf("Expected 200, got %d", w.Code)
+	}
+	if user := findUserByEmail("user@site.com"); !user.Verified() {
+		t.Errorf("Expected user to be verified")
+	}
+}
+
+func TestUserRegisterHandlerFailInvalidEmail(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	r, _ := http.NewRequest("POST", "/users/register", strings.NewReader("email=notanemail&password=mypassword"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+	w := httptest.NewRecorder()
+
+	router().ServeHTTP(w, r)
+
+	if w.Code != 400 {
+		t.Errorf("Expected 400, got %d", w.Code)
+	}
+	expectedBody := "{\"email\":\"is invalid\"}"
+	if b := w.Body.String(); b != expectedBody {
+		t.Errorf("Expected %q, got %q", expectedBody, b)
+	}
+}
+
+func TestUserVerifyHandlerFailInvalidToken(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	r, _ := http.NewRequest("POST", "/users/verify", strings.NewReader("token=garbage"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+	w := httptest.NewRecorder()
+
+	router().ServeHTTP(w, r)
+
+	if w.Code != 400 {
+		t.Errorf("Expected 400, got %d", w.Code)
+	}
+}
+
+func TestShareCreateHandlerFailUnverified(t *testing.T) {
+	db := testDbSetup()
+	defer db.Close()
+
+	user := createUser(&UserRegisterForm{Email: "user@site.com", Password: "password"})
+	note := createNote(user, "title", "body")
+
+	postBody := strings.NewReader(fmt.Sprintf("note_id=%d&permissions=read", note.ID))
+	r, _ := http.NewRequest("POST", "/shares", postBody)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+	r.Header.Add("X-Auth-Token", user.AuthToken)
+	w := httptest.NewRecorder()
+
+	router().ServeHTTP(w, r)
+
+	if w.Code != 403 {
+		t.Errorf("Expected 403, got %d", w.Code)
+	}
+	expectedBody := "{\"email\":\"is not verified\"}"
+	if b := w.Body.String(); b != expectedBody {
+		t.Errorf("Expected %q, got %q", expectedBody, b)
+	}
+}